@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// Bump to invalidate every existing cache entry (e.g. when the key format changes)
+const cacheKeyVersion = "1"
+
+// cache is nil when disabled (-cache-size-mb 0)
+var cache *buildCache
+
+// errCacheMiss is returned by Restore when there is no entry for a key
+var errCacheMiss = errors.New("cache miss")
+
+// cacheMeta is stored next to the outputs of an entry
+type cacheMeta struct {
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"` // For LRU eviction
+}
+
+// buildCache is a content-addressed store of job outputs on the agent machine.
+// Each entry is a directory named after the key, holding meta.json and the
+// outputs under files/. Entries are written to a temporary directory first and
+// renamed into place, so a crash never leaves a half-written entry behind.
+type buildCache struct {
+	dir     string
+	maxSize int64 // Bytes; the least recently used entries are evicted above it
+
+	mu sync.Mutex
+}
+
+func newBuildCache(dir string, maxSize int64) (*buildCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &buildCache{dir: dir, maxSize: maxSize}, nil
+}
+
+// defaultCacheDir is the per-user cache directory, or a temp directory without one
+func defaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "devair", "build-cache")
+	}
+	return filepath.Join(os.TempDir(), "devair-build-cache")
+}
+
+// Key hashes everything that determines a job's outputs: the commands, the cache
+// spec and the path and content of every input file. Secrets are left out.
+func (bc *buildCache) Key(cmdPayload protocol.CommandPayload, workDir string) (string, error) {
+	h := sha256.New()
+	spec, _ := json.Marshal(struct {
+		Version string
+		Type    string
+		Command string
+		Steps   []protocol.JobStep
+		Cache   *protocol.CacheSpec
+	}{cacheKeyVersion, cmdPayload.Type, cmdPayload.Command, cmdPayload.Steps, cmdPayload.Cache})
+	h.Write(spec)
+
+	files, err := matchCacheInputs(workDir, cmdPayload.Cache.Inputs)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no files match the cache inputs")
+	}
+	for _, rel := range files {
+		f, err := os.Open(filepath.Join(workDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return "", err
+		}
+		fileHash := sha256.New()
+		_, err = io.Copy(fileHash, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%x\n", rel, fileHash.Sum(nil))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Restore replaces the outputs in workDir with the cached ones
+func (bc *buildCache) Restore(key string, outputs []string, workDir string) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	entry := filepath.Join(bc.dir, key)
+	meta, err := readCacheMeta(entry)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return errCacheMiss
+		}
+		return err
+	}
+
+	for _, out := range outputs {
+		// Validated with the payload, but never delete more than the output
+		rel := filepath.FromSlash(out)
+		if !filepath.IsLocal(rel) || filepath.Clean(rel) == "." {
+			return fmt.Errorf("cache output %q is not below the working directory", out)
+		}
+		dst := filepath.Join(workDir, rel)
+		if err := os.RemoveAll(dst); err != nil {
+			return err
+		}
+		src := filepath.Join(entry, "files", filepath.FromSlash(out))
+		if _, err := os.Lstat(src); errors.Is(err, fs.ErrNotExist) {
+			continue // The job didn't produce this output
+		}
+		if err := copyTree(src, dst); err != nil {
+			return err
+		}
+	}
+
+	meta.LastUsed = time.Now()
+	return writeCacheMeta(entry, meta)
+}
+
+// Store saves the outputs of a successful run under key and evicts old entries
+func (bc *buildCache) Store(key string, outputs []string, workDir string) error {
+	tmp, err := os.MkdirTemp(bc.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, out := range outputs {
+		src := filepath.Join(workDir, filepath.FromSlash(out))
+		if _, err := os.Lstat(src); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := copyTree(src, filepath.Join(tmp, "files", filepath.FromSlash(out))); err != nil {
+			return err
+		}
+	}
+
+	size, err := treeSize(tmp)
+	if err != nil {
+		return err
+	}
+	if size > bc.maxSize {
+		return fmt.Errorf("outputs (%d bytes) exceed the cache size limit", size)
+	}
+	now := time.Now()
+	if err := writeCacheMeta(tmp, cacheMeta{Key: key, Size: size, CreatedAt: now, LastUsed: now}); err != nil {
+		return err
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	entry := filepath.Join(bc.dir, key)
+	os.RemoveAll(entry)
+	if err := os.Rename(tmp, entry); err != nil {
+		return err
+	}
+	bc.evict()
+	return nil
+}
+
+// evict removes the least recently used entries until the cache fits maxSize.
+// Called with mu held.
+func (bc *buildCache) evict() {
+	dirEntries, err := os.ReadDir(bc.dir)
+	if err != nil {
+		return
+	}
+
+	var entries []cacheMeta
+	var total int64
+	for _, d := range dirEntries {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			continue
+		}
+		meta, err := readCacheMeta(filepath.Join(bc.dir, d.Name()))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, meta)
+		total += meta.Size
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.Before(entries[j].LastUsed) })
+	for _, e := range entries {
+		if total <= bc.maxSize {
+			break
+		}
+		if err := os.RemoveAll(filepath.Join(bc.dir, e.Key)); err != nil {
+			log.Printf("Cache: failed to evict %s: %v", e.Key, err)
+			continue
+		}
+		total -= e.Size
+		log.Printf("Cache: evicted %s (%d bytes)", shortKey(e.Key), e.Size)
+	}
+}
+
+func readCacheMeta(entry string) (cacheMeta, error) {
+	var meta cacheMeta
+	data, err := os.ReadFile(filepath.Join(entry, "meta.json"))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+func writeCacheMeta(entry string, meta cacheMeta) error {
+	data, _ := json.Marshal(meta)
+	return os.WriteFile(filepath.Join(entry, "meta.json"), data, 0o644)
+}
+
+func shortKey(key string) string {
+	if len(key) > 12 {
+		return key[:12]
+	}
+	return key
+}
+
+// matchCacheInputs returns the slash-separated paths of the files under workDir
+// matching any of the globs, sorted. "**" matches any number of directories and
+// a glob matching a directory includes everything below it.
+func matchCacheInputs(workDir string, inputs []string) ([]string, error) {
+	var globs []string
+	for _, g := range inputs {
+		globs = append(globs, g, strings.TrimSuffix(g, "/")+"/**")
+	}
+
+	var files []string
+	err := filepath.WalkDir(workDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(workDir, p)
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			for _, g := range globs {
+				if globMayMatchUnder(g, rel) {
+					return nil
+				}
+			}
+			return filepath.SkipDir
+		}
+		for _, g := range globs {
+			if globMatch(g, rel) {
+				files = append(files, rel)
+				break
+			}
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func globMatch(pattern, name string) bool {
+	return matchSegments(strings.Split(path.Clean(pattern), "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// globMayMatchUnder reports whether files below dir could match pattern,
+// so whole trees like node_modules are skipped unless a glob names them
+func globMayMatchUnder(pattern, dir string) bool {
+	segments := strings.Split(path.Clean(pattern), "/")
+	for i, d := range strings.Split(dir, "/") {
+		if i >= len(segments)-1 {
+			// The last segment matches files, not directories
+			return i < len(segments) && segments[i] == "**"
+		}
+		if segments[i] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(segments[i], d); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// copyTree copies a file, symlink or directory, keeping file modes
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		}
+		return nil // Sockets, devices, ...
+	})
+}
+
+func copyFile(src, dst string, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func treeSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
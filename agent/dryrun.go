@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// simulation is nil unless the agent runs with -dry-run
+var simulation *simulator
+
+// Pause between simulated output lines and stages (set by the -dry-run-delay flag)
+var dryRunDelay = 300 * time.Millisecond
+
+// Port reported for simulated services that don't set one
+const simulatedServicePort = 5173
+
+// Fake output of a build command
+var simulatedBuildOutput = []string{
+	"Resolving dependencies...",
+	"Compiling 128 modules...",
+	"transforming (64) src/components/App.jsx",
+	"transforming (128) src/main.jsx",
+	"rendering chunks...",
+	"dist/index.html                  0.46 kB",
+	"dist/assets/index.css            8.12 kB",
+	"dist/assets/index.js           143.52 kB",
+}
+
+// Fake test suite; with "simulate": "fail" the last test fails
+var simulatedTests = []protocol.TestCaseResult{
+	{Suite: "auth", Name: "logs in with valid credentials", Status: protocol.TestStatusPass, DurationMs: 42},
+	{Suite: "auth", Name: "rejects a wrong password", Status: protocol.TestStatusPass, DurationMs: 18},
+	{Suite: "api", Name: "lists projects", Status: protocol.TestStatusPass, DurationMs: 65},
+	{Suite: "api", Name: "paginates jobs", Status: protocol.TestStatusSkip},
+	{Suite: "ui", Name: "renders the dashboard", Status: protocol.TestStatusPass, DurationMs: 120},
+}
+
+// simulator stands in for the command handlers in dry-run mode. Every command is
+// accepted and answered with the messages a real run would send (logs, steps,
+// AI stages, test results, service states), but nothing is executed, no app is
+// launched and no keystrokes are sent.
+//
+// Commands with Params["simulate"] == "fail" fail the way a real run would.
+type simulator struct {
+	conn *safeConn
+
+	mu       sync.Mutex
+	windows  map[string]bool // Apps "opened" by OPEN_APP, OPEN_IDE and FIND
+	services map[string]protocol.ServiceStatusPayload
+}
+
+func newSimulator(c *safeConn) *simulator {
+	return &simulator{
+		conn:     c,
+		windows:  make(map[string]bool),
+		services: make(map[string]protocol.ServiceStatusPayload),
+	}
+}
+
+// Run simulates one command
+func (s *simulator) Run(cmdPayload protocol.CommandPayload) {
+	log.Printf("[dry-run] Simulating %s (%s)", cmdPayload.Type, cmdPayload.JobID)
+
+	var err error
+	var result string
+	switch cmdPayload.Type {
+	case "OPEN_APP":
+		err = s.openApp(cmdPayload.App)
+	case "OPEN_IDE":
+		s.openWindow("code")
+	case "AI_INSTRUCTION":
+		s.aiInstruction(cmdPayload)
+	case "UI_ACTION":
+		err = s.uiAction(cmdPayload)
+	case "TEST":
+		result, err = s.test(cmdPayload)
+	case "SERVICE_START":
+		err = s.startService(cmdPayload)
+	case "SERVICE_STOP":
+		err = s.stopService(serviceName(cmdPayload.Params))
+	case "SERVICE_STATUS":
+		statuses := s.serviceStatuses(cmdPayload.Params["name"])
+		for _, st := range statuses {
+			s.conn.Send(protocol.EventTypeServiceStatus, st)
+		}
+		data, _ := json.Marshal(statuses)
+		result = string(data)
+	default:
+		err = s.build(cmdPayload)
+	}
+
+	update := protocol.JobUpdatePayload{
+		JobID:  cmdPayload.JobID,
+		Status: protocol.JobStatusCompleted,
+		Result: result,
+	}
+	if err != nil {
+		log.Printf("[dry-run] Simulated failure: %v", err)
+		update.Status = protocol.JobStatusFailed
+		update.Error = err.Error()
+	}
+	s.conn.Send(protocol.EventTypeJobUpdate, update)
+}
+
+func (s *simulator) openApp(name string) error {
+	if _, ok := appLauncher[strings.ToLower(name)]; !ok {
+		return fmt.Errorf("unknown app %q", name)
+	}
+	log.Printf("[dry-run] Would launch %s", name)
+	s.openWindow(name)
+	return nil
+}
+
+func (s *simulator) openWindow(name string) {
+	s.mu.Lock()
+	s.windows[strings.ToLower(name)] = true
+	s.mu.Unlock()
+}
+
+func (s *simulator) windowOpen(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.windows[strings.ToLower(name)]
+}
+
+func (s *simulator) aiInstruction(cmdPayload protocol.CommandPayload) {
+	stages := []string{"Analyzing request...", "Planning execution...", "Generating code...", "Done!"}
+	for _, stage := range stages {
+		s.conn.Send(protocol.EventTypeAIStageUpdate, protocol.AIStagePayload{
+			JobID:   cmdPayload.JobID,
+			Stage:   stage,
+			Message: fmt.Sprintf("Processing: %s", cmdPayload.Prompt),
+		})
+		pause(3)
+	}
+}
+
+// uiAction mirrors the checks of the real handler: FIND launches known apps
+// that aren't open yet, TYPE needs its target window
+func (s *simulator) uiAction(cmdPayload protocol.CommandPayload) error {
+	target := cmdPayload.Target
+	switch cmdPayload.Action {
+	case "FIND":
+		if s.windowOpen(target) {
+			break
+		}
+		if _, ok := appLauncher[strings.ToLower(target)]; !ok {
+			return fmt.Errorf("Window '%s' not found", target)
+		}
+		log.Printf("[dry-run] Would launch %s", target)
+		s.openWindow(target)
+		pause(10)
+	case "TYPE":
+		if target != "" && !s.windowOpen(target) {
+			return fmt.Errorf("Target '%s' not focused. Aborting TYPE.", target)
+		}
+		log.Printf("[dry-run] Would type '%s'", cmdPayload.Value)
+	case "CLICK":
+		log.Printf("[dry-run] Would press %s", cmdPayload.Value)
+	}
+	return nil
+}
+
+// build streams fake output for the command or each step
+func (s *simulator) build(cmdPayload protocol.CommandPayload) error {
+	fail := shouldFail(cmdPayload)
+	if len(cmdPayload.Steps) == 0 {
+		return s.output(cmdPayload, cmdPayload.Command, simulatedBuildOutput, fail)
+	}
+
+	var jobErr error
+	for i, step := range cmdPayload.Steps {
+		update := protocol.StepUpdatePayload{
+			JobID: cmdPayload.JobID,
+			Index: i,
+			Name:  stepName(step, i),
+		}
+		if jobErr != nil {
+			update.Status = protocol.StepStatusSkipped
+			s.conn.Send(protocol.EventTypeStepUpdate, update)
+			continue
+		}
+
+		update.Status = protocol.JobStatusRunning
+		update.StartedAt = time.Now().UnixMilli()
+		s.conn.Send(protocol.EventTypeStepUpdate, update)
+
+		// Only the last step fails, so the steps before it are seen completing
+		lines := simulatedBuildOutput[:3]
+		err := s.output(cmdPayload, step.Command, lines, fail && i == len(cmdPayload.Steps)-1)
+
+		code := 0
+		update.FinishedAt = time.Now().UnixMilli()
+		update.Status = protocol.JobStatusCompleted
+		if err != nil {
+			code = 1
+			update.Status = protocol.JobStatusFailed
+			update.Error = err.Error()
+			if !step.ContinueOnError {
+				jobErr = fmt.Errorf("step %s failed: %w", update.Name, err)
+			}
+		}
+		update.ExitCode = &code
+		s.conn.Send(protocol.EventTypeStepUpdate, update)
+	}
+	return jobErr
+}
+
+// output streams lines as the output of command, like runProcess would
+func (s *simulator) output(cmdPayload protocol.CommandPayload, command string, lines []string, fail bool) error {
+	out := newLogStreamer(s.conn, cmdPayload.JobID, jobRedactor(cmdPayload.Secrets), nil)
+	defer out.Flush()
+
+	fmt.Fprintf(out, "[dry-run] $ %s (not executed)\n", command)
+	for _, line := range lines {
+		pause(1)
+		fmt.Fprintln(out, line)
+	}
+	pause(1)
+	if fail {
+		fmt.Fprintln(out, "error: simulated failure")
+		return fmt.Errorf("exit status 1")
+	}
+	fmt.Fprintf(out, "Done in %.2fs\n", float64(len(lines)+1)*dryRunDelay.Seconds())
+	return nil
+}
+
+func (s *simulator) test(cmdPayload protocol.CommandPayload) (string, error) {
+	results := append([]protocol.TestCaseResult(nil), simulatedTests...)
+	if shouldFail(cmdPayload) {
+		last := &results[len(results)-1]
+		last.Status = protocol.TestStatusFail
+		last.Output = "expected dashboard to render 3 widgets, got 2"
+	}
+
+	// Output in TAP, as the format reported below
+	lines := []string{fmt.Sprintf("1..%d", len(results))}
+	for i, r := range results {
+		line := fmt.Sprintf("ok %d - %s > %s", i+1, r.Suite, r.Name)
+		switch r.Status {
+		case protocol.TestStatusFail:
+			line = "not " + line
+		case protocol.TestStatusSkip:
+			line += " # SKIP"
+		}
+		lines = append(lines, line)
+	}
+	runErr := s.output(cmdPayload, cmdPayload.Command, lines, false)
+
+	s.conn.Send(protocol.EventTypeTestResults, protocol.TestResultsPayload{
+		JobID:   cmdPayload.JobID,
+		Format:  protocol.TestFormatTAP,
+		Results: results,
+	})
+	summary := summarizeTestResults(results)
+	if summary.Failed > 0 {
+		return summary.String(), fmt.Errorf("exit status 1")
+	}
+	return summary.String(), runErr
+}
+
+// startService reports the states of a dev server coming up; the port is
+// reported but nothing listens on it
+func (s *simulator) startService(cmdPayload protocol.CommandPayload) error {
+	if cmdPayload.Command == "" {
+		return fmt.Errorf("no command given")
+	}
+	name := serviceName(cmdPayload.Params)
+	port := simulatedServicePort
+	if v := cmdPayload.Params["port"]; v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid port %q", v)
+		}
+		port = p
+	}
+
+	s.mu.Lock()
+	if st, ok := s.services[name]; ok && st.Status != protocol.ServiceStatusStopped {
+		s.mu.Unlock()
+		return fmt.Errorf("service %q is already running", name)
+	}
+	s.services[name] = protocol.ServiceStatusPayload{Name: name, Command: cmdPayload.Command}
+	s.mu.Unlock()
+	s.setServiceStatus(name, func(st *protocol.ServiceStatusPayload) {
+		st.Status = protocol.ServiceStatusStarting
+	})
+
+	out := newLogStreamer(s.conn, cmdPayload.JobID, jobRedactor(cmdPayload.Secrets), nil)
+	fmt.Fprintf(out, "[dry-run] $ %s (not executed)\n", cmdPayload.Command)
+	out.Flush()
+
+	// The job completes once the process is launched, the states follow
+	go func() {
+		pause(3)
+		running := s.setServiceStatus(name, func(st *protocol.ServiceStatusPayload) {
+			st.Status = protocol.ServiceStatusRunning
+			st.Port = port
+			st.URL = fmt.Sprintf("http://localhost:%d", port)
+		})
+		if !running {
+			return
+		}
+		fmt.Fprintf(out, "ready in 312 ms\nLocal: http://localhost:%d/\n", port)
+		out.Flush()
+		pause(3)
+		s.setServiceStatus(name, func(st *protocol.ServiceStatusPayload) {
+			st.Status = protocol.ServiceStatusHealthy
+		})
+	}()
+	return nil
+}
+
+func (s *simulator) stopService(name string) error {
+	s.mu.Lock()
+	st, ok := s.services[name]
+	s.mu.Unlock()
+	if !ok || st.Status == protocol.ServiceStatusStopped {
+		return fmt.Errorf("service %q is not running", name)
+	}
+	pause(1)
+	s.setServiceStatus(name, func(st *protocol.ServiceStatusPayload) {
+		st.Status = protocol.ServiceStatusStopped
+		st.Port = 0
+		st.URL = ""
+	})
+	return nil
+}
+
+// setServiceStatus changes a simulated service and broadcasts its new state.
+// A service stopped in the meantime keeps its STOPPED state (returns false).
+func (s *simulator) setServiceStatus(name string, change func(st *protocol.ServiceStatusPayload)) bool {
+	s.mu.Lock()
+	st, ok := s.services[name]
+	if !ok || st.Status == protocol.ServiceStatusStopped {
+		s.mu.Unlock()
+		return false
+	}
+	change(&st)
+	st.UpdatedAt = time.Now().UnixMilli()
+	s.services[name] = st
+	s.mu.Unlock()
+
+	s.conn.Send(protocol.EventTypeServiceStatus, st)
+	return true
+}
+
+func (s *simulator) serviceStatuses(name string) []protocol.ServiceStatusPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := []protocol.ServiceStatusPayload{}
+	for n, st := range s.services {
+		if name == "" || n == name {
+			statuses = append(statuses, st)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func shouldFail(cmdPayload protocol.CommandPayload) bool {
+	return cmdPayload.Params["simulate"] == "fail"
+}
+
+// pause waits n simulated delays
+func pause(n int) {
+	time.Sleep(time.Duration(n) * dryRunDelay)
+}
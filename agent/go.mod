@@ -2,4 +2,12 @@ module github.com/rohaaaaaan/devair-agent
 
 go 1.25.6
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/rohaaaaaan/devair-protocol v0.0.0
+)
+
+require github.com/ugorji/go/codec v1.3.0 // indirect
+
+// Shared wire protocol, developed in this repository
+replace github.com/rohaaaaaan/devair-protocol => ../protocol
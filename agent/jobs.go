@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// How long the agent remembers a job it received, to ignore the COMMANDs the
+// backend resends when an acknowledgement got lost
+const receivedJobsTTL = 24 * time.Hour
+
+// jobSet remembers job IDs for a while. Used by the read loop only.
+type jobSet struct {
+	ttl  time.Duration
+	seen map[string]time.Time
+}
+
+func newJobSet(ttl time.Duration) *jobSet {
+	return &jobSet{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// add records a job ID and reports whether it is new
+func (s *jobSet) add(jobID string) bool {
+	now := time.Now()
+	for id, at := range s.seen {
+		if now.Sub(at) > s.ttl {
+			delete(s.seen, id)
+		}
+	}
+	if _, ok := s.seen[jobID]; ok {
+		return false
+	}
+	s.seen[jobID] = now
+	return true
+}
+
+// commandQueue holds the COMMANDs waiting for the job worker. It has no bound:
+// a blocked read loop would stop acknowledging COMMANDs and serving previews.
+type commandQueue struct {
+	mu    sync.Mutex
+	items []protocol.CommandPayload
+	ready chan struct{} // Signalled when items go from empty to non-empty
+}
+
+func newCommandQueue() *commandQueue {
+	return &commandQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *commandQueue) push(cmd protocol.CommandPayload) {
+	q.mu.Lock()
+	q.items = append(q.items, cmd)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the oldest COMMAND
+func (q *commandQueue) pop() protocol.CommandPayload {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			cmd := q.items[0]
+			q.items[0] = protocol.CommandPayload{}
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return cmd
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+// runShellJob runs a generic command job (BUILD, ...) and reports its outcome.
+// Jobs with a cache spec are skipped when their outputs can be restored from the cache.
+func runShellJob(c *safeConn, cmdPayload protocol.CommandPayload, workDir string) {
+	var cacheKey string
+	if cmdPayload.Cache != nil && cache != nil {
+		var restored bool
+		cacheKey, restored = restoreFromCache(c, cmdPayload, workDir)
+		if restored {
+			return
+		}
+	}
+
+	resources, runErr := runCommand(c, cmdPayload, workDir, nil)
+	log.Println(">>> COMMAND FINISHED")
+
+	if runErr == nil && cacheKey != "" {
+		if err := cache.Store(cacheKey, cmdPayload.Cache.Outputs, workDir); err != nil {
+			log.Printf("Cache: failed to store outputs: %v", err)
+		} else {
+			log.Printf("Cache: stored outputs as %s", shortKey(cacheKey))
+		}
+	}
+
+	update := protocol.JobUpdatePayload{
+		JobID:     cmdPayload.JobID,
+		Status:    protocol.JobStatusCompleted,
+		Resources: resources,
+	}
+	if runErr != nil {
+		log.Printf("Command failed: %v", runErr)
+		update.Status = protocol.JobStatusFailed
+		update.Error = runErr.Error()
+	}
+	c.Send(protocol.EventTypeJobUpdate, update)
+}
+
+// runTestJob runs the test command, then parses its output (or report file)
+// into per-test results
+func runTestJob(c *safeConn, cmdPayload protocol.CommandPayload, workDir string) {
+	var output bytes.Buffer
+	resources, runErr := runCommand(c, cmdPayload, workDir, &output)
+	log.Println(">>> TEST COMMAND FINISHED")
+
+	update := protocol.JobUpdatePayload{
+		JobID:     cmdPayload.JobID,
+		Status:    protocol.JobStatusCompleted,
+		Resources: resources,
+	}
+	format, results, parseErr := parseTestResults(cmdPayload.Params, output.Bytes(), workDir)
+	if parseErr != nil {
+		log.Printf("Failed to parse test results: %v", parseErr)
+	} else {
+		// Failure output is captured before redaction
+		redactor := jobRedactor(cmdPayload.Secrets)
+		for i := range results {
+			results[i].Output = redactor.Redact(results[i].Output)
+		}
+		c.Send(protocol.EventTypeTestResults, protocol.TestResultsPayload{
+			JobID:   cmdPayload.JobID,
+			Format:  format,
+			Results: results,
+		})
+
+		summary := summarizeTestResults(results)
+		update.Result = summary.String()
+		if summary.Failed > 0 {
+			update.Status = protocol.JobStatusFailed
+		}
+	}
+	if runErr != nil {
+		update.Status = protocol.JobStatusFailed
+		update.Error = runErr.Error()
+	}
+	c.Send(protocol.EventTypeJobUpdate, update)
+}
+
+// restoreFromCache looks the job up in the build cache. On a hit the outputs are
+// restored and the job is reported COMPLETED; otherwise the key to store the
+// outputs under is returned ("" if the inputs could not be hashed).
+func restoreFromCache(c *safeConn, cmdPayload protocol.CommandPayload, workDir string) (string, bool) {
+	key, err := cache.Key(cmdPayload, workDir)
+	if err != nil {
+		log.Printf("Cache: not caching job %s: %v", cmdPayload.JobID, err)
+		return "", false
+	}
+
+	err = cache.Restore(key, cmdPayload.Cache.Outputs, workDir)
+	if err == errCacheMiss {
+		log.Printf("Cache: miss for %s", shortKey(key))
+		return key, false
+	}
+	if err != nil {
+		// Outputs may be half restored; running the job rewrites them
+		log.Printf("Cache: failed to restore %s: %v", shortKey(key), err)
+		return key, false
+	}
+
+	log.Printf(">>> CACHE HIT: %s", shortKey(key))
+	c.Send(protocol.EventTypeLogChunk, protocol.LogChunkPayload{
+		JobID: cmdPayload.JobID,
+		Chunk: fmt.Sprintf("Inputs unchanged, restored %s from cache (%s)\n", strings.Join(cmdPayload.Cache.Outputs, ", "), shortKey(key)),
+	})
+	c.Send(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+		JobID:  cmdPayload.JobID,
+		Status: protocol.JobStatusCompleted,
+		Result: "cached",
+		Cached: true,
+	})
+	return key, true
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,44 +11,60 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/rohaaaaaan/devair-protocol"
 )
 
-// Copied from backend for now (should share code later)
-type EventType string
+// safeConn serialises writes: gorilla/websocket supports only one concurrent writer,
+// and command output is streamed from other goroutines than the read loop.
+type safeConn struct {
+	*websocket.Conn
+	writeMu  sync.Mutex
+	encoding string // Frame encoding granted by the backend's WELCOME, JSON until then
+}
 
-const (
-	EventTypeIdentify      EventType = "IDENTIFY"
-	EventTypeCommand       EventType = "COMMAND"
-	EventTypeLogChunk      EventType = "LOG_CHUNK"
-	EventTypeJobUpdate     EventType = "JOB_UPDATE"
-	EventTypeAIStageUpdate EventType = "AI_STAGE_UPDATE"
-)
+func (c *safeConn) WriteJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteJSON(v)
+}
 
-type WSMessage struct {
-	Type    EventType   `json:"type"`
-	Payload interface{} `json:"payload"`
+// Send encodes payload and writes it as a message of type t
+func (c *safeConn) Send(t protocol.EventType, payload interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	frameType, data, err := protocol.EncodeFrame(c.encoding, t, payload)
+	if err != nil {
+		log.Printf("Dropping outgoing message: %v", err)
+		return err
+	}
+	return c.Conn.WriteMessage(frameType, data)
 }
 
-type IdentifyPayload struct {
-	ProjectID string `json:"project_id"`
-	Secret    string `json:"secret"`
-	Role      string `json:"role"`
+func (c *safeConn) setEncoding(encoding string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.encoding = encoding
 }
 
-type CommandPayload struct {
-	JobID   string            `json:"job_id"`
-	Type    string            `json:"type"`
-	Command string            `json:"command"`
-	App     string            `json:"app"`    // For OPEN_APP
-	Prompt  string            `json:"prompt"` // For AI_INSTRUCTION
-	Action  string            `json:"action"` // For UI_ACTION
-	Target  string            `json:"target"` // For UI_ACTION
-	Value   string            `json:"value"`  // For UI_ACTION
-	Params  map[string]string `json:"params"`
+// sendDecodeError answers a message we could not decode
+func (c *safeConn) sendDecodeError(err error) {
+	var decodeErr *protocol.DecodeError
+	if errors.As(err, &decodeErr) {
+		c.Send(protocol.EventTypeError, decodeErr.ErrorPayload())
+	}
+}
+
+func (c *safeConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
 }
 
 // App launcher mapping (friendly name -> executable)
@@ -65,10 +82,24 @@ var appLauncher = map[string]string{
 func main() {
 	// Define Flags
 	serverURLPtr := flag.String("server", "ws://localhost:8080/ws", "WebSocket server URL")
-	apiURLPtr := flag.String("api", "http://localhost:8080/api/projects", "API URL for project auto-discovery")
+	apiURLPtr := flag.String("api", "http://localhost:8080/api", "API URL for project auto-discovery")
 	projectIDPtr := flag.String("project", "", "Project ID (optional, will auto-fetch if empty)")
-	secretPtr := flag.String("secret", "my-secret-token", "Authentication secret")
+	secretPtr := flag.String("secret", "", "Agent token from POST /api/projects/:id/agents (default $DEVAIR_AGENT_TOKEN)")
 	wdPtr := flag.String("wd", ".", "Working directory for executed commands")
+	encodingPtr := flag.String("encoding", protocol.EncodingJSON, "Frame encoding to request from the backend: json or msgpack")
+	compressPtr := flag.Bool("compress", true, "Negotiate permessage-deflate compression")
+	previewPortPtr := flag.Int("preview-port", 0, "Local port served through the backend's /preview route (default: port of a running dev server)")
+	watchPtr := flag.String("watch", "", "Opt-in watch mode: run BUILD or TEST locally when files in -wd change")
+	watchCommandPtr := flag.String("watch-command", "", "Command for watch-triggered jobs (default: npm run build / npm test)")
+	watchIgnorePtr := flag.String("watch-ignore", defaultWatchIgnore, "Comma-separated names or path patterns to ignore in watch mode")
+	watchDebouncePtr := flag.Duration("watch-debounce", 2*time.Second, "Quiet period after the last change before a watch job starts")
+	watchIntervalPtr := flag.Duration("watch-interval", time.Second, "How often the working directory is scanned in watch mode")
+	cacheDirPtr := flag.String("cache-dir", defaultCacheDir(), "Directory of the build cache used by jobs that declare cache inputs/outputs")
+	cacheSizePtr := flag.Int64("cache-size-mb", 2048, "Build cache size limit in MB, least recently used entries are evicted (0 disables the cache)")
+	labelsPtr := flag.String("labels", "", "Comma-separated labels jobs can require, e.g. gpu,docker (os:<GOOS> and arch:<GOARCH> are always added)")
+	dryRunPtr := flag.Bool("dry-run", false, "Simulate every command (logs, steps, AI stages, test results, services) without executing anything or launching apps")
+	flag.DurationVar(&dryRunDelay, "dry-run-delay", dryRunDelay, "Pause between simulated output lines and stages in -dry-run mode")
+	flag.DurationVar(&sampleInterval, "sample-interval", sampleInterval, "How often to sample CPU/memory/IO of running jobs (0 disables)")
 
 	flag.Parse()
 
@@ -76,154 +107,244 @@ func main() {
 	apiURL := *apiURLPtr
 	projectID := *projectIDPtr
 	secret := *secretPtr
+	if secret == "" {
+		// Preferred over the flag, which other users can see in the process list
+		secret = os.Getenv("DEVAIR_AGENT_TOKEN")
+	}
+	agentSecrets = collectAgentSecrets(secret)
 	workDir := *wdPtr
+	labels := parseLabels(*labelsPtr)
+
+	switch *encodingPtr {
+	case protocol.EncodingJSON, protocol.EncodingMsgpack:
+	default:
+		log.Fatalf("Invalid -encoding %q: must be json or msgpack", *encodingPtr)
+	}
+
+	if *cacheSizePtr > 0 {
+		var err error
+		if cache, err = newBuildCache(*cacheDirPtr, *cacheSizePtr*1024*1024); err != nil {
+			log.Printf("Build cache disabled: %v", err)
+		}
+	}
+
+	var watchCfg watchConfig
+	if *watchPtr != "" {
+		watchCfg = watchConfig{
+			jobType:  strings.ToUpper(*watchPtr),
+			command:  *watchCommandPtr,
+			ignore:   parseWatchIgnore(*watchIgnorePtr),
+			debounce: *watchDebouncePtr,
+			interval: *watchIntervalPtr,
+		}
+		switch watchCfg.jobType {
+		case "BUILD":
+			if watchCfg.command == "" {
+				watchCfg.command = "npm run build"
+			}
+		case "TEST":
+			if watchCfg.command == "" {
+				watchCfg.command = "npm test"
+			}
+		default:
+			log.Fatalf("Invalid -watch %q: must be BUILD or TEST", *watchPtr)
+		}
+		if watchCfg.interval <= 0 {
+			log.Fatal("-watch-interval must be positive")
+		}
+	}
 
 	// Resolve Project ID
 	if projectID == "" {
-		// Auto-fetch from API
+		// The project an agent belongs to is known from its token
 		log.Println("No Project ID provided, fetching from API...")
-		resp, err := http.Get(apiURL)
+		// -api used to point at /api/projects
+		agentURL := strings.TrimSuffix(strings.TrimSuffix(apiURL, "/"), "/projects") + "/agents/me"
+		req, _ := http.NewRequest(http.MethodGet, agentURL, nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			log.Fatalf("Failed to fetch projects from %s: %v", apiURL, err)
+			log.Fatalf("Failed to fetch agent from %s: %v", agentURL, err)
 		}
 		defer resp.Body.Close()
-
-		var projects []struct {
-			ID   string `json:"id"`
-			Name string `json:"name"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&projects); err != nil {
-			log.Fatalf("Failed to decode projects: %v", err)
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("Failed to fetch agent from %s: %s (check -secret or provide -project)", agentURL, resp.Status)
 		}
 
-		if len(projects) > 0 {
-			projectID = projects[0].ID
-			log.Printf("Auto-selected Project: %s (%s)", projects[0].Name, projectID)
-		} else {
-			log.Fatal("No projects found in Backend. Please seed the DB or provide -project flag.")
+		var agent struct {
+			ID        string `json:"id"`
+			ProjectID string `json:"project_id"`
+			Name      string `json:"name"`
 		}
+		if err := json.NewDecoder(resp.Body).Decode(&agent); err != nil {
+			log.Fatalf("Failed to decode agent: %v", err)
+		}
+		projectID = agent.ProjectID
+		log.Printf("Auto-selected Project: %s (agent %s)", projectID, agent.Name)
 	}
 
 	log.Printf("Connecting to %s as Agent for Project %s...", serverURL, projectID)
 	log.Printf("Working Directory: %s", workDir)
 
-	c, _, err := websocket.DefaultDialer.Dial(serverURL, nil)
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = *compressPtr
+	rawConn, resp, err := dialer.Dial(serverURL, nil)
 	if err != nil {
 		log.Fatal("dial:", err)
 	}
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); ext != "" {
+		log.Printf("Negotiated extensions: %s", ext)
+	}
+	c := &safeConn{Conn: rawConn}
 	defer c.Close()
 
 	// IDENTIFY
-	identifyMsg := WSMessage{
-		Type: EventTypeIdentify,
-		Payload: IdentifyPayload{
-			ProjectID: projectID,
-			Secret:    secret,
-			Role:      "AGENT", // Explicitly set role
-		},
+	identify := protocol.IdentifyPayload{
+		ProjectID:       projectID,
+		Secret:          secret,
+		Role:            protocol.RoleAgent, // Explicitly set role
+		ProtocolVersion: protocol.Version,
+		Encoding:        *encodingPtr,
+		Labels:          labels,
 	}
-	if err := c.WriteJSON(identifyMsg); err != nil {
+	if err := c.Send(protocol.EventTypeIdentify, identify); err != nil {
 		log.Println("write identify:", err)
 		return
 	}
 	log.Println("Identified with Backend.")
 
-	done := make(chan struct{})
+	services := newServiceManager(c)
+	tunnel := newTunnelClient(c, func() int {
+		if *previewPortPtr != 0 || simulation != nil {
+			// Nothing listens on the ports of simulated services
+			return *previewPortPtr
+		}
+		return services.HealthyPort()
+	})
+	if *dryRunPtr {
+		log.Println("Dry-run mode: commands are simulated, nothing is executed")
+		simulation = newSimulator(c)
+	}
 
+	// Jobs run one at a time, off the read loop, so COMMANDs are acknowledged
+	// (and preview requests served) while a job runs
+	received := newJobSet(receivedJobsTTL)
+	commands := newCommandQueue()
 	go func() {
-		defer close(done)
 		for {
-			var msg WSMessage
-			err := c.ReadJSON(&msg)
-			if err != nil {
-				log.Println("read:", err)
-				return
+			cmdPayload := commands.pop()
+			// The backend moves the job from QUEUED to RUNNING
+			c.Send(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+				JobID:  cmdPayload.JobID,
+				Status: protocol.JobStatusRunning,
+			})
+
+			if simulation != nil {
+				simulation.Run(cmdPayload)
+				continue
 			}
 
-			log.Printf("Received Message Type: %s", msg.Type)
-
-			if msg.Type == EventTypeCommand {
-				// Parse Payload
-				payloadBytes, _ := json.Marshal(msg.Payload)
-				var cmdPayload CommandPayload
-				if err := json.Unmarshal(payloadBytes, &cmdPayload); err != nil {
-					log.Printf("Error processing command payload: %v", err)
+			log.Printf(">>> EXECUTING: %s", cmdPayload.Type)
+
+			switch cmdPayload.Type {
+			case "OPEN_APP":
+				// Launch an app by friendly name
+				appName := cmdPayload.App
+				executable, ok := appLauncher[strings.ToLower(appName)]
+				if !ok {
+					log.Printf("Unknown app: %s", appName)
+					c.Send(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+						JobID:  cmdPayload.JobID,
+						Status: protocol.JobStatusFailed,
+					})
 					continue
 				}
-
-				log.Printf(">>> EXECUTING: %s", cmdPayload.Type)
-
-				switch cmdPayload.Type {
-				case "OPEN_APP":
-					// Launch an app by friendly name
-					appName := cmdPayload.App
-					executable, ok := appLauncher[strings.ToLower(appName)]
-					if !ok {
-						log.Printf("Unknown app: %s", appName)
-						c.WriteJSON(WSMessage{
-							Type: EventTypeJobUpdate,
-							Payload: map[string]string{
-								"job_id": cmdPayload.JobID,
-								"status": "FAILED",
-							},
-						})
-						continue
-					}
-					log.Printf("Launching app: %s (%s)", appName, executable)
-					cmd := exec.Command(executable)
-					cmd.Dir = workDir
-					if err := cmd.Start(); err != nil {
-						log.Printf("Failed to launch app: %v", err)
-					}
-					c.WriteJSON(WSMessage{
-						Type: EventTypeJobUpdate,
-						Payload: map[string]string{
-							"job_id": cmdPayload.JobID,
-							"status": "COMPLETED",
-						},
+				log.Printf("Launching app: %s (%s)", appName, executable)
+				cmd := exec.Command(executable)
+				cmd.Dir = workDir
+				if err := cmd.Start(); err != nil {
+					log.Printf("Failed to launch app: %v", err)
+				}
+				c.Send(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+					JobID:  cmdPayload.JobID,
+					Status: protocol.JobStatusCompleted,
+				})
+
+			case "AI_INSTRUCTION":
+				// Simulate AI processing stages
+				prompt := cmdPayload.Prompt
+				log.Printf("AI Instruction received: %s", prompt)
+
+				// Simulate sending AI stage updates
+				stages := []string{"Analyzing request...", "Planning execution...", "Generating code...", "Done!"}
+				for _, stage := range stages {
+					log.Printf("AI Stage: %s", stage)
+					c.Send(protocol.EventTypeAIStageUpdate, protocol.AIStagePayload{
+						JobID:   cmdPayload.JobID,
+						Stage:   stage,
+						Message: fmt.Sprintf("Processing: %s", prompt),
 					})
+					time.Sleep(1 * time.Second) // Simulate work
+				}
 
-				case "AI_INSTRUCTION":
-					// Simulate AI processing stages
-					prompt := cmdPayload.Prompt
-					log.Printf("AI Instruction received: %s", prompt)
-
-					// Simulate sending AI stage updates
-					stages := []string{"Analyzing request...", "Planning execution...", "Generating code...", "Done!"}
-					for _, stage := range stages {
-						log.Printf("AI Stage: %s", stage)
-						c.WriteJSON(WSMessage{
-							Type: EventTypeAIStageUpdate,
-							Payload: map[string]string{
-								"job_id":  cmdPayload.JobID,
-								"stage":   stage,
-								"message": fmt.Sprintf("Processing: %s", prompt),
-							},
-						})
-						time.Sleep(1 * time.Second) // Simulate work
+				c.Send(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+					JobID:  cmdPayload.JobID,
+					Status: protocol.JobStatusCompleted,
+				})
+
+			case "UI_ACTION":
+				action := cmdPayload.Action
+				target := cmdPayload.Target
+				value := cmdPayload.Value
+
+				log.Printf("UI Action: %s on %s with value '%s'", action, target, value)
+
+				switch action {
+				case "FIND":
+					// FIND/FOCUS
+					// Use PowerShell to focus window, return extensive error if fails
+					// Also try partial match by iterating processes if direct AppActivate fails
+					psScript := fmt.Sprintf(`
+						$wshell = New-Object -ComObject wscript.shell
+						if ($wshell.AppActivate('%s')) { exit 0 }
+						# Try to find by process main window title
+						$proc = Get-Process | Where-Object { $_.MainWindowTitle -match '%s' } | Select-Object -First 1
+						if ($proc) {
+							if ($wshell.AppActivate($proc.Id)) { exit 0 }
+						}
+						exit 1
+					`, target, target)
+
+					cmd := exec.Command("powershell", "-Command", psScript)
+					if err := cmd.Run(); err != nil {
+						log.Printf("Failed to focus window '%s': %v", target, err)
+
+						// If we can't find it, launch it?
+						// Only if it's a known app
+						if executable, ok := appLauncher[strings.ToLower(target)]; ok {
+							log.Printf("Launching %s...", target)
+							exec.Command(executable).Start()
+
+							// Wait longer for app to actually open
+							time.Sleep(3 * time.Second)
+						} else {
+							// REPORT FAILURE and STOP
+							c.Send(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+								JobID:  cmdPayload.JobID,
+								Status: protocol.JobStatusFailed,
+								Error:  fmt.Sprintf("Window '%s' not found", target),
+							})
+							continue
+						}
 					}
 
-					c.WriteJSON(WSMessage{
-						Type: EventTypeJobUpdate,
-						Payload: map[string]string{
-							"job_id": cmdPayload.JobID,
-							"status": "COMPLETED",
-						},
-					})
-
-				case "UI_ACTION":
-					action := cmdPayload.Action
-					target := cmdPayload.Target
-					value := cmdPayload.Value
-
-					log.Printf("UI Action: %s on %s with value '%s'", action, target, value)
-
-					switch action {
-					case "FIND":
-						// FIND/FOCUS
-						// Use PowerShell to focus window, return extensive error if fails
-						// Also try partial match by iterating processes if direct AppActivate fails
-						psScript := fmt.Sprintf(`
+				case "TYPE":
+					// TYPE text
+					// Safety check: If a target is specified, ensure it's focused!
+					if target != "" {
+						// Reuse the focus logic (simplified here for brevity, or extract to helper)
+						// Use robust FIND logic: AppActivate OR Process Title Match
+						psFocus := fmt.Sprintf(`
 							$wshell = New-Object -ComObject wscript.shell
 							if ($wshell.AppActivate('%s')) { exit 0 }
 							# Try to find by process main window title
@@ -233,196 +354,218 @@ func main() {
 							}
 							exit 1
 						`, target, target)
-
-						cmd := exec.Command("powershell", "-Command", psScript)
-						if err := cmd.Run(); err != nil {
-							log.Printf("Failed to focus window '%s': %v", target, err)
-
-							// If we can't find it, launch it?
-							// Only if it's a known app
-							if executable, ok := appLauncher[strings.ToLower(target)]; ok {
-								log.Printf("Launching %s...", target)
-								exec.Command(executable).Start()
-
-								// Wait longer for app to actually open
-								time.Sleep(3 * time.Second)
-							} else {
-								// REPORT FAILURE and STOP
-								c.WriteJSON(WSMessage{
-									Type: EventTypeJobUpdate,
-									Payload: map[string]string{
-										"job_id": cmdPayload.JobID,
-										"status": "FAILED",
-										"error":  fmt.Sprintf("Window '%s' not found", target),
-									},
-								})
-								continue
-							}
-						}
-
-					case "TYPE":
-						// TYPE text
-						// Safety check: If a target is specified, ensure it's focused!
-						if target != "" {
-							// Reuse the focus logic (simplified here for brevity, or extract to helper)
-							// Use robust FIND logic: AppActivate OR Process Title Match
-							psFocus := fmt.Sprintf(`
-								$wshell = New-Object -ComObject wscript.shell
-								if ($wshell.AppActivate('%s')) { exit 0 }
-								# Try to find by process main window title
-								$proc = Get-Process | Where-Object { $_.MainWindowTitle -match '%s' } | Select-Object -First 1
-								if ($proc) {
-									if ($wshell.AppActivate($proc.Id)) { exit 0 }
-								}
-								exit 1
-							`, target, target)
-							if err := exec.Command("powershell", "-Command", psFocus).Run(); err != nil {
-								// REPORT FAILURE and STOP
-								c.WriteJSON(WSMessage{
-									Type: EventTypeJobUpdate,
-									Payload: map[string]string{
-										"job_id": cmdPayload.JobID,
-										"status": "FAILED",
-										"error":  fmt.Sprintf("Target '%s' not focused. Aborting TYPE.", target),
-									},
-								})
-								continue
-							}
+						if err := exec.Command("powershell", "-Command", psFocus).Run(); err != nil {
+							// REPORT FAILURE and STOP
+							c.Send(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+								JobID:  cmdPayload.JobID,
+								Status: protocol.JobStatusFailed,
+								Error:  fmt.Sprintf("Target '%s' not focused. Aborting TYPE.", target),
+							})
+							continue
 						}
+					}
 
-						// Use PowerShell SendKeys with escaping
-						// +^%~(){}[] need escaping with {}
-						safeValue := value
-
-						// Basic escaping for SendKeys:
-						// + -> {+}
-						// ( -> {(}
-						// ! -> {!}
-						// etc.
-						replacer := strings.NewReplacer(
-							"+", "{+}",
-							"^", "{^}",
-							"%", "{%}",
-							"~", "{~}",
-							"(", "{(}",
-							")", "{)}",
-							"[", "{[}",
-							"]", "{]}",
-							"{", "{{}",
-							"}", "{}}",
-							"!", "{!}",
-						)
-						safeValue = replacer.Replace(safeValue)
-
-						// Also escape single quotes for PowerShell string
-						psSafeValue := strings.ReplaceAll(safeValue, "'", "''")
-
-						psScript := fmt.Sprintf(`
-							$wshell = New-Object -ComObject wscript.shell
-							$wshell.SendKeys('%s')
-						`, psSafeValue)
-						exec.Command("powershell", "-Command", psScript).Run()
-
-					case "CLICK":
-						// Simple click/shortcut simulation
-						// e.g. "enter" -> SendKeys("{ENTER}")
-						keys := ""
-						switch value {
-						case "enter":
-							keys = "{ENTER}"
-						case "tab":
-							keys = "{TAB}"
-						case "space":
-							keys = " "
-						default:
-							keys = value
-						}
-						psScript := fmt.Sprintf(`
-							$wshell = New-Object -ComObject wscript.shell
-							$wshell.SendKeys('%s')
-						`, keys)
-						exec.Command("powershell", "-Command", psScript).Run()
+					// Use PowerShell SendKeys with escaping
+					// +^%~(){}[] need escaping with {}
+					safeValue := value
+
+					// Basic escaping for SendKeys:
+					// + -> {+}
+					// ( -> {(}
+					// ! -> {!}
+					// etc.
+					replacer := strings.NewReplacer(
+						"+", "{+}",
+						"^", "{^}",
+						"%", "{%}",
+						"~", "{~}",
+						"(", "{(}",
+						")", "{)}",
+						"[", "{[}",
+						"]", "{]}",
+						"{", "{{}",
+						"}", "{}}",
+						"!", "{!}",
+					)
+					safeValue = replacer.Replace(safeValue)
+
+					// Also escape single quotes for PowerShell string
+					psSafeValue := strings.ReplaceAll(safeValue, "'", "''")
+
+					psScript := fmt.Sprintf(`
+						$wshell = New-Object -ComObject wscript.shell
+						$wshell.SendKeys('%s')
+					`, psSafeValue)
+					exec.Command("powershell", "-Command", psScript).Run()
+
+				case "CLICK":
+					// Simple click/shortcut simulation
+					// e.g. "enter" -> SendKeys("{ENTER}")
+					keys := ""
+					switch value {
+					case "enter":
+						keys = "{ENTER}"
+					case "tab":
+						keys = "{TAB}"
+					case "space":
+						keys = " "
+					default:
+						keys = value
 					}
+					psScript := fmt.Sprintf(`
+						$wshell = New-Object -ComObject wscript.shell
+						$wshell.SendKeys('%s')
+					`, keys)
+					exec.Command("powershell", "-Command", psScript).Run()
+				}
 
-					c.WriteJSON(WSMessage{
-						Type: EventTypeJobUpdate,
-						Payload: map[string]string{
-							"job_id": cmdPayload.JobID,
-							"status": "COMPLETED",
-						},
-					})
+				c.Send(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+					JobID:  cmdPayload.JobID,
+					Status: protocol.JobStatusCompleted,
+				})
 
-				case "OPEN_IDE":
-					cmd := exec.Command("code", ".")
-					cmd.Dir = workDir
-					if err := cmd.Start(); err != nil {
-						log.Printf("Failed to open IDE: %v", err)
+			case "OPEN_IDE":
+				cmd := exec.Command("code", ".")
+				cmd.Dir = workDir
+				if err := cmd.Start(); err != nil {
+					log.Printf("Failed to open IDE: %v", err)
+				}
+				c.Send(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+					JobID:  cmdPayload.JobID,
+					Status: protocol.JobStatusCompleted,
+				})
+
+			case "TEST":
+				runTestJob(c, cmdPayload, workDir)
+
+			case "SERVICE_START":
+				update := protocol.JobUpdatePayload{
+					JobID:  cmdPayload.JobID,
+					Status: protocol.JobStatusCompleted,
+				}
+				if err := services.Start(cmdPayload, workDir); err != nil {
+					log.Printf("Failed to start service: %v", err)
+					update.Status = protocol.JobStatusFailed
+					update.Error = err.Error()
+				}
+				c.Send(protocol.EventTypeJobUpdate, update)
+
+			case "SERVICE_STOP":
+				// Stopping waits for the process to exit, don't block the job worker
+				go func(cmdPayload protocol.CommandPayload) {
+					update := protocol.JobUpdatePayload{
+						JobID:  cmdPayload.JobID,
+						Status: protocol.JobStatusCompleted,
 					}
-					c.WriteJSON(WSMessage{
-						Type: EventTypeJobUpdate,
-						Payload: map[string]string{
-							"job_id": cmdPayload.JobID,
-							"status": "COMPLETED",
-						},
-					})
+					if err := services.Stop(serviceName(cmdPayload.Params)); err != nil {
+						log.Printf("Failed to stop service: %v", err)
+						update.Status = protocol.JobStatusFailed
+						update.Error = err.Error()
+					}
+					c.Send(protocol.EventTypeJobUpdate, update)
+				}(cmdPayload)
+
+			case "SERVICE_STATUS":
+				// Push the current state of the named service (or all of them)
+				statuses := services.Statuses(cmdPayload.Params["name"])
+				for _, st := range statuses {
+					c.Send(protocol.EventTypeServiceStatus, st)
+				}
+				result, _ := json.Marshal(statuses)
+				c.Send(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+					JobID:  cmdPayload.JobID,
+					Status: protocol.JobStatusCompleted,
+					Result: string(result),
+				})
+
+			default:
+				// Generic command execution (BUILD, etc.)
+				runShellJob(c, cmdPayload, workDir)
+			}
+		}
+	}()
 
-				default:
-					// Generic command execution (BUILD, etc.)
-					cmd := exec.Command("cmd", "/C", cmdPayload.Command)
-					cmd.Dir = workDir
+	done := make(chan struct{})
 
-					stdout, _ := cmd.StdoutPipe()
-					stderr, _ := cmd.StderrPipe()
+	go func() {
+		defer close(done)
+		for {
+			frameType, data, err := c.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, protocol.CloseIncompatibleVersion) {
+					log.Fatalf("Backend rejected this agent: protocol version %d is not supported, please update the agent", protocol.Version)
+				}
+				// Reconnecting with the same token can't succeed
+				if websocket.IsCloseError(err, protocol.CloseUnauthorized) {
+					log.Fatalf("Backend rejected this agent: %v (check -secret, tokens are created with POST /api/projects/:id/agents)", err)
+				}
+				log.Println("read:", err)
+				return
+			}
 
-					if err := cmd.Start(); err != nil {
-						log.Printf("Failed to start command: %v", err)
-						continue
-					}
+			msg, err := protocol.ParseFrame(frameType, data)
+			if err != nil {
+				log.Printf("Dropping message: %v", err)
+				c.sendDecodeError(err)
+				continue
+			}
+			payload, err := msg.Decode()
+			if err != nil {
+				log.Printf("Dropping message: %v", err)
+				// Never answer an ERROR with an ERROR
+				if msg.Type != protocol.EventTypeError {
+					c.sendDecodeError(err)
+				}
+				continue
+			}
 
-					// Reader routine
-					go func() {
-						reader := io.MultiReader(stdout, stderr)
-						buf := make([]byte, 1024)
-						for {
-							n, err := reader.Read(buf)
-							if n > 0 {
-								chunk := string(buf[:n])
-								fmt.Print(chunk)
-								c.WriteJSON(WSMessage{
-									Type: EventTypeLogChunk,
-									Payload: map[string]string{
-										"job_id": cmdPayload.JobID,
-										"chunk":  chunk,
-									},
-								})
-							}
-							if err != nil {
-								break
-							}
-						}
-					}()
+			if welcome, ok := payload.(*protocol.WelcomePayload); ok {
+				if welcome.Encoding != protocol.EncodingJSON {
+					log.Printf("Using %s encoding", welcome.Encoding)
+				}
+				c.setEncoding(welcome.Encoding)
+				continue
+			}
 
-					cmd.Wait()
-					log.Println(">>> COMMAND FINISHED")
+			// The backend reports malformed messages, and why it rejects a connection before closing it
+			if errPayload, ok := payload.(*protocol.ErrorPayload); ok {
+				log.Printf("Backend error (%s): %s", errPayload.Code, errPayload.Message)
+				continue
+			}
 
-					c.WriteJSON(WSMessage{
-						Type: EventTypeJobUpdate,
-						Payload: map[string]string{
-							"job_id": cmdPayload.JobID,
-							"status": "COMPLETED",
-						},
-					})
+			// Preview tunnel frames are high volume, handle them before logging
+			if tunnel.handle(payload) {
+				continue
+			}
+
+			log.Printf("Received Message Type: %s", msg.Type)
+
+			if p, ok := payload.(*protocol.CommandPayload); ok {
+				// Acknowledge on receipt, the backend resends a COMMAND until it gets a COMMAND_ACK
+				c.Send(protocol.EventTypeCommandAck, protocol.CommandAckPayload{JobID: p.JobID})
+				if !received.add(p.JobID) {
+					log.Printf("Ignoring resent COMMAND of job %s", p.JobID)
+					continue
 				}
+				commands.push(*p)
 			}
 		}
 	}()
 
+	stopWatch := make(chan struct{})
+	if watchCfg.jobType != "" {
+		go newWatcher(c, workDir, watchCfg).Run(stopWatch)
+	}
+
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
 	<-interrupt
 	log.Println("interrupt")
 
+	close(stopWatch)
+	services.StopAll()
+
 	// Cleanly close connection
 	err = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	if err != nil {
@@ -434,3 +577,123 @@ func main() {
 	case <-time.After(time.Second):
 	}
 }
+
+// parseLabels splits the -labels flag and adds the platform labels
+func parseLabels(list string) []string {
+	labels := []string{"os:" + runtime.GOOS, "arch:" + runtime.GOARCH}
+	for _, l := range strings.Split(list, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+// shellCommand runs a command line through the platform shell
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// commandEnv returns the environment for a command: the agent's plus the job's
+// secrets, or nil (inherit) if there are none
+func commandEnv(secrets map[string]string) []string {
+	if len(secrets) == 0 {
+		return nil
+	}
+	env := os.Environ()
+	for name, value := range secrets {
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+// runCommand executes the command (or the steps) of a job in workDir, streaming its
+// combined output to the backend as LOG_CHUNKs with secrets redacted. If capture is
+// non-nil the raw output is also copied there. While the command runs its process
+// tree is sampled; the summary may be nil.
+func runCommand(c *safeConn, cmdPayload protocol.CommandPayload, workDir string, capture io.Writer) (*protocol.ResourceSummary, error) {
+	if len(cmdPayload.Steps) > 0 {
+		return runSteps(c, cmdPayload, workDir, capture)
+	}
+	redactor := jobRedactor(cmdPayload.Secrets)
+	return runProcess(c, cmdPayload.JobID, cmdPayload.Command, workDir, cmdPayload.Secrets, 0, redactor, capture)
+}
+
+// runProcess runs one shell command of a job. env is added to the agent's environment;
+// a timeout of 0 means none.
+func runProcess(c *safeConn, jobID string, command string, dir string, env map[string]string, timeout time.Duration, redactor *redactor, capture io.Writer) (*protocol.ResourceSummary, error) {
+	cmd := shellCommand(command)
+	cmd.Dir = dir
+	cmd.Env = commandEnv(env)
+
+	// Same writer for both streams: exec copies them from a single pipe, in order
+	out := newLogStreamer(c, jobID, redactor, capture)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if timeout > 0 {
+		// The whole tree has to go on timeout, not just the shell
+		setProcessGroup(cmd)
+		cmd.WaitDelay = 5 * time.Second
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	sampler := startResourceSampler(c, jobID, cmd.Process.Pid)
+
+	var timedOut atomic.Bool
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			timedOut.Store(true)
+			killProcessTree(cmd)
+		})
+		defer timer.Stop()
+	}
+
+	err := cmd.Wait()
+	out.Flush()
+	if timedOut.Load() {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return sampler.Stop(), err
+}
+
+// logStreamer forwards everything written to it as LOG_CHUNK messages.
+// Secrets are redacted before a chunk is sent, so chunks follow line boundaries
+// rather than writes.
+type logStreamer struct {
+	conn     *safeConn
+	jobID    string
+	capture  io.Writer
+	redacted *streamRedactor
+}
+
+func newLogStreamer(c *safeConn, jobID string, r *redactor, capture io.Writer) *logStreamer {
+	l := &logStreamer{conn: c, jobID: jobID, capture: capture}
+	l.redacted = newStreamRedactor(r, l.send)
+	return l
+}
+
+func (l *logStreamer) Write(p []byte) (int, error) {
+	fmt.Print(string(p))
+	if l.capture != nil {
+		l.capture.Write(p)
+	}
+	return l.redacted.Write(p)
+}
+
+// Flush sends output held back by the redactor
+func (l *logStreamer) Flush() {
+	l.redacted.Flush()
+}
+
+func (l *logStreamer) send(chunk string) {
+	l.conn.Send(protocol.EventTypeLogChunk, protocol.LogChunkPayload{
+		JobID: l.jobID,
+		Chunk: chunk,
+	})
+}
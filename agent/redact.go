@@ -0,0 +1,209 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redactedText = "***"
+	// Values shorter than this are too likely to appear in normal output
+	minSecretLength = 6
+	// How long an unterminated line (a prompt, a progress bar) is held back
+	redactFlushDelay = 200 * time.Millisecond
+	// Unterminated output beyond this is sent even if it may hide a split secret
+	maxPendingOutput = 64 * 1024
+)
+
+// Token formats that are redacted even when their value is unknown. The
+// submatch named "secret", if any, is the part replaced.
+var secretPatterns = []*regexp.Regexp{
+	// AWS access key IDs
+	regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA|AIPA)[A-Z0-9]{16}\b`),
+	// AWS secret access keys only have a recognisable name, not a format
+	regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?(?P<secret>[A-Za-z0-9/+=]{40})`),
+	// GitHub tokens (classic and fine-grained)
+	regexp.MustCompile(`\b(?:ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36,}\b`),
+	regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{22,}\b`),
+	// Authorization: Bearer <token>
+	regexp.MustCompile(`(?i)\bbearer\s+(?P<secret>[A-Za-z0-9\-._~+/]+=*)`),
+}
+
+// Text after which the next word is a token value (see safeCut)
+var secretContextRegex = regexp.MustCompile(`(?i)(?:bearer|aws_?secret_?access_?key["']?\s*[:=])\s*["']?$`)
+
+// Agent environment variables whose values are credentials
+var secretEnvNameRegex = regexp.MustCompile(`(?i)(SECRET|TOKEN|PASSWORD|PASSWD|API_?KEY|ACCESS_?KEY|PRIVATE_?KEY|CREDENTIAL)`)
+
+// agentSecrets are redacted from every job: the agent's own credentials
+var agentSecrets []string
+
+// collectAgentSecrets returns the agent secret and credential-like environment values
+func collectAgentSecrets(agentSecret string) []string {
+	secrets := []string{agentSecret}
+	for _, kv := range os.Environ() {
+		name, value, ok := strings.Cut(kv, "=")
+		if ok && secretEnvNameRegex.MatchString(name) {
+			secrets = append(secrets, value)
+		}
+	}
+	return secrets
+}
+
+// redactor replaces known secret values and token patterns with ***
+type redactor struct {
+	secrets []string // Longest first, so overlapping secrets are fully replaced
+}
+
+func newRedactor(secretSets ...[]string) *redactor {
+	seen := make(map[string]bool)
+	r := &redactor{}
+	add := func(s string) {
+		if len(s) >= minSecretLength && !seen[s] {
+			seen[s] = true
+			r.secrets = append(r.secrets, s)
+		}
+	}
+	for _, set := range secretSets {
+		for _, s := range set {
+			add(s)
+			// Output is redacted a line at a time, so a multi-line secret (a PEM
+			// private key) is matched line by line
+			if strings.ContainsAny(s, "\n\r") {
+				for _, line := range strings.FieldsFunc(s, func(c rune) bool { return c == '\n' || c == '\r' }) {
+					add(strings.TrimSpace(line))
+				}
+			}
+		}
+	}
+	sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+	return r
+}
+
+// jobRedactor covers the agent's credentials and the secrets of one job
+func jobRedactor(jobSecrets map[string]string) *redactor {
+	values := make([]string, 0, len(jobSecrets))
+	for _, v := range jobSecrets {
+		values = append(values, v)
+	}
+	return newRedactor(agentSecrets, values)
+}
+
+func (r *redactor) Redact(s string) string {
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redactedText)
+	}
+	for _, re := range secretPatterns {
+		group := re.SubexpIndex("secret")
+		s = re.ReplaceAllStringFunc(s, func(match string) string {
+			if group < 0 {
+				return redactedText
+			}
+			m := re.FindStringSubmatchIndex(match)
+			return match[:m[2*group]] + redactedText + match[m[2*group+1]:]
+		})
+	}
+	return s
+}
+
+// safeCut returns how much of an unterminated line can be sent now without
+// cutting a secret in two: everything before the last word, the keyword
+// that introduces it, and any suffix that starts a known secret.
+func (r *redactor) safeCut(s string) int {
+	cut := strings.LastIndexAny(s, " \t") + 1
+	if loc := secretContextRegex.FindStringIndex(s[:cut]); loc != nil {
+		cut = loc[0]
+	}
+	for _, secret := range r.secrets {
+		// Secrets may contain spaces
+		for start := 0; ; {
+			i := strings.Index(s[start:], secret)
+			if i < 0 {
+				break
+			}
+			i += start
+			if i < cut && i+len(secret) > cut {
+				cut = i
+			}
+			start = i + 1
+		}
+		for n := min(len(secret)-1, len(s)); n > 0; n-- {
+			if strings.HasSuffix(s, secret[:n]) {
+				cut = min(cut, len(s)-n)
+				break
+			}
+		}
+	}
+	return cut
+}
+
+// streamRedactor redacts a stream written in arbitrary chunks. Output is
+// released a line at a time, so secrets split across writes are still found;
+// an unterminated line is released after redactFlushDelay, up to safeCut.
+type streamRedactor struct {
+	r    *redactor
+	emit func(string)
+
+	mu      sync.Mutex
+	pending string
+	timer   *time.Timer
+}
+
+func newStreamRedactor(r *redactor, emit func(string)) *streamRedactor {
+	return &streamRedactor{r: r, emit: emit}
+}
+
+func (s *streamRedactor) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending += string(p)
+	// \r ends progress bar updates
+	if end := strings.LastIndexAny(s.pending, "\n\r") + 1; end > 0 {
+		s.release(end)
+	}
+	if len(s.pending) > maxPendingOutput {
+		s.release(len(s.pending))
+	}
+
+	if s.pending != "" {
+		if s.timer == nil {
+			s.timer = time.AfterFunc(redactFlushDelay, s.flushPartial)
+		} else {
+			s.timer.Reset(redactFlushDelay)
+		}
+	}
+	return len(p), nil
+}
+
+// flushPartial releases the safe part of an unterminated line
+func (s *streamRedactor) flushPartial() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cut := s.r.safeCut(s.pending); cut > 0 {
+		s.release(cut)
+	}
+}
+
+// Flush releases everything, e.g. when the command has exited
+func (s *streamRedactor) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.release(len(s.pending))
+}
+
+func (s *streamRedactor) release(n int) {
+	if n == 0 {
+		return
+	}
+	out := s.pending[:n]
+	s.pending = s.pending[n:]
+	s.emit(s.r.Redact(out))
+}
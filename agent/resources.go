@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// procStats is a point-in-time reading of one process tree
+type procStats struct {
+	processes int
+	rssBytes  uint64
+	// Cumulative counters per PID, so that exited children keep counting
+	cpuSeconds map[int]float64
+	readBytes  map[int]uint64
+	writeBytes map[int]uint64
+}
+
+// resourceSampler periodically samples the process tree of a running job
+type resourceSampler struct {
+	conn     *safeConn
+	jobID    string
+	pid      int
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+
+	mu      sync.Mutex
+	summary protocol.ResourceSummary
+	cpuSum  float64
+	rssSum  float64
+}
+
+// Returned by readProcessTree on platforms without /proc
+var errSamplingUnsupported = errors.New("resource sampling not supported")
+
+// How often job resources are sampled (set by the -sample-interval flag)
+var sampleInterval = 2 * time.Second
+
+func startResourceSampler(c *safeConn, jobID string, pid int) *resourceSampler {
+	s := &resourceSampler{
+		conn:     c,
+		jobID:    jobID,
+		pid:      pid,
+		interval: sampleInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *resourceSampler) run() {
+	defer close(s.done)
+	if s.interval <= 0 {
+		return
+	}
+
+	start := time.Now()
+	cpu := make(map[int]float64)
+	reads := make(map[int]uint64)
+	writes := make(map[int]uint64)
+	var lastCPU float64
+	lastTime := start
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			stats, err := readProcessTree(s.pid)
+			if err != nil {
+				if err == errSamplingUnsupported {
+					return
+				}
+				continue // Process may just have exited
+			}
+
+			// Merge into the per-PID totals (PIDs of exited processes keep their last value)
+			for pid, v := range stats.cpuSeconds {
+				cpu[pid] = v
+			}
+			for pid, v := range stats.readBytes {
+				reads[pid] = v
+			}
+			for pid, v := range stats.writeBytes {
+				writes[pid] = v
+			}
+			totalCPU := sumValues(cpu)
+
+			sample := protocol.ResourceSample{
+				JobID:      s.jobID,
+				Timestamp:  now.UnixMilli(),
+				RSSBytes:   stats.rssBytes,
+				ReadBytes:  sumValues(reads),
+				WriteBytes: sumValues(writes),
+				Processes:  stats.processes,
+			}
+			if elapsed := now.Sub(lastTime).Seconds(); elapsed > 0 && totalCPU >= lastCPU {
+				sample.CPUPercent = (totalCPU - lastCPU) / elapsed * 100
+			}
+			lastCPU, lastTime = totalCPU, now
+
+			s.record(sample, now.Sub(start))
+			s.conn.Send(protocol.EventTypeResourceSample, sample)
+		}
+	}
+}
+
+func (s *resourceSampler) record(sample protocol.ResourceSample, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sum := &s.summary
+	sum.Samples++
+	sum.DurationMs = elapsed.Milliseconds()
+	s.cpuSum += sample.CPUPercent
+	s.rssSum += float64(sample.RSSBytes)
+	sum.AvgCPUPercent = s.cpuSum / float64(sum.Samples)
+	sum.AvgRSSBytes = uint64(s.rssSum / float64(sum.Samples))
+	if sample.CPUPercent > sum.PeakCPUPercent {
+		sum.PeakCPUPercent = sample.CPUPercent
+	}
+	if sample.RSSBytes > sum.PeakRSSBytes {
+		sum.PeakRSSBytes = sample.RSSBytes
+	}
+	sum.ReadBytes = sample.ReadBytes
+	sum.WriteBytes = sample.WriteBytes
+}
+
+// Stop ends sampling and returns the summary, or nil if nothing was sampled
+func (s *resourceSampler) Stop() *protocol.ResourceSummary {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.summary.Samples == 0 {
+		return nil
+	}
+	summary := s.summary
+	return &summary
+}
+
+// mergeResourceSummaries combines the summaries of consecutive processes
+// (the steps of a job); either may be nil
+func mergeResourceSummaries(a, b *protocol.ResourceSummary) *protocol.ResourceSummary {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	samples := float64(a.Samples + b.Samples)
+	merged := protocol.ResourceSummary{
+		Samples:        a.Samples + b.Samples,
+		DurationMs:     a.DurationMs + b.DurationMs,
+		PeakCPUPercent: max(a.PeakCPUPercent, b.PeakCPUPercent),
+		AvgCPUPercent:  (a.AvgCPUPercent*float64(a.Samples) + b.AvgCPUPercent*float64(b.Samples)) / samples,
+		PeakRSSBytes:   max(a.PeakRSSBytes, b.PeakRSSBytes),
+		AvgRSSBytes:    uint64((float64(a.AvgRSSBytes)*float64(a.Samples) + float64(b.AvgRSSBytes)*float64(b.Samples)) / samples),
+		ReadBytes:      a.ReadBytes + b.ReadBytes,
+		WriteBytes:     a.WriteBytes + b.WriteBytes,
+	}
+	return &merged
+}
+
+func sumValues[V float64 | uint64](m map[int]V) V {
+	var total V
+	for _, v := range m {
+		total += v
+	}
+	return total
+}
@@ -0,0 +1,125 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// USER_HZ, the unit of utime/stime in /proc/<pid>/stat. It is 100 on every
+// mainstream Linux architecture.
+const clockTicksPerSecond = 100
+
+var pageSize = uint64(os.Getpagesize())
+
+// readProcessTree sums the resource usage of root and all its descendants from /proc
+func readProcessTree(root int) (procStats, error) {
+	stats := procStats{
+		cpuSeconds: make(map[int]float64),
+		readBytes:  make(map[int]uint64),
+		writeBytes: make(map[int]uint64),
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return stats, err
+	}
+
+	type procInfo struct {
+		ppid     int
+		cpuTicks uint64
+		rssPages uint64
+	}
+	procs := make(map[int]procInfo)
+	children := make(map[int][]int)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		ppid, cpuTicks, rssPages, err := readProcStat(pid)
+		if err != nil {
+			continue // Exited while we were scanning
+		}
+		procs[pid] = procInfo{ppid: ppid, cpuTicks: cpuTicks, rssPages: rssPages}
+		children[ppid] = append(children[ppid], pid)
+	}
+
+	if _, ok := procs[root]; !ok {
+		return stats, os.ErrNotExist
+	}
+
+	queue := []int{root}
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		queue = append(queue, children[pid]...)
+
+		info := procs[pid]
+		stats.processes++
+		stats.rssBytes += info.rssPages * pageSize
+		stats.cpuSeconds[pid] = float64(info.cpuTicks) / clockTicksPerSecond
+		if r, w, err := readProcIO(pid); err == nil {
+			stats.readBytes[pid] = r
+			stats.writeBytes[pid] = w
+		}
+	}
+	return stats, nil
+}
+
+// readProcStat returns ppid, utime+stime (ticks) and rss (pages) from /proc/<pid>/stat
+func readProcStat(pid int) (int, uint64, uint64, error) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	// comm (field 2) may contain spaces and parentheses; fields resume after the last ')'
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, 0, 0, errors.New("malformed stat")
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	// fields[0] is field 3 (state) in proc(5) numbering
+	if len(fields) < 22 {
+		return 0, 0, 0, errors.New("malformed stat")
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+	if rss < 0 {
+		rss = 0
+	}
+	return ppid, utime + stime, uint64(rss), nil
+}
+
+// readProcIO returns read_bytes and write_bytes (storage I/O) from /proc/<pid>/io
+func readProcIO(pid int) (uint64, uint64, error) {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/io")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var read, write uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		switch key {
+		case "read_bytes":
+			read = n
+		case "write_bytes":
+			write = n
+		}
+	}
+	return read, write, scanner.Err()
+}
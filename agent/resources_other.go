@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func readProcessTree(root int) (procStats, error) {
+	return procStats{}, errSamplingUnsupported
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+const (
+	defaultServiceName        = "dev"
+	defaultServiceMaxRestarts = 3
+	serviceHealthInterval     = 5 * time.Second
+	serviceHealthTimeout      = 2 * time.Second
+)
+
+// service is one supervised long-running process (e.g. `npm run dev`)
+type service struct {
+	name        string
+	command     string
+	workDir     string
+	jobID       string // Job that started the service; its output is logged under this ID
+	healthPath  string
+	maxRestarts int
+	fixedPort   int // From params; skips detection
+	secrets     map[string]string
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	status  protocol.ServiceStatusPayload
+	stop    chan struct{} // Closed by Stop
+	stopped chan struct{} // Closed when the supervisor exits
+
+	stopOnce sync.Once
+}
+
+// serviceManager supervises all services started on this agent
+type serviceManager struct {
+	conn *safeConn
+
+	mu       sync.Mutex
+	services map[string]*service
+}
+
+func newServiceManager(c *safeConn) *serviceManager {
+	return &serviceManager{
+		conn:     c,
+		services: make(map[string]*service),
+	}
+}
+
+// Start launches a service described by a SERVICE_START command.
+// Params: name, port, health_path (default "/"), max_restarts (default 3).
+func (m *serviceManager) Start(cmd protocol.CommandPayload, workDir string) error {
+	if cmd.Command == "" {
+		return fmt.Errorf("no command given")
+	}
+	name := serviceName(cmd.Params)
+
+	svc := &service{
+		name:        name,
+		command:     cmd.Command,
+		workDir:     workDir,
+		jobID:       cmd.JobID,
+		secrets:     cmd.Secrets,
+		healthPath:  "/",
+		maxRestarts: defaultServiceMaxRestarts,
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	if p := cmd.Params["health_path"]; p != "" {
+		svc.healthPath = p
+	}
+	if v := cmd.Params["max_restarts"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid max_restarts %q", v)
+		}
+		svc.maxRestarts = n
+	}
+	if v := cmd.Params["port"]; v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %q", v)
+		}
+		svc.fixedPort = port
+	}
+	svc.status = protocol.ServiceStatusPayload{Name: name, Command: cmd.Command}
+
+	m.mu.Lock()
+	if existing, ok := m.services[name]; ok && !existing.finished() {
+		m.mu.Unlock()
+		return fmt.Errorf("service %q is already running", name)
+	}
+	m.services[name] = svc
+	m.mu.Unlock()
+
+	go m.supervise(svc)
+	go m.checkHealth(svc)
+	return nil
+}
+
+// Stop terminates a service and waits for its supervisor to exit
+func (m *serviceManager) Stop(name string) error {
+	m.mu.Lock()
+	svc, ok := m.services[name]
+	m.mu.Unlock()
+	if !ok || svc.finished() {
+		return fmt.Errorf("service %q is not running", name)
+	}
+
+	svc.mu.Lock()
+	svc.stopOnce.Do(func() { close(svc.stop) })
+	cmd := svc.cmd
+	svc.mu.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		if err := killProcessTree(cmd); err != nil {
+			log.Printf("Failed to kill service %s: %v", name, err)
+		}
+	}
+
+	select {
+	case <-svc.stopped:
+		return nil
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("service %q did not stop in time", name)
+	}
+}
+
+// StopAll is used on agent shutdown
+func (m *serviceManager) StopAll() {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.services))
+	for name, svc := range m.services {
+		if !svc.finished() {
+			names = append(names, name)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, name := range names {
+		m.Stop(name)
+	}
+}
+
+// Statuses returns the current status of one service, or all when name is empty
+func (m *serviceManager) Statuses(name string) []protocol.ServiceStatusPayload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := []protocol.ServiceStatusPayload{}
+	for n, svc := range m.services {
+		if name == "" || n == name {
+			statuses = append(statuses, svc.snapshot())
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// HealthyPort returns the port of a running service, preferring healthy ones (0 if none)
+func (m *serviceManager) HealthyPort() int {
+	port := 0
+	for _, st := range m.Statuses("") {
+		switch st.Status {
+		case protocol.ServiceStatusHealthy:
+			return st.Port
+		case protocol.ServiceStatusRunning, protocol.ServiceStatusUnhealthy:
+			if port == 0 {
+				port = st.Port
+			}
+		}
+	}
+	return port
+}
+
+// supervise runs the service process and restarts it when it crashes
+func (m *serviceManager) supervise(svc *service) {
+	defer close(svc.stopped)
+
+	for {
+		cmd := shellCommand(svc.command)
+		cmd.Dir = svc.workDir
+		cmd.Env = commandEnv(svc.secrets)
+		setProcessGroup(cmd)
+		// Don't hang on pipes held open by orphaned grandchildren
+		cmd.WaitDelay = 5 * time.Second
+
+		logs := newLogStreamer(m.conn, svc.jobID, jobRedactor(svc.secrets), nil)
+		out := io.MultiWriter(
+			logs,
+			&portDetector{onPort: func(port int) { m.portDetected(svc, port) }},
+		)
+		cmd.Stdout = out
+		cmd.Stderr = out
+
+		svc.mu.Lock()
+		if svc.stopRequested() {
+			svc.mu.Unlock()
+			m.update(svc, func(st *protocol.ServiceStatusPayload) {
+				st.Status = protocol.ServiceStatusStopped
+				st.PID = 0
+				st.URL = ""
+			})
+			return
+		}
+		err := cmd.Start()
+		if err == nil {
+			svc.cmd = cmd
+		}
+		svc.mu.Unlock()
+
+		if err == nil {
+			m.update(svc, func(st *protocol.ServiceStatusPayload) {
+				st.Status = protocol.ServiceStatusStarting
+				st.PID = cmd.Process.Pid
+				st.Error = ""
+				if svc.fixedPort != 0 {
+					st.Port = svc.fixedPort
+					st.URL = fmt.Sprintf("http://localhost:%d", svc.fixedPort)
+					st.Status = protocol.ServiceStatusRunning
+				}
+			})
+			err = cmd.Wait()
+		}
+		logs.Flush()
+
+		svc.mu.Lock()
+		svc.cmd = nil
+		svc.mu.Unlock()
+
+		if svc.stopRequested() {
+			m.update(svc, func(st *protocol.ServiceStatusPayload) {
+				st.Status = protocol.ServiceStatusStopped
+				st.PID = 0
+				st.URL = ""
+			})
+			return
+		}
+
+		errMsg := "exited"
+		if err != nil {
+			errMsg = err.Error()
+		}
+		log.Printf("Service %s stopped unexpectedly: %s", svc.name, errMsg)
+
+		restarts := svc.snapshot().Restarts
+		if restarts >= svc.maxRestarts {
+			m.update(svc, func(st *protocol.ServiceStatusPayload) {
+				st.Status = protocol.ServiceStatusFailed
+				st.PID = 0
+				st.URL = ""
+				st.Error = fmt.Sprintf("%s (gave up after %d restarts)", errMsg, restarts)
+			})
+			return
+		}
+		m.update(svc, func(st *protocol.ServiceStatusPayload) {
+			st.Status = protocol.ServiceStatusCrashed
+			st.PID = 0
+			st.Error = errMsg
+			st.Restarts++
+		})
+
+		// Back off a little more on every crash
+		select {
+		case <-time.After(time.Duration(restarts+1) * time.Second):
+		case <-svc.stop:
+		}
+	}
+}
+
+func (m *serviceManager) portDetected(svc *service, port int) {
+	if svc.fixedPort != 0 {
+		return
+	}
+	m.update(svc, func(st *protocol.ServiceStatusPayload) {
+		if st.Port == port && st.Status != protocol.ServiceStatusStarting {
+			return
+		}
+		st.Port = port
+		st.URL = fmt.Sprintf("http://localhost:%d", port)
+		if st.Status == protocol.ServiceStatusStarting {
+			st.Status = protocol.ServiceStatusRunning
+		}
+	})
+}
+
+// checkHealth polls the service over HTTP while it runs
+func (m *serviceManager) checkHealth(svc *service) {
+	client := &http.Client{Timeout: serviceHealthTimeout}
+	ticker := time.NewTicker(serviceHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-svc.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		st := svc.snapshot()
+		if st.Port == 0 {
+			continue
+		}
+		switch st.Status {
+		case protocol.ServiceStatusRunning, protocol.ServiceStatusHealthy, protocol.ServiceStatusUnhealthy:
+		default:
+			continue
+		}
+
+		healthy := false
+		checkErr := ""
+		resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", st.Port, svc.healthPath))
+		if err != nil {
+			checkErr = err.Error()
+		} else {
+			resp.Body.Close()
+			healthy = resp.StatusCode < http.StatusInternalServerError
+			if !healthy {
+				checkErr = fmt.Sprintf("health check returned %s", resp.Status)
+			}
+		}
+
+		m.update(svc, func(st *protocol.ServiceStatusPayload) {
+			// The process may have crashed while we were checking
+			switch st.Status {
+			case protocol.ServiceStatusRunning, protocol.ServiceStatusHealthy, protocol.ServiceStatusUnhealthy:
+			default:
+				return
+			}
+			if healthy {
+				st.Status = protocol.ServiceStatusHealthy
+				st.Error = ""
+			} else {
+				st.Status = protocol.ServiceStatusUnhealthy
+				st.Error = checkErr
+			}
+		})
+	}
+}
+
+// update changes the status of svc and pushes it to the backend if anything changed
+func (m *serviceManager) update(svc *service, change func(st *protocol.ServiceStatusPayload)) {
+	svc.mu.Lock()
+	before := svc.status
+	change(&svc.status)
+	changed := svc.status != before
+	if changed {
+		svc.status.UpdatedAt = time.Now().UnixMilli()
+	}
+	st := svc.status
+	svc.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	log.Printf("Service %s: %s", st.Name, st.Status)
+	m.conn.Send(protocol.EventTypeServiceStatus, st)
+}
+
+func (s *service) snapshot() protocol.ServiceStatusPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *service) stopRequested() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *service) finished() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func serviceName(params map[string]string) string {
+	if name := params["name"]; name != "" {
+		return name
+	}
+	return defaultServiceName
+}
+
+// Dev servers announce where they listen, e.g. "Local: http://localhost:5173/",
+// "listening on port 3000", "started server on 0.0.0.0:3000"
+var (
+	ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+	listenURLRegex  = regexp.MustCompile(`(?i)(?:localhost|127\.0\.0\.1|0\.0\.0\.0|\[::1?\]):(\d{2,5})\b`)
+	listenPortRegex = regexp.MustCompile(`(?i)\b(?:listening|running|started|serving)\b.*\bport\b\D{0,3}(\d{2,5})\b`)
+)
+
+// portDetector scans process output line by line for the port it listens on
+type portDetector struct {
+	onPort  func(port int)
+	partial []byte
+}
+
+func (d *portDetector) Write(p []byte) (int, error) {
+	d.partial = append(d.partial, p...)
+	for {
+		i := bytes.IndexByte(d.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := ansiEscapeRegex.ReplaceAll(d.partial[:i], nil)
+		d.partial = d.partial[i+1:]
+		if port := detectPort(line); port != 0 {
+			d.onPort(port)
+		}
+	}
+	// Guard against output without newlines
+	if len(d.partial) > 4096 {
+		d.partial = d.partial[len(d.partial)-1024:]
+	}
+	return len(p), nil
+}
+
+func detectPort(line []byte) int {
+	for _, re := range []*regexp.Regexp{listenURLRegex, listenPortRegex} {
+		if m := re.FindSubmatch(line); m != nil {
+			if port, err := strconv.Atoi(string(m[1])); err == nil && port > 0 && port <= 65535 {
+				return port
+			}
+		}
+	}
+	return 0
+}
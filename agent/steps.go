@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// runSteps runs the steps of a multi-step job in order and reports each one as a
+// STEP_UPDATE when it starts and ends. A failed step ends the job unless it may
+// continue on error; the steps after it are reported as SKIPPED.
+func runSteps(c *safeConn, cmdPayload protocol.CommandPayload, workDir string, capture io.Writer) (*protocol.ResourceSummary, error) {
+	redactor := jobRedactor(cmdPayload.Secrets)
+	var resources *protocol.ResourceSummary
+	var jobErr error
+
+	for i, step := range cmdPayload.Steps {
+		update := protocol.StepUpdatePayload{
+			JobID: cmdPayload.JobID,
+			Index: i,
+			Name:  stepName(step, i),
+		}
+		if jobErr != nil {
+			update.Status = protocol.StepStatusSkipped
+			c.Send(protocol.EventTypeStepUpdate, update)
+			continue
+		}
+
+		log.Printf(">>> STEP %d/%d: %s", i+1, len(cmdPayload.Steps), update.Name)
+		update.Status = protocol.JobStatusRunning
+		update.StartedAt = time.Now().UnixMilli()
+		c.Send(protocol.EventTypeStepUpdate, update)
+
+		// Job secrets win over step env, so a step can't unset them
+		env := make(map[string]string, len(step.Env)+len(cmdPayload.Secrets))
+		for k, v := range step.Env {
+			env[k] = v
+		}
+		for k, v := range cmdPayload.Secrets {
+			env[k] = v
+		}
+		timeout := time.Duration(step.TimeoutSeconds) * time.Second
+
+		stepResources, err := runProcess(c, cmdPayload.JobID, step.Command, stepDir(workDir, step.WorkDir), env, timeout, redactor, capture)
+		resources = mergeResourceSummaries(resources, stepResources)
+
+		update.FinishedAt = time.Now().UnixMilli()
+		update.Status = protocol.JobStatusCompleted
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			code := exitErr.ExitCode()
+			update.ExitCode = &code
+		} else if err == nil {
+			code := 0
+			update.ExitCode = &code
+		}
+		if err != nil {
+			log.Printf("Step %s failed: %v", update.Name, err)
+			update.Status = protocol.JobStatusFailed
+			update.Error = err.Error()
+			if !step.ContinueOnError {
+				jobErr = fmt.Errorf("step %s failed: %w", update.Name, err)
+			}
+		}
+		c.Send(protocol.EventTypeStepUpdate, update)
+	}
+	return resources, jobErr
+}
+
+// stepName falls back to the step's position
+func stepName(step protocol.JobStep, index int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return fmt.Sprintf("step %d", index+1)
+}
+
+func stepDir(workDir string, dir string) string {
+	if dir == "" {
+		return workDir
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(workDir, dir)
+}
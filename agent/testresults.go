@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// Keep failure output small enough to show on a phone
+const maxTestOutput = 4096
+
+// parseTestResults turns the output of a TEST job into per-test results.
+// Params may set "format" (gotest-json, junit, tap) and "report" (path of a JUnit XML
+// file, relative to workDir and inside it). Without a format the output is sniffed.
+func parseTestResults(params map[string]string, output []byte, workDir string) (string, []protocol.TestCaseResult, error) {
+	format := params["format"]
+	data := output
+
+	if report := params["report"]; report != "" {
+		if !filepath.IsLocal(filepath.FromSlash(report)) {
+			return "", nil, fmt.Errorf("test report %q must be relative to the working directory", report)
+		}
+		fileData, err := os.ReadFile(filepath.Join(workDir, filepath.FromSlash(report)))
+		if err != nil {
+			return "", nil, fmt.Errorf("reading test report: %w", err)
+		}
+		data = fileData
+		if format == "" {
+			format = protocol.TestFormatJUnit
+		}
+	}
+
+	if format == "" {
+		format = detectTestFormat(data)
+	}
+
+	var results []protocol.TestCaseResult
+	var err error
+	switch format {
+	case protocol.TestFormatGoJSON:
+		results, err = parseGoTestJSON(data)
+	case protocol.TestFormatJUnit:
+		results, err = parseJUnitXML(data)
+	case protocol.TestFormatTAP:
+		results, err = parseTAP(data)
+	case "":
+		return "", nil, fmt.Errorf("could not detect test output format")
+	default:
+		return "", nil, fmt.Errorf("unknown test format %q", format)
+	}
+	return format, results, err
+}
+
+var tapPlanRegex = regexp.MustCompile(`(?m)^(TAP version \d+|1\.\.\d+)\s*$`)
+
+func detectTestFormat(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.Contains(data, []byte(`"Action":`)):
+		return protocol.TestFormatGoJSON
+	case bytes.HasPrefix(trimmed, []byte("<?xml")) || bytes.Contains(data, []byte("<testsuite")):
+		return protocol.TestFormatJUnit
+	case tapPlanRegex.Match(data):
+		return protocol.TestFormatTAP
+	}
+	return ""
+}
+
+// goTestEvent mirrors the events printed by `go test -json` (see `go doc test2json`)
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64 // seconds
+	Output  string
+}
+
+func parseGoTestJSON(data []byte) ([]protocol.TestCaseResult, error) {
+	var results []protocol.TestCaseResult
+	outputs := make(map[string]*strings.Builder)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		// Build errors and other tool output are interleaved with the JSON stream
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		var ev goTestEvent
+		if err := json.Unmarshal(line, &ev); err != nil || ev.Test == "" {
+			continue
+		}
+
+		key := ev.Package + "\x00" + ev.Test
+		switch ev.Action {
+		case "output":
+			b, ok := outputs[key]
+			if !ok {
+				b = &strings.Builder{}
+				outputs[key] = b
+			}
+			b.WriteString(ev.Output)
+		case "pass", "fail", "skip":
+			r := protocol.TestCaseResult{
+				Suite:      ev.Package,
+				Name:       ev.Test,
+				Status:     strings.ToUpper(ev.Action),
+				DurationMs: ev.Elapsed * 1000,
+			}
+			if b, ok := outputs[key]; ok && r.Status != protocol.TestStatusPass {
+				r.Output = truncateTestOutput(b.String())
+			}
+			delete(outputs, key)
+			results = append(results, r)
+		}
+	}
+	return results, scanner.Err()
+}
+
+type junitTestSuites struct {
+	Suites []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name   string           `xml:"name,attr"`
+	Cases  []junitTestCase  `xml:"testcase"`
+	Suites []junitTestSuite `xml:"testsuite"` // Some tools nest suites
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Error     *junitMessage `xml:"error"`
+	Skipped   *junitMessage `xml:"skipped"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func (m *junitMessage) text() string {
+	return strings.TrimSpace(strings.TrimSpace(m.Message) + "\n" + strings.TrimSpace(m.Body))
+}
+
+func parseJUnitXML(data []byte) ([]protocol.TestCaseResult, error) {
+	start := bytes.Index(data, []byte("<testsuite"))
+	if start < 0 {
+		return nil, fmt.Errorf("no <testsuite> element found")
+	}
+
+	// The root is either <testsuites> or a single <testsuite>
+	var suites []junitTestSuite
+	if bytes.HasPrefix(data[start:], []byte("<testsuites")) {
+		var root junitTestSuites
+		if err := xml.Unmarshal(data[start:], &root); err != nil {
+			return nil, fmt.Errorf("parsing JUnit XML: %w", err)
+		}
+		suites = root.Suites
+	} else {
+		var suite junitTestSuite
+		if err := xml.Unmarshal(data[start:], &suite); err != nil {
+			return nil, fmt.Errorf("parsing JUnit XML: %w", err)
+		}
+		suites = []junitTestSuite{suite}
+	}
+
+	var results []protocol.TestCaseResult
+	var walk func(suites []junitTestSuite)
+	walk = func(suites []junitTestSuite) {
+		for _, suite := range suites {
+			for _, tc := range suite.Cases {
+				r := protocol.TestCaseResult{
+					Suite:  tc.ClassName,
+					Name:   tc.Name,
+					Status: protocol.TestStatusPass,
+				}
+				if r.Suite == "" {
+					r.Suite = suite.Name
+				}
+				if secs, err := strconv.ParseFloat(tc.Time, 64); err == nil {
+					r.DurationMs = secs * 1000
+				}
+				switch {
+				case tc.Failure != nil:
+					r.Status = protocol.TestStatusFail
+					r.Output = truncateTestOutput(tc.Failure.text())
+				case tc.Error != nil:
+					r.Status = protocol.TestStatusFail
+					r.Output = truncateTestOutput(tc.Error.text())
+				case tc.Skipped != nil:
+					r.Status = protocol.TestStatusSkip
+					r.Output = truncateTestOutput(tc.Skipped.text())
+				}
+				results = append(results, r)
+			}
+			walk(suite.Suites)
+		}
+	}
+	walk(suites)
+	return results, nil
+}
+
+// ok 1 - description # SKIP reason
+var tapLineRegex = regexp.MustCompile(`^(not ok|ok)\b\s*(\d+)?\s*(?:-\s*)?([^#]*?)\s*(?:#\s*(\w+)\b\s*(.*))?$`)
+
+// duration_ms in the YAML diagnostic block (node-tap, tape, ...)
+var tapDurationRegex = regexp.MustCompile(`^\s*duration_ms:\s*([0-9.]+)`)
+
+func parseTAP(data []byte) ([]protocol.TestCaseResult, error) {
+	var results []protocol.TestCaseResult
+	var diag strings.Builder
+	inDiag := false
+
+	flushDiag := func() {
+		if len(results) > 0 && diag.Len() > 0 && results[len(results)-1].Status == protocol.TestStatusFail {
+			results[len(results)-1].Output = truncateTestOutput(diag.String())
+		}
+		diag.Reset()
+		inDiag = false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if inDiag {
+			if trimmed == "..." {
+				flushDiag()
+				continue
+			}
+			if m := tapDurationRegex.FindStringSubmatch(line); m != nil && len(results) > 0 {
+				if ms, err := strconv.ParseFloat(m[1], 64); err == nil {
+					results[len(results)-1].DurationMs = ms
+				}
+			}
+			diag.WriteString(trimmed + "\n")
+			continue
+		}
+		if trimmed == "---" && len(results) > 0 {
+			inDiag = true
+			continue
+		}
+
+		// Subtests are indented; only top-level points are reported
+		if line != strings.TrimLeft(line, " \t") {
+			continue
+		}
+		m := tapLineRegex.FindStringSubmatch(trimmed)
+		if m == nil {
+			continue
+		}
+
+		r := protocol.TestCaseResult{Name: m[3], Status: protocol.TestStatusPass}
+		if r.Name == "" {
+			r.Name = "test " + m[2]
+		}
+		if m[1] == "not ok" {
+			r.Status = protocol.TestStatusFail
+		}
+		switch strings.ToUpper(m[4]) {
+		case "SKIP":
+			r.Status = protocol.TestStatusSkip
+			r.Output = m[5]
+		case "TODO":
+			// TODO tests are not expected to pass
+			r.Status = protocol.TestStatusSkip
+			r.Output = "TODO " + m[5]
+		}
+		results = append(results, r)
+	}
+	flushDiag()
+	return results, scanner.Err()
+}
+
+func truncateTestOutput(s string) string {
+	if len(s) <= maxTestOutput {
+		return s
+	}
+	// Cut at a rune boundary, the results are stored as UTF-8 text
+	cut := maxTestOutput
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "\n... (truncated)"
+}
+
+type testSummary struct {
+	Passed, Failed, Skipped int
+}
+
+func summarizeTestResults(results []protocol.TestCaseResult) testSummary {
+	var s testSummary
+	for _, r := range results {
+		switch r.Status {
+		case protocol.TestStatusPass:
+			s.Passed++
+		case protocol.TestStatusFail:
+			s.Failed++
+		case protocol.TestStatusSkip:
+			s.Skipped++
+		}
+	}
+	return s
+}
+
+func (s testSummary) String() string {
+	return fmt.Sprintf("%d passed, %d failed, %d skipped", s.Passed, s.Failed, s.Skipped)
+}
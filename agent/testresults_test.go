@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// Trimmed output of `go test -json ./...` with a build error line interleaved
+const sampleGoTestJSON = `{"Time":"2024-05-01T10:00:00Z","Action":"start","Package":"example.com/app"}
+{"Time":"2024-05-01T10:00:00Z","Action":"run","Package":"example.com/app","Test":"TestAdd"}
+{"Time":"2024-05-01T10:00:00Z","Action":"output","Package":"example.com/app","Test":"TestAdd","Output":"=== RUN   TestAdd\n"}
+{"Time":"2024-05-01T10:00:00Z","Action":"pass","Package":"example.com/app","Test":"TestAdd","Elapsed":0.01}
+{"Time":"2024-05-01T10:00:00Z","Action":"run","Package":"example.com/app","Test":"TestDiv"}
+{"Time":"2024-05-01T10:00:00Z","Action":"output","Package":"example.com/app","Test":"TestDiv","Output":"    div_test.go:12: division by zero\n"}
+{"Time":"2024-05-01T10:00:00Z","Action":"fail","Package":"example.com/app","Test":"TestDiv","Elapsed":0.25}
+# example.com/app/broken
+broken/x.go:3:1: syntax error
+{"Time":"2024-05-01T10:00:00Z","Action":"output","Package":"example.com/app","Test":"TestSlow","Output":"    slow_test.go:8: -short set\n"}
+{"Time":"2024-05-01T10:00:00Z","Action":"skip","Package":"example.com/app","Test":"TestSlow"}
+{"Time":"2024-05-01T10:00:00Z","Action":"pass","Package":"example.com/app/sub","Test":"TestSub/case_1","Elapsed":0}
+{"Time":"2024-05-01T10:00:00Z","Action":"fail","Package":"example.com/app","Elapsed":0.3}
+`
+
+// Nested suites as written by pytest/jest reporters, one case without a time
+const sampleJUnit = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="all">
+  <testsuite name="api">
+    <testcase classname="api.users" name="creates a user" time="0.120"/>
+    <testcase name="lists users">
+      <failure message="expected 2 users">AssertionError: got 1</failure>
+    </testcase>
+    <testsuite name="api.admin">
+      <testcase classname="api.admin" name="needs a token" time="0.005">
+        <skipped message="flaky on CI"/>
+      </testcase>
+      <testcase classname="api.admin" name="deletes a user" time="1.5">
+        <error message="timeout"/>
+      </testcase>
+    </testsuite>
+  </testsuite>
+</testsuites>
+`
+
+const sampleTAP = `TAP version 13
+# math
+ok 1 - adds numbers
+  ---
+  duration_ms: 12.5
+  ...
+not ok 2 - divides numbers
+  ---
+  operator: equal
+  expected: 2
+  actual: 3
+  duration_ms: 4
+  ...
+ok 3 - uploads # SKIP no network
+not ok 4 # TODO not implemented
+    ok 1 - indented subtest
+ok 5
+1..5
+`
+
+func TestDetectTestFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{"go test -json", sampleGoTestJSON, protocol.TestFormatGoJSON},
+		{"junit", sampleJUnit, protocol.TestFormatJUnit},
+		{"junit without declaration", "noise\n<testsuite name=\"x\"></testsuite>", protocol.TestFormatJUnit},
+		{"tap", sampleTAP, protocol.TestFormatTAP},
+		{"tap plan only", "ok 1 - a\n1..1\n", protocol.TestFormatTAP},
+		{"plain output", "PASS\nok  \texample.com/app\t0.3s\n", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := detectTestFormat([]byte(tt.output)); got != tt.want {
+			t.Errorf("%s: detectTestFormat = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTestResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string // Empty: detected
+		output string
+		want   []protocol.TestCaseResult
+	}{
+		{
+			name:   "go test -json",
+			output: sampleGoTestJSON,
+			want: []protocol.TestCaseResult{
+				{Suite: "example.com/app", Name: "TestAdd", Status: protocol.TestStatusPass, DurationMs: 10},
+				{Suite: "example.com/app", Name: "TestDiv", Status: protocol.TestStatusFail, DurationMs: 250, Output: "    div_test.go:12: division by zero\n"},
+				{Suite: "example.com/app", Name: "TestSlow", Status: protocol.TestStatusSkip, Output: "    slow_test.go:8: -short set\n"},
+				{Suite: "example.com/app/sub", Name: "TestSub/case_1", Status: protocol.TestStatusPass},
+			},
+		},
+		{
+			name:   "junit nested suites",
+			output: sampleJUnit,
+			want: []protocol.TestCaseResult{
+				{Suite: "api.users", Name: "creates a user", Status: protocol.TestStatusPass, DurationMs: 120},
+				{Suite: "api", Name: "lists users", Status: protocol.TestStatusFail, Output: "expected 2 users\nAssertionError: got 1"},
+				{Suite: "api.admin", Name: "needs a token", Status: protocol.TestStatusSkip, DurationMs: 5, Output: "flaky on CI"},
+				{Suite: "api.admin", Name: "deletes a user", Status: protocol.TestStatusFail, DurationMs: 1500, Output: "timeout"},
+			},
+		},
+		{
+			name:   "junit single suite",
+			format: protocol.TestFormatJUnit,
+			output: `<testsuite name="unit"><testcase name="a" time="bad"/></testsuite>`,
+			want: []protocol.TestCaseResult{
+				{Suite: "unit", Name: "a", Status: protocol.TestStatusPass},
+			},
+		},
+		{
+			name:   "tap",
+			output: sampleTAP,
+			want: []protocol.TestCaseResult{
+				{Name: "adds numbers", Status: protocol.TestStatusPass, DurationMs: 12.5},
+				{Name: "divides numbers", Status: protocol.TestStatusFail, DurationMs: 4, Output: "operator: equal\nexpected: 2\nactual: 3\nduration_ms: 4\n"},
+				{Name: "uploads", Status: protocol.TestStatusSkip, Output: "no network"},
+				{Name: "test 4", Status: protocol.TestStatusSkip, Output: "TODO not implemented"},
+				{Name: "test 5", Status: protocol.TestStatusPass},
+			},
+		},
+	}
+	for _, tt := range tests {
+		format, got, err := parseTestResults(map[string]string{"format": tt.format}, []byte(tt.output), t.TempDir())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.format != "" && format != tt.format {
+			t.Errorf("%s: format = %q, want %q", tt.name, format, tt.format)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTestResultsReport(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.xml"), []byte(sampleJUnit), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The report file wins over the command output, and implies JUnit
+	format, results, err := parseTestResults(map[string]string{"report": "report.xml"}, []byte(sampleTAP), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != protocol.TestFormatJUnit || len(results) != 4 {
+		t.Errorf("got %s with %d results, want junit with 4", format, len(results))
+	}
+
+	for _, report := range []string{"../report.xml", "/etc/passwd", "sub/../../report.xml"} {
+		if _, _, err := parseTestResults(map[string]string{"report": report}, nil, dir); err == nil {
+			t.Errorf("report %q outside the working directory: expected an error", report)
+		}
+	}
+	if _, _, err := parseTestResults(map[string]string{"report": "missing.xml"}, nil, dir); err == nil {
+		t.Error("missing report: expected an error")
+	}
+	if _, _, err := parseTestResults(nil, []byte("just some output\n"), dir); err == nil {
+		t.Error("undetectable output: expected an error")
+	}
+	if _, _, err := parseTestResults(map[string]string{"format": "nunit"}, nil, dir); err == nil {
+		t.Error("unknown format: expected an error")
+	}
+}
+
+func TestTruncateTestOutput(t *testing.T) {
+	long := strings.Repeat("x", maxTestOutput+10)
+	got := truncateTestOutput(long)
+	if !strings.HasPrefix(got, long[:maxTestOutput]) || !strings.HasSuffix(got, "(truncated)") {
+		t.Errorf("long output not truncated: %d bytes", len(got))
+	}
+	// A multibyte rune across the limit is left out whole
+	got = truncateTestOutput(strings.Repeat("x", maxTestOutput-1) + "é" + long)
+	if !utf8.ValidString(got) || !strings.HasPrefix(got, strings.Repeat("x", maxTestOutput-1)+"\n") {
+		t.Errorf("truncated output is not valid UTF-8 or cut early: %q", got[maxTestOutput-4:])
+	}
+	if got := truncateTestOutput("short"); got != "short" {
+		t.Errorf("short output changed: %q", got)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+const (
+	tunnelChunkSize = 32 * 1024
+	// Frames from the backend buffered per stream before it is aborted
+	// (the read loop must never block on a slow dev server)
+	tunnelInboundBuffer = 256
+)
+
+// Requests to the dev server: no redirects (the browser follows them), no
+// timeout (HMR and event streams stay open), no transparent decompression
+var tunnelHTTPClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		Proxy:              nil,
+		DisableCompression: true,
+	},
+}
+
+// tunnelFrame is a body chunk or WebSocket message from the backend
+type tunnelFrame struct {
+	data        []byte
+	eof         bool
+	messageType int
+}
+
+type tunnelStream struct {
+	id      string
+	inbound chan tunnelFrame
+	cancel  context.CancelFunc
+}
+
+// tunnelClient serves TUNNEL_REQUESTs by proxying them to a local dev server
+type tunnelClient struct {
+	conn *safeConn
+	port func() int // 0 if no dev server is available
+
+	mu      sync.Mutex
+	streams map[string]*tunnelStream
+}
+
+func newTunnelClient(c *safeConn, port func() int) *tunnelClient {
+	return &tunnelClient{
+		conn:    c,
+		port:    port,
+		streams: make(map[string]*tunnelStream),
+	}
+}
+
+// handle processes tunnel frames from the read loop. It returns false for other payloads.
+func (t *tunnelClient) handle(payload protocol.Payload) bool {
+	switch p := payload.(type) {
+	case *protocol.TunnelRequestPayload:
+		t.open(*p)
+	case *protocol.TunnelDataPayload:
+		t.deliver(p.StreamID, tunnelFrame{data: p.Data, eof: p.EOF})
+	case *protocol.TunnelWSMessagePayload:
+		t.deliver(p.StreamID, tunnelFrame{data: p.Data, messageType: p.MessageType})
+	case *protocol.TunnelClosePayload:
+		t.close(p.StreamID)
+	default:
+		return false
+	}
+	return true
+}
+
+func (t *tunnelClient) open(req protocol.TunnelRequestPayload) {
+	port := t.port()
+	if port == 0 {
+		t.sendClose(req.StreamID, "no dev server running on the agent (start one or pass -preview-port)")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &tunnelStream{
+		id:      req.StreamID,
+		inbound: make(chan tunnelFrame, tunnelInboundBuffer),
+		cancel:  cancel,
+	}
+
+	t.mu.Lock()
+	t.streams[stream.id] = stream
+	t.mu.Unlock()
+
+	if req.WebSocket {
+		go t.proxyWebSocket(ctx, stream, req, port)
+	} else {
+		go t.proxyHTTP(ctx, stream, req, port)
+	}
+}
+
+func (t *tunnelClient) deliver(streamID string, frame tunnelFrame) {
+	t.mu.Lock()
+	stream, ok := t.streams[streamID]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case stream.inbound <- frame:
+	default:
+		t.close(streamID)
+		t.sendClose(streamID, "dev server too slow")
+	}
+}
+
+// close cancels a stream; its goroutines clean up
+func (t *tunnelClient) close(streamID string) {
+	t.mu.Lock()
+	stream, ok := t.streams[streamID]
+	delete(t.streams, streamID)
+	t.mu.Unlock()
+	if ok {
+		stream.cancel()
+	}
+}
+
+func (t *tunnelClient) proxyHTTP(ctx context.Context, stream *tunnelStream, req protocol.TunnelRequestPayload, port int) {
+	defer t.close(stream.id)
+
+	// The request body arrives as TUNNEL_DATA frames
+	bodyReader, bodyWriter := io.Pipe()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				bodyWriter.CloseWithError(ctx.Err())
+				return
+			case frame := <-stream.inbound:
+				if len(frame.data) > 0 {
+					if _, err := bodyWriter.Write(frame.data); err != nil {
+						return
+					}
+				}
+				if frame.eof {
+					bodyWriter.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, fmt.Sprintf("http://127.0.0.1:%d%s", port, req.Path), bodyReader)
+	if err != nil {
+		t.sendClose(stream.id, err.Error())
+		return
+	}
+	httpReq.Header = http.Header(req.Headers).Clone()
+	// Dev servers check the Host header (e.g. Vite's allowedHosts)
+	httpReq.Host = fmt.Sprintf("localhost:%d", port)
+	if n, err := strconv.ParseInt(httpReq.Header.Get("Content-Length"), 10, 64); err == nil {
+		httpReq.ContentLength = n
+	}
+	if httpReq.ContentLength == 0 && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		httpReq.Body = http.NoBody
+	}
+
+	resp, err := tunnelHTTPClient.Do(httpReq)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			t.sendClose(stream.id, err.Error())
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	t.conn.Send(protocol.EventTypeTunnelResponse, protocol.TunnelResponsePayload{
+		StreamID: stream.id,
+		Status:   resp.StatusCode,
+		Headers:  resp.Header,
+	})
+
+	buf := make([]byte, tunnelChunkSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		frame := protocol.TunnelDataPayload{StreamID: stream.id, EOF: err == io.EOF}
+		if n > 0 {
+			frame.Data = append([]byte(nil), buf[:n]...)
+		}
+		if n > 0 || frame.EOF {
+			t.conn.Send(protocol.EventTypeTunnelData, frame)
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				t.sendClose(stream.id, err.Error())
+			}
+			return
+		}
+	}
+}
+
+func (t *tunnelClient) proxyWebSocket(ctx context.Context, stream *tunnelStream, req protocol.TunnelRequestPayload, port int) {
+	defer t.close(stream.id)
+
+	headers := http.Header(req.Headers).Clone()
+	dialer := websocket.Dialer{}
+	if protocols := headers.Get("Sec-Websocket-Protocol"); protocols != "" {
+		for _, p := range strings.Split(protocols, ",") {
+			dialer.Subprotocols = append(dialer.Subprotocols, strings.TrimSpace(p))
+		}
+	}
+	headers.Del("Sec-Websocket-Protocol")
+	headers.Set("Host", fmt.Sprintf("localhost:%d", port))
+
+	upstream, resp, err := dialer.DialContext(ctx, fmt.Sprintf("ws://127.0.0.1:%d%s", port, req.Path), headers)
+	if err != nil {
+		status := http.StatusBadGateway
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		log.Printf("Preview websocket to port %d failed: %v", port, err)
+		t.conn.Send(protocol.EventTypeTunnelResponse, protocol.TunnelResponsePayload{StreamID: stream.id, Status: status})
+		return
+	}
+	defer upstream.Close()
+
+	respHeaders := map[string][]string{}
+	if p := upstream.Subprotocol(); p != "" {
+		respHeaders["Sec-Websocket-Protocol"] = []string{p}
+	}
+	t.conn.Send(protocol.EventTypeTunnelResponse, protocol.TunnelResponsePayload{
+		StreamID: stream.id,
+		Status:   http.StatusSwitchingProtocols,
+		Headers:  respHeaders,
+	})
+
+	// Backend -> dev server
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				upstream.Close()
+				return
+			case frame := <-stream.inbound:
+				if err := upstream.WriteMessage(frame.messageType, frame.data); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// Dev server -> backend
+	for {
+		messageType, data, err := upstream.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil {
+				t.sendClose(stream.id, "")
+			}
+			return
+		}
+		t.conn.Send(protocol.EventTypeTunnelWSMessage, protocol.TunnelWSMessagePayload{
+			StreamID:    stream.id,
+			MessageType: messageType,
+			Data:        data,
+		})
+	}
+}
+
+func (t *tunnelClient) sendClose(streamID string, reason string) {
+	t.conn.Send(protocol.EventTypeTunnelClose, protocol.TunnelClosePayload{StreamID: streamID, Error: reason})
+}
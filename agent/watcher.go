@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// Skipped unless -watch-ignore overrides them
+const defaultWatchIgnore = "node_modules,.git,dist,build,.next,coverage,*.log"
+
+type watchConfig struct {
+	jobType  string // BUILD or TEST
+	command  string
+	ignore   []string
+	debounce time.Duration
+	interval time.Duration // Polling interval
+}
+
+// fileState is what we compare between scans
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watcher polls the working directory and runs a local job after a burst of
+// changes has settled. Polling keeps the agent free of platform-specific
+// notification APIs and works the same on every OS and network drive.
+type watcher struct {
+	conn    *safeConn
+	workDir string
+	config  watchConfig
+}
+
+func newWatcher(c *safeConn, workDir string, config watchConfig) *watcher {
+	return &watcher{conn: c, workDir: workDir, config: config}
+}
+
+// Run blocks until stop is closed
+func (w *watcher) Run(stop <-chan struct{}) {
+	log.Printf("Watching %s (%s on change, ignoring %s)", w.workDir, w.config.jobType, strings.Join(w.config.ignore, ","))
+
+	snapshot, err := w.scan()
+	if err != nil {
+		log.Printf("Watch: initial scan failed: %v", err)
+	}
+
+	var lastChange time.Time
+	pending := false
+
+	ticker := time.NewTicker(w.config.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			current, err := w.scan()
+			if err != nil {
+				log.Printf("Watch: scan failed: %v", err)
+				continue
+			}
+			if changed := diffSnapshots(snapshot, current); changed != "" {
+				if !pending {
+					log.Printf("Watch: change detected (%s)", changed)
+				}
+				pending = true
+				lastChange = now
+			}
+			snapshot = current
+
+			// Debounce: wait until the burst (editor save, git checkout, ...) is over
+			if pending && now.Sub(lastChange) >= w.config.debounce {
+				pending = false
+				w.runJob()
+
+				// Ignore whatever the job itself wrote
+				if s, err := w.scan(); err == nil {
+					snapshot = s
+				}
+			}
+		}
+	}
+}
+
+// runJob reports a new job to the backend and runs it like a dispatched command
+func (w *watcher) runJob() {
+	cmdPayload := protocol.CommandPayload{
+		JobID:   newJobID(),
+		Type:    w.config.jobType,
+		Command: w.config.command,
+	}
+
+	log.Printf(">>> WATCH: %s (%s)", cmdPayload.Type, cmdPayload.JobID)
+	w.conn.Send(protocol.EventTypeJobCreated, protocol.JobCreatedPayload{
+		JobID:         cmdPayload.JobID,
+		Type:          cmdPayload.Type,
+		Command:       cmdPayload.Command,
+		TriggerSource: protocol.TriggerSourceWatch,
+	})
+
+	if simulation != nil {
+		simulation.Run(cmdPayload)
+	} else if cmdPayload.Type == "TEST" {
+		runTestJob(w.conn, cmdPayload, w.workDir)
+	} else {
+		runShellJob(w.conn, cmdPayload, w.workDir)
+	}
+}
+
+func (w *watcher) scan() (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.WalkDir(w.workDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may disappear while we walk
+			if p == w.workDir {
+				return err
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(w.workDir, p)
+		if rel == "." {
+			return nil
+		}
+		if w.ignored(filepath.ToSlash(rel), d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files[rel] = fileState{modTime: info.ModTime(), size: info.Size()}
+		return nil
+	})
+	return files, err
+}
+
+// ignored matches patterns against the base name ("node_modules", "*.log")
+// or, for patterns containing a slash, the relative path ("src/generated/*")
+func (w *watcher) ignored(rel string, name string) bool {
+	for _, pattern := range w.config.ignore {
+		target := name
+		if strings.Contains(pattern, "/") {
+			target = rel
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// diffSnapshots returns one changed path, or "" if nothing changed
+func diffSnapshots(before, after map[string]fileState) string {
+	for p, st := range after {
+		if prev, ok := before[p]; !ok || prev != st {
+			return p
+		}
+	}
+	for p := range before {
+		if _, ok := after[p]; !ok {
+			return p
+		}
+	}
+	return ""
+}
+
+func parseWatchIgnore(list string) []string {
+	var patterns []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, strings.TrimSuffix(p, "/"))
+		}
+	}
+	return patterns
+}
+
+// newJobID returns a random UUID (v4), the format of jobs.id
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
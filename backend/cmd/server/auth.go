@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rohaaaaaan/devair-backend/internal/core"
+	"github.com/rohaaaaaan/devair-backend/internal/gateway"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+)
+
+// Set per project for /preview/<id>/, which is loaded by iframes and can't send headers.
+// The API itself only accepts the Authorization header, so it is not exposed to CSRF.
+// The gateway keeps it from the dev servers behind /preview.
+const sessionCookie = gateway.SessionCookie
+
+// previewPath is the cookie path of a project's previews
+func previewPath(projectID string) string {
+	return "/preview/" + url.PathEscape(projectID) + "/"
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// requireUser rejects requests without a valid session with 401 and stores the
+// user in the context under "user". allowCookie also accepts the session cookie.
+func requireUser(svc *core.Service, allowCookie bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c.Request)
+		if token == "" && allowCookie {
+			token, _ = c.Cookie(sessionCookie)
+		}
+		user, err := svc.AuthenticateUser(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not logged in"})
+			return
+		}
+		c.Set("user", user)
+		c.Next()
+	}
+}
+
+// projectAuth checks the user's role in the project a request is about. It is
+// disabled when clients are not authenticated.
+type projectAuth struct {
+	svc      *core.Service
+	disabled bool
+}
+
+// require rejects requests of users without at least role in the project
+// projectOf finds for the request with 403, or 404 if there is no such job or agent.
+// It runs after requireUser.
+func (a projectAuth) require(role string, projectOf func(c *gin.Context) (string, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.disabled {
+			c.Next()
+			return
+		}
+		projectID, err := projectOf(c)
+		if errors.Is(err, core.ErrJobNotFound) || errors.Is(err, core.ErrAgentNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		user := c.MustGet("user").(models.User)
+		err = a.svc.Authorize(projectID, user.ID, role)
+		if errors.Is(err, core.ErrForbidden) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Requires the " + role + " role in this project"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// projectParam finds the project in a route parameter
+func projectParam(name string) func(c *gin.Context) (string, error) {
+	return func(c *gin.Context) (string, error) {
+		return c.Param(name), nil
+	}
+}
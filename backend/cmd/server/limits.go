@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rohaaaaaan/devair-backend/internal/core"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+)
+
+// loadLimits reads the limits of job triggering from the environment:
+// RATE_LIMIT_USER and RATE_LIMIT_PROJECT ("<count>/<duration>", e.g. "30/1m"),
+// MAX_ACTIVE_JOBS and DAILY_JOB_QUOTA (per project). "0" disables a limit.
+func loadLimits() (core.Limits, error) {
+	limits := core.Limits{
+		UserRate:      core.Rate{Count: 30, Per: time.Minute},
+		ProjectRate:   core.Rate{Count: 60, Per: time.Minute},
+		MaxActiveJobs: 20,
+		DailyJobs:     1000,
+	}
+	for env, rate := range map[string]*core.Rate{"RATE_LIMIT_USER": &limits.UserRate, "RATE_LIMIT_PROJECT": &limits.ProjectRate} {
+		if v := os.Getenv(env); v != "" {
+			r, err := core.ParseRate(v)
+			if err != nil {
+				return core.Limits{}, fmt.Errorf("%s: %w", env, err)
+			}
+			*rate = r
+		}
+	}
+	for env, n := range map[string]*int{"MAX_ACTIVE_JOBS": &limits.MaxActiveJobs, "DAILY_JOB_QUOTA": &limits.DailyJobs} {
+		if v := os.Getenv(env); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				return core.Limits{}, fmt.Errorf("%s: invalid number %q", env, v)
+			}
+			*n = i
+		}
+	}
+	return limits, nil
+}
+
+// limitTriggers rejects a request that would trigger a job over the rate limits
+// of the user or of the project in the "id" parameter with 429 and a
+// Retry-After header. A request that creates no job doesn't count.
+func limitTriggers(svc *core.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := ""
+		if user, ok := c.Get("user"); ok {
+			userID = user.(models.User).ID
+		}
+		projectID := c.Param("id")
+		if err := svc.CheckTrigger(projectID, userID); err != nil {
+			triggerFailed(c, err)
+			c.Abort()
+			return
+		}
+		c.Next()
+		if c.Writer.Status() >= http.StatusMultipleChoices {
+			svc.RefundTrigger(projectID, userID)
+		}
+	}
+}
+
+// triggerFailed responds to a failed job trigger: 429 and a Retry-After header
+// if it was over a limit, 500 otherwise
+func triggerFailed(c *gin.Context, err error) {
+	var limited *core.LimitError
+	if errors.As(err, &limited) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(limited.RetryAfter().Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": limited.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
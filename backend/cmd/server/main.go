@@ -1,15 +1,22 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"github.com/rohaaaaaan/devair-backend/internal/cluster"
 	"github.com/rohaaaaaan/devair-backend/internal/core"
 	"github.com/rohaaaaaan/devair-backend/internal/db"
 	"github.com/rohaaaaaan/devair-backend/internal/gateway"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+	"github.com/rohaaaaaan/devair-protocol"
 )
 
 func main() {
@@ -27,53 +34,503 @@ func main() {
 
 	// Init Service
 	svc := core.NewService()
+	gateway.GlobalManager.OnAgentMessage = svc.HandleAgentMessage
+	gateway.GlobalManager.OnJobUpdate = svc.ApplyJobUpdate
+	gateway.GlobalManager.OnLogChunk = svc.AppendLog
+	gateway.GlobalManager.ReplayLogs = svc.ReplayJobLog
+	gateway.GlobalManager.OnClientCommand = svc.SubmitCommand
+	gateway.GlobalManager.AuthorizeCommand = svc.AuthorizeCommand
+	gateway.GlobalManager.OnAgentConnected = svc.DeliverQueuedJobs
+	gateway.GlobalManager.OnJobUnassigned = svc.RequeueJob
+	gateway.GlobalManager.AuthenticateAgent = svc.AuthenticateAgent
+	if os.Getenv("ALLOW_UNAUTHENTICATED_AGENTS") == "true" {
+		log.Println("Warning: ALLOW_UNAUTHENTICATED_AGENTS is set, agent tokens are not checked")
+		gateway.GlobalManager.AuthenticateAgent = nil
+	}
+	// How long a job waits for an agent before it fails, e.g. "30m" ("0" never expires)
+	queuedJobTTL := time.Hour
+	if v := os.Getenv("QUEUED_JOB_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid QUEUED_JOB_TTL %q: %v", v, err)
+		}
+		queuedJobTTL = ttl
+	}
+	svc.StartJobQueue(queuedJobTTL)
+	gateway.GlobalManager.StartCommandResends()
+	gateway.GlobalManager.StartEventLogCleanup()
+	limits, err := loadLimits()
+	if err != nil {
+		log.Fatalf("Invalid limits: %v", err)
+	}
+	svc.SetLimits(limits)
+	// Instances sharing the database relay sockets to each other
+	if db.Pool != nil {
+		cluster.Start(gateway.GlobalManager)
+	}
+	gateway.GlobalManager.AuthenticateClient = svc.AuthenticateClient
+	requireLogin, requirePreviewLogin := requireUser(svc, false), requireUser(svc, true)
+	auth := projectAuth{svc: svc}
+	if os.Getenv("ALLOW_UNAUTHENTICATED_CLIENTS") == "true" {
+		log.Println("Warning: ALLOW_UNAUTHENTICATED_CLIENTS is set, the API and client sockets are open to anyone")
+		gateway.GlobalManager.AuthenticateClient = nil
+		gateway.GlobalManager.AuthorizeCommand = nil
+		requireLogin = func(c *gin.Context) { c.Next() }
+		requirePreviewLogin = requireLogin
+		auth.disabled = true
+	}
+	// Project roles required by the routes, by where the route finds its project
+	byJob := func(c *gin.Context) (string, error) { return svc.JobProject(c.Param("id")) }
+	byAgent := func(c *gin.Context) (string, error) { return svc.AgentProject(c.Param("id")) }
+	viewer := auth.require(core.RoleViewer, projectParam("id"))
+	operator := auth.require(core.RoleOperator, projectParam("id"))
+	admin := auth.require(core.RoleAdmin, projectParam("id"))
+	jobViewer := auth.require(core.RoleViewer, byJob)
+	agentAdmin := auth.require(core.RoleAdmin, byAgent)
+	trigger := limitTriggers(svc) // Rate limits and quotas of the routes that start jobs
+
+	// Browser origins allowed to use the API and sockets, comma-separated ("*" for any)
+	allowedOrigins := "http://localhost:5173,http://127.0.0.1:5173"
+	if v := os.Getenv("ALLOWED_ORIGINS"); v != "" {
+		allowedOrigins = v
+	}
+	gateway.SetAllowedOrigins(strings.Split(allowedOrigins, ","))
 
 	// Init Gin
 	r := gin.Default()
 
-	// CORS
+	// CORS, for the allowed origins only
 	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*") // Allow all for dev
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		allowed := gateway.OriginAllowed(c.Request)
+		c.Writer.Header().Add("Vary", "Origin")
+		if origin := c.GetHeader("Origin"); origin != "" && allowed {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Last-Event-ID")
+		}
 		if c.Request.Method == "OPTIONS" {
+			if !allowed {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
 			c.AbortWithStatus(204)
 			return
 		}
 		c.Next()
 	})
 
+	// Routes that don't need a login session
+	public := r.Group("/api")
+	{
+		public.POST("/auth/register", func(c *gin.Context) {
+			var req struct {
+				Email    string `json:"email"`
+				Password string `json:"password"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+				return
+			}
+			user, err := svc.Register(req.Email, req.Password)
+			switch {
+			case errors.Is(err, core.ErrInvalidEmail), errors.Is(err, core.ErrInvalidPassword):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.Is(err, core.ErrEmailTaken):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			case err != nil:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusCreated, user)
+			}
+		})
+
+		public.POST("/auth/login", func(c *gin.Context) {
+			var req struct {
+				Email    string `json:"email"`
+				Password string `json:"password"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+				return
+			}
+			session, err := svc.Login(req.Email, req.Password)
+			if errors.Is(err, core.ErrInvalidCredentials) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, session)
+		})
+
+		// Lets an agent started without -project find its project (authenticated by its token)
+		public.GET("/agents/me", func(c *gin.Context) {
+			agent, err := svc.GetAgentByToken(bearerToken(c.Request))
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid agent token"})
+				return
+			}
+			c.JSON(http.StatusOK, agent)
+		})
+	}
+
 	// Routes
-	api := r.Group("/api")
+	api := r.Group("/api", requireLogin)
 	{
+		api.GET("/auth/me", func(c *gin.Context) {
+			user, ok := c.Get("user")
+			if !ok {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Not logged in"})
+				return
+			}
+			c.JSON(http.StatusOK, user)
+		})
+
+		api.POST("/auth/logout", func(c *gin.Context) {
+			if err := svc.Logout(bearerToken(c.Request)); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			// The preview cookies hold the ended session, they no longer log anyone in
+			c.Status(http.StatusNoContent)
+		})
+
+		// The projects the user is a member of (all of them without authentication)
 		api.GET("/projects", func(c *gin.Context) {
-			projects := svc.GetProjects()
+			user, ok := c.Get("user")
+			if !ok {
+				c.JSON(http.StatusOK, svc.GetProjects())
+				return
+			}
+			projects, err := svc.GetUserProjects(user.(models.User).ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
 			c.JSON(http.StatusOK, projects)
 		})
 
-		api.POST("/projects/:id/build", func(c *gin.Context) {
+		// Lets the browser load /preview/<id>/ with the session, which iframes
+		// can't send as a header. The cookie is scoped to this project's
+		// previews, so no other project's dev server gets it.
+		api.POST("/projects/:id/preview-session", viewer, func(c *gin.Context) {
+			c.SetSameSite(http.SameSiteLaxMode)
+			c.SetCookie(sessionCookie, bearerToken(c.Request), 0, previewPath(c.Param("id")), "", c.Request.TLS != nil, true)
+			c.Status(http.StatusNoContent)
+		})
+
+		api.DELETE("/projects/:id/preview-session", func(c *gin.Context) {
+			c.SetCookie(sessionCookie, "", -1, previewPath(c.Param("id")), "", c.Request.TLS != nil, true)
+			c.Status(http.StatusNoContent)
+		})
+
+		// Project members and their roles (viewer, operator, admin)
+		api.GET("/projects/:id/members", viewer, func(c *gin.Context) {
+			members, err := svc.GetMembers(c.Param("id"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, members)
+		})
+
+		api.PUT("/projects/:id/members", admin, func(c *gin.Context) {
+			var req struct {
+				Email string `json:"email"`
+				Role  string `json:"role"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+				return
+			}
+			member, err := svc.SetMember(c.Param("id"), req.Email, req.Role)
+			switch {
+			case errors.Is(err, core.ErrInvalidRole):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.Is(err, core.ErrUserNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			case errors.Is(err, core.ErrLastAdmin):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			case err != nil:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusOK, member)
+			}
+		})
+
+		api.DELETE("/projects/:id/members/:userID", admin, func(c *gin.Context) {
+			err := svc.RemoveMember(c.Param("id"), c.Param("userID"))
+			switch {
+			case errors.Is(err, core.ErrMemberNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			case errors.Is(err, core.ErrLastAdmin):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			case err != nil:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			default:
+				c.Status(http.StatusNoContent)
+			}
+		})
+
+		api.POST("/projects/:id/build", operator, trigger, func(c *gin.Context) {
 			projectID := c.Param("id")
-			job, _ := svc.TriggerBuild(projectID)
+			job, err := svc.TriggerBuild(projectID)
+			if err != nil {
+				triggerFailed(c, err)
+				return
+			}
 			c.JSON(http.StatusOK, job)
 		})
 
-		api.POST("/projects/:id/command", func(c *gin.Context) {
+		api.POST("/projects/:id/test", operator, trigger, func(c *gin.Context) {
 			projectID := c.Param("id")
 			var req struct {
-				Type string `json:"type"`
+				Params map[string]string `json:"params"` // format (gotest-json, junit, tap), report (JUnit file path)
+			}
+			// Body is optional
+			if c.Request.ContentLength > 0 {
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+					return
+				}
+			}
+			job, err := svc.TriggerTest(projectID, req.Params)
+			if err != nil {
+				triggerFailed(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, job)
+		})
+
+		// The command TEST jobs run, e.g. "go test -json ./..." ("" restores npm test)
+		api.PUT("/projects/:id/test-command", admin, func(c *gin.Context) {
+			var req struct {
+				Command string `json:"command"`
 			}
 			if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 				return
 			}
-			job, err := svc.TriggerJob(projectID, req.Type)
+			if err := svc.SetTestCommand(c.Param("id"), req.Command); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.Status(http.StatusNoContent)
+		})
+
+		api.GET("/jobs/:id/tests", jobViewer, func(c *gin.Context) {
+			results, err := svc.GetTestResults(c.Param("id"))
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
+			c.JSON(http.StatusOK, results)
+		})
+
+		// Log of a job, all of it or the range ?offset=<byte>&limit=<bytes>
+		api.GET("/jobs/:id/logs", jobViewer, func(c *gin.Context) {
+			offset, err := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+			if err != nil || offset < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+				return
+			}
+			limit, err := strconv.ParseInt(c.DefaultQuery("limit", "0"), 10, 64)
+			if err != nil || limit < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+				return
+			}
+			jobLog, err := svc.GetJobLog(c.Param("id"), offset, limit)
+			if errors.Is(err, core.ErrJobNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, jobLog)
+		})
+
+		// Server-Sent Events: LOG_CHUNK, JOB_UPDATE and AI_STAGE_UPDATE, resumable with Last-Event-ID.
+		// A job stream starts with the job's stored log and ends when the job does.
+		api.GET("/jobs/:id/events", jobViewer, func(c *gin.Context) {
+			job, err := svc.GetJob(c.Param("id"))
+			if errors.Is(err, core.ErrJobNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			finished := func() *protocol.JobUpdatePayload {
+				if update := core.FinalJobUpdate(job); update != nil {
+					return update
+				}
+				// The job may have ended before the stream was registered
+				if job, err := svc.GetJob(job.ID); err == nil {
+					return core.FinalJobUpdate(job)
+				}
+				return nil
+			}
+			gateway.GlobalManager.ServeEvents(c, job.ProjectID, job.ID, finished)
+		})
+
+		api.GET("/projects/:id/events", viewer, func(c *gin.Context) {
+			gateway.GlobalManager.ServeEvents(c, c.Param("id"), "", nil)
+		})
+
+		api.GET("/jobs/:id/steps", jobViewer, func(c *gin.Context) {
+			steps, err := svc.GetJobSteps(c.Param("id"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, steps)
+		})
+
+		api.GET("/projects/:id/resource-usage", viewer, func(c *gin.Context) {
+			limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+			if err != nil || limit <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+				return
+			}
+			usage, err := svc.GetResourceUsage(c.Param("id"), c.DefaultQuery("sort", "peak_rss"), limit)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, usage)
+		})
+
+		// Supervised dev servers (SERVICE_START / SERVICE_STOP)
+		api.GET("/projects/:id/services", viewer, func(c *gin.Context) {
+			c.JSON(http.StatusOK, svc.GetServices(c.Param("id")))
+		})
+
+		api.POST("/projects/:id/services/:name/start", operator, trigger, func(c *gin.Context) {
+			var req struct {
+				Command string            `json:"command"` // Defaults to "npm run dev"
+				Params  map[string]string `json:"params"`  // port, health_path, max_restarts
+			}
+			if c.Request.ContentLength > 0 {
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+					return
+				}
+			}
+			job, err := svc.StartService(c.Param("id"), c.Param("name"), req.Command, req.Params)
+			if err != nil {
+				triggerFailed(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, job)
+		})
+
+		api.POST("/projects/:id/services/:name/stop", operator, trigger, func(c *gin.Context) {
+			job, err := svc.StopService(c.Param("id"), c.Param("name"))
+			if err != nil {
+				triggerFailed(c, err)
+				return
+			}
 			c.JSON(http.StatusOK, job)
 		})
 
+		api.POST("/projects/:id/command", operator, trigger, func(c *gin.Context) {
+			projectID := c.Param("id")
+			var req struct {
+				Type    string              `json:"type"`
+				Command string              `json:"command"` // Optional, overrides the default command of the type (not BUILD or TEST, use steps)
+				Params  map[string]string   `json:"params"`
+				Secrets map[string]string   `json:"secrets"` // Env vars for the command, never echoed in its logs
+				Steps   []protocol.JobStep  `json:"steps"`   // Multi-step job, replaces command
+				Cache   *protocol.CacheSpec `json:"cache"`   // Opt-in: skip the job when its inputs are unchanged
+				Labels  []string            `json:"labels"`  // Only agents with all of these labels run the job
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+				return
+			}
+			if err := protocol.ValidateSteps(req.Steps); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := req.Cache.Validate(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			job, err := svc.TriggerCommand(projectID, protocol.CommandPayload{
+				Type:    req.Type,
+				Command: req.Command,
+				Params:  req.Params,
+				Secrets: req.Secrets,
+				Steps:   req.Steps,
+				Cache:   req.Cache,
+				Labels:  req.Labels,
+			})
+			if err != nil {
+				triggerFailed(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, job)
+		})
+
+		// Agent tokens: shown once on create/rotate, only a hash is stored
+		api.GET("/projects/:id/agents", viewer, func(c *gin.Context) {
+			agents, err := svc.GetAgents(c.Param("id"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, agents)
+		})
+
+		api.POST("/projects/:id/agents", admin, func(c *gin.Context) {
+			var req struct {
+				Name string `json:"name"` // e.g. the machine the agent runs on
+			}
+			if c.Request.ContentLength > 0 {
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+					return
+				}
+			}
+			token, err := svc.CreateAgent(c.Param("id"), req.Name)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusCreated, token)
+		})
+
+		api.POST("/agents/:id/rotate", agentAdmin, func(c *gin.Context) {
+			token, err := svc.RotateAgentToken(c.Param("id"))
+			if errors.Is(err, core.ErrAgentNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found or revoked"})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, token)
+		})
+
+		api.DELETE("/agents/:id", agentAdmin, func(c *gin.Context) {
+			agent, err := svc.RevokeAgent(c.Param("id"))
+			if errors.Is(err, core.ErrAgentNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, agent)
+		})
+
 		// AI Analysis Endpoint
 		aiSvc := core.NewAIService()
 		api.POST("/ai/analyze", func(c *gin.Context) {
@@ -90,7 +547,7 @@ func main() {
 		})
 
 		// AI Command Endpoint (OPEN_APP, AI_INSTRUCTION, UI_ACTION)
-		api.POST("/projects/:id/ai-command", func(c *gin.Context) {
+		api.POST("/projects/:id/ai-command", operator, trigger, func(c *gin.Context) {
 			projectID := c.Param("id")
 			var req struct {
 				Type   string `json:"type"`   // OPEN_APP, AI_INSTRUCTION, UI_ACTION
@@ -106,7 +563,7 @@ func main() {
 			}
 			job, err := svc.TriggerJobWithParams(projectID, req.Type, req.App, req.Prompt, req.Action, req.Target, req.Value)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				triggerFailed(c, err)
 				return
 			}
 			c.JSON(http.StatusOK, job)
@@ -116,6 +573,9 @@ func main() {
 	// WebSocket
 	r.GET("/ws", gateway.HandleWebSocket)
 
+	// Preview: proxies to the dev server on the agent machine (HTTP and WebSocket/HMR)
+	r.Any("/preview/:projectID/*path", requirePreviewLogin, auth.require(core.RoleViewer, projectParam("projectID")), gateway.HandlePreview)
+
 	// Start Server
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,410 @@
+// Package cluster lets several backend instances share one database and act as
+// one gateway. Instances talk over Postgres LISTEN/NOTIFY and publish which
+// agents and clients they hold in gateway_presence, with a TTL so a crashed
+// instance drops out on its own.
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rohaaaaaan/devair-backend/internal/db"
+	"github.com/rohaaaaaan/devair-backend/internal/gateway"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+const (
+	channel = "devair_gateway"
+
+	heartbeatInterval = 10 * time.Second
+	presenceTTL       = 3 * heartbeatInterval
+
+	// Postgres rejects NOTIFY payloads of 8000 bytes or more; larger messages
+	// go through gateway_messages
+	maxNotifyPayload = 7900
+	messageTTL       = time.Minute
+
+	outboxSize = 1024
+
+	// Disconnects are published at once and retried, the revoke waits for them
+	publishAttempts = 3
+	publishBackoff  = 500 * time.Millisecond
+)
+
+const (
+	kindBroadcast  = "broadcast"
+	kindDispatch   = "dispatch"
+	kindDisconnect = "disconnect"
+	kindPresence   = "presence" // The sender's presence changed, reload it
+)
+
+// message is the payload of a notification
+type message struct {
+	Origin string `json:"origin"`           // Instance that sent it
+	Target string `json:"target,omitempty"` // Only instance that handles it (dispatch)
+	Kind   string `json:"kind"`
+	Ref    int64  `json:"ref,omitempty"` // The message is in gateway_messages
+
+	ProjectID string                   `json:"project_id,omitempty"`
+	LogJobID  string                   `json:"log_job_id,omitempty"`
+	Data      json.RawMessage          `json:"data,omitempty"` // Encoded client message
+	Command   *protocol.CommandPayload `json:"command,omitempty"`
+	AgentID   string                   `json:"agent_id,omitempty"`
+	Reason    string                   `json:"reason,omitempty"`
+}
+
+// Relay implements gateway.Relay
+type Relay struct {
+	instanceID string
+	manager    *gateway.Manager
+
+	mu    sync.RWMutex
+	peers map[string]map[string]gateway.ProjectPresence // Other live instances -> ProjectID -> Presence
+
+	outbox   chan message  // Broadcasts and presence changes, published in order
+	announce chan struct{} // Our presence changed
+	reload   chan struct{} // A peer's presence changed
+}
+
+// Start joins the cluster and sets the manager's Relay. The database must be connected.
+func Start(m *gateway.Manager) *Relay {
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+
+	r := &Relay{
+		instanceID: hex.EncodeToString(idBytes),
+		manager:    m,
+		peers:      make(map[string]map[string]gateway.ProjectPresence),
+		outbox:     make(chan message, outboxSize),
+		announce:   make(chan struct{}, 1),
+		reload:     make(chan struct{}, 1),
+	}
+	m.Relay = r
+
+	go r.listenLoop()
+	go r.publishLoop()
+	go r.heartbeatLoop()
+	log.Printf("Gateway instance %s joined the cluster", r.instanceID)
+	return r
+}
+
+// Broadcast implements gateway.Relay. It only publishes if another instance
+// holds clients of the project.
+func (r *Relay) Broadcast(projectID string, data []byte, logJobID string) {
+	if !r.peerHasClients(projectID) {
+		return
+	}
+	r.enqueue(message{Kind: kindBroadcast, ProjectID: projectID, LogJobID: logJobID, Data: data})
+}
+
+// DispatchJob implements gateway.Relay: the job goes to the instance holding
+// the best ranked agent, which picks the agent itself
+func (r *Relay) DispatchJob(projectID string, cmd protocol.CommandPayload) bool {
+	target := ""
+	best := 0
+	r.mu.RLock()
+	for instanceID, projects := range r.peers {
+		for _, agent := range projects[projectID].Agents {
+			if score, ok := gateway.RankAgent(agent, cmd); ok && (target == "" || score < best) {
+				target, best = instanceID, score
+			}
+		}
+	}
+	r.mu.RUnlock()
+	if target == "" {
+		return false
+	}
+
+	err := r.publish(message{Kind: kindDispatch, Target: target, ProjectID: projectID, Command: &cmd})
+	if err != nil {
+		log.Printf("Error handing job %s to instance %s: %v", cmd.JobID, target, err)
+		return false
+	}
+	log.Printf("Job %s of Project %s handed to instance %s", cmd.JobID, projectID, target)
+	return true
+}
+
+// DisconnectAgent implements gateway.Relay. Unlike broadcasts it is never
+// dropped: an agent left connected would keep using a revoked token.
+func (r *Relay) DisconnectAgent(agentID string, reason string) error {
+	return r.publishRetry(message{Kind: kindDisconnect, AgentID: agentID, Reason: reason})
+}
+
+// AgentStatus implements gateway.Relay
+func (r *Relay) AgentStatus(agentID string) (gateway.AgentStatus, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, projects := range r.peers {
+		for _, p := range projects {
+			for _, a := range p.Agents {
+				if a.AgentID == agentID {
+					return gateway.AgentStatus{Online: true, Labels: a.Labels, ActiveJobs: a.ActiveJobs}, true
+				}
+			}
+		}
+	}
+	return gateway.AgentStatus{}, false
+}
+
+// PresenceChanged implements gateway.Relay
+func (r *Relay) PresenceChanged() {
+	select {
+	case r.announce <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Relay) peerHasClients(projectID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, projects := range r.peers {
+		if projects[projectID].Clients > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue publishes a message without blocking the caller (e.g. an agent's read loop)
+func (r *Relay) enqueue(msg message) {
+	select {
+	case r.outbox <- msg:
+	default:
+		log.Printf("Cluster outbox full, dropping %s message", msg.Kind)
+	}
+}
+
+func (r *Relay) publishLoop() {
+	for msg := range r.outbox {
+		if err := r.publish(msg); err != nil {
+			log.Printf("Error publishing %s message: %v", msg.Kind, err)
+		}
+	}
+}
+
+// publishRetry publishes a message, trying again after a failure
+func (r *Relay) publishRetry(msg message) error {
+	for attempt := 1; ; attempt++ {
+		err := r.publish(msg)
+		if err == nil || attempt == publishAttempts {
+			return err
+		}
+		log.Printf("Error publishing %s message (attempt %d of %d): %v", msg.Kind, attempt, publishAttempts, err)
+		time.Sleep(time.Duration(attempt) * publishBackoff)
+	}
+}
+
+func (r *Relay) publish(msg message) error {
+	msg.Origin = r.instanceID
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > maxNotifyPayload {
+		// Secrets are never written to the database
+		if msg.Command != nil && len(msg.Command.Secrets) > 0 {
+			return fmt.Errorf("command with secrets too large to relay (%d bytes)", len(data))
+		}
+		if err := db.Pool.QueryRow(context.Background(),
+			"INSERT INTO gateway_messages (payload) VALUES ($1) RETURNING id", string(data)).Scan(&msg.Ref); err != nil {
+			return err
+		}
+		data, _ = json.Marshal(message{Origin: r.instanceID, Target: msg.Target, Kind: msg.Kind, Ref: msg.Ref})
+	}
+
+	_, err = db.Pool.Exec(context.Background(), "SELECT pg_notify($1, $2)", channel, string(data))
+	return err
+}
+
+func (r *Relay) listenLoop() {
+	for {
+		err := r.listen()
+		log.Printf("Cluster listener stopped: %v (reconnecting)", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (r *Relay) listen() error {
+	ctx := context.Background()
+	pooled, err := db.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// A listening connection must not go back to the pool
+	conn := pooled.Hijack()
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+		return err
+	}
+	// Whatever was published while we weren't listening is lost; catch up on presence
+	r.triggerReload()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		r.handle(notification)
+	}
+}
+
+func (r *Relay) handle(notification *pgconn.Notification) {
+	var msg message
+	if err := json.Unmarshal([]byte(notification.Payload), &msg); err != nil {
+		log.Printf("Dropping malformed cluster message: %v", err)
+		return
+	}
+	if msg.Origin == r.instanceID || (msg.Target != "" && msg.Target != r.instanceID) {
+		return
+	}
+	if msg.Ref != 0 {
+		var payload string
+		if err := db.Pool.QueryRow(context.Background(),
+			"SELECT payload FROM gateway_messages WHERE id = $1", msg.Ref).Scan(&payload); err != nil {
+			log.Printf("Error loading cluster message %d: %v", msg.Ref, err)
+			return
+		}
+		if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+			log.Printf("Dropping malformed cluster message %d: %v", msg.Ref, err)
+			return
+		}
+	}
+
+	switch msg.Kind {
+	case kindBroadcast:
+		r.manager.DeliverLocal(msg.ProjectID, msg.Data, msg.LogJobID)
+
+	case kindDispatch:
+		if msg.Command == nil {
+			return
+		}
+		// Sending may wait for a slow agent; keep reading notifications
+		go func(projectID string, cmd protocol.CommandPayload) {
+			if !r.manager.DispatchLocal(projectID, cmd) {
+				r.manager.Unassigned(projectID, cmd, "the agent left instance "+r.instanceID)
+			}
+		}(msg.ProjectID, *msg.Command)
+
+	case kindDisconnect:
+		r.manager.DisconnectLocalAgent(msg.AgentID, msg.Reason)
+
+	case kindPresence:
+		r.triggerReload()
+	}
+}
+
+func (r *Relay) triggerReload() {
+	select {
+	case r.reload <- struct{}{}:
+	default:
+	}
+}
+
+// heartbeatLoop keeps our presence rows alive and the view of the peers fresh
+func (r *Relay) heartbeatLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	r.writePresence()
+	r.loadPeers()
+	for {
+		select {
+		case <-ticker.C:
+			r.writePresence()
+			r.cleanup()
+			r.loadPeers()
+		case <-r.announce:
+			r.writePresence()
+			r.enqueue(message{Kind: kindPresence})
+		case <-r.reload:
+			r.loadPeers()
+		}
+	}
+}
+
+// writePresence replaces this instance's rows in gateway_presence
+func (r *Relay) writePresence() {
+	ctx := context.Background()
+	presence := r.manager.Presence()
+	expiresAt := time.Now().Add(presenceTTL)
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		log.Printf("Error writing gateway presence: %v", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM gateway_presence WHERE instance_id = $1", r.instanceID); err != nil {
+		log.Printf("Error writing gateway presence: %v", err)
+		return
+	}
+	for projectID, p := range presence {
+		agents, _ := json.Marshal(p.Agents)
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO gateway_presence (instance_id, project_id, agents, clients, expires_at) VALUES ($1, $2, $3, $4, $5)",
+			r.instanceID, projectID, string(agents), p.Clients, expiresAt); err != nil {
+			log.Printf("Error writing gateway presence: %v", err)
+			return
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Printf("Error writing gateway presence: %v", err)
+	}
+}
+
+// loadPeers reads the live presence of the other instances
+func (r *Relay) loadPeers() {
+	rows, err := db.Pool.Query(context.Background(),
+		"SELECT instance_id, project_id, agents, clients FROM gateway_presence WHERE instance_id <> $1 AND expires_at > NOW()",
+		r.instanceID)
+	if err != nil {
+		log.Printf("Error reading gateway presence: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	peers := make(map[string]map[string]gateway.ProjectPresence)
+	for rows.Next() {
+		var instanceID, projectID, agents string
+		var p gateway.ProjectPresence
+		if err := rows.Scan(&instanceID, &projectID, &agents, &p.Clients); err != nil {
+			log.Printf("Error reading gateway presence: %v", err)
+			return
+		}
+		json.Unmarshal([]byte(agents), &p.Agents)
+		if peers[instanceID] == nil {
+			peers[instanceID] = make(map[string]gateway.ProjectPresence)
+		}
+		peers[instanceID][projectID] = p
+	}
+	if rows.Err() != nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.peers = peers
+	r.mu.Unlock()
+}
+
+// cleanup deletes expired presence of crashed instances and relayed messages
+// everyone has read
+func (r *Relay) cleanup() {
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, "DELETE FROM gateway_presence WHERE expires_at < NOW()"); err != nil {
+		log.Printf("Error cleaning up gateway presence: %v", err)
+	}
+	if _, err := db.Pool.Exec(ctx,
+		"DELETE FROM gateway_messages WHERE created_at < NOW() - make_interval(secs => $1)", messageTTL.Seconds()); err != nil {
+		log.Printf("Error cleaning up gateway messages: %v", err)
+	}
+}
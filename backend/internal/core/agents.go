@@ -0,0 +1,192 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rohaaaaaan/devair-backend/internal/db"
+	"github.com/rohaaaaaan/devair-backend/internal/gateway"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+)
+
+// Agent tokens look like dva_<agent id>_<secret>. The ID finds the row, the
+// secret is compared against its stored hash.
+const agentTokenPrefix = "dva_"
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+var (
+	ErrAgentNotFound = errors.New("agent not found")
+	// Deliberately vague: callers must not learn whether the agent exists
+	errInvalidAgentToken = errors.New("invalid agent token")
+)
+
+const agentColumns = "id, project_id, COALESCE(name, ''), status, last_seen_at, token_rotated_at, revoked_at, created_at"
+
+func scanAgent(row pgx.Row) (models.Agent, error) {
+	var a models.Agent
+	err := row.Scan(&a.ID, &a.ProjectID, &a.Name, &a.Status, &a.LastSeenAt, &a.TokenRotatedAt, &a.RevokedAt, &a.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = ErrAgentNotFound
+	}
+	return a, err
+}
+
+func formatAgentToken(agentID, secret string) string {
+	return agentTokenPrefix + agentID + "_" + secret
+}
+
+func parseAgentToken(token string) (agentID string, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(token, agentTokenPrefix)
+	if !ok {
+		return "", "", false
+	}
+	agentID, secret, ok = strings.Cut(rest, "_")
+	return agentID, secret, ok && uuidRegex.MatchString(agentID) && secret != ""
+}
+
+// CreateAgent registers an agent for a project and returns its token
+func (s *Service) CreateAgent(projectID string, name string) (models.AgentToken, error) {
+	if db.Pool == nil {
+		return models.AgentToken{}, fmt.Errorf("database not connected")
+	}
+
+	secret, hash := newSecret()
+	agent, err := scanAgent(db.Pool.QueryRow(context.Background(),
+		"INSERT INTO agents (project_id, name, token_hash) VALUES ($1, NULLIF($2, ''), $3) RETURNING "+agentColumns,
+		projectID, name, hash))
+	if err != nil {
+		return models.AgentToken{}, err
+	}
+	return models.AgentToken{Agent: agent, Token: formatAgentToken(agent.ID, secret)}, nil
+}
+
+// GetAgents returns the agents of a project, including revoked ones. Status,
+// labels and load come from the live connection.
+func (s *Service) GetAgents(projectID string) ([]models.Agent, error) {
+	if db.Pool == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		"SELECT "+agentColumns+" FROM agents WHERE project_id = $1 ORDER BY created_at", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	agents := []models.Agent{}
+	for rows.Next() {
+		a, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		live := gateway.GlobalManager.AgentStatus(a.ID)
+		a.Status = "OFFLINE"
+		if live.Online {
+			a.Status = "ONLINE"
+		}
+		a.Labels = live.Labels
+		a.ActiveJobs = live.ActiveJobs
+		agents = append(agents, a)
+	}
+	return agents, rows.Err()
+}
+
+// RotateAgentToken replaces the token of an agent. The old token stops working
+// at once and an agent connected with it is disconnected.
+func (s *Service) RotateAgentToken(agentID string) (models.AgentToken, error) {
+	if db.Pool == nil {
+		return models.AgentToken{}, fmt.Errorf("database not connected")
+	}
+	if !uuidRegex.MatchString(agentID) {
+		return models.AgentToken{}, ErrAgentNotFound
+	}
+
+	secret, hash := newSecret()
+	agent, err := scanAgent(db.Pool.QueryRow(context.Background(),
+		"UPDATE agents SET token_hash = $2, token_rotated_at = NOW() WHERE id = $1 AND revoked_at IS NULL RETURNING "+agentColumns,
+		agentID, hash))
+	if err != nil {
+		return models.AgentToken{}, err
+	}
+
+	if err := gateway.GlobalManager.DisconnectAgent(agentID, "agent token was rotated"); err != nil {
+		return models.AgentToken{}, fmt.Errorf("token rotated, but the agent may still be connected to another instance (rotate again): %w", err)
+	}
+	return models.AgentToken{Agent: agent, Token: formatAgentToken(agent.ID, secret)}, nil
+}
+
+// RevokeAgent permanently invalidates the token of an agent and disconnects it.
+// The row is kept for the history of the project.
+func (s *Service) RevokeAgent(agentID string) (models.Agent, error) {
+	if db.Pool == nil {
+		return models.Agent{}, fmt.Errorf("database not connected")
+	}
+	if !uuidRegex.MatchString(agentID) {
+		return models.Agent{}, ErrAgentNotFound
+	}
+
+	agent, err := scanAgent(db.Pool.QueryRow(context.Background(),
+		"UPDATE agents SET token_hash = NULL, revoked_at = COALESCE(revoked_at, NOW()) WHERE id = $1 RETURNING "+agentColumns,
+		agentID))
+	if err != nil {
+		return models.Agent{}, err
+	}
+
+	if err := gateway.GlobalManager.DisconnectAgent(agentID, "agent token was revoked"); err != nil {
+		return models.Agent{}, fmt.Errorf("token revoked, but the agent may still be connected to another instance (revoke again): %w", err)
+	}
+	return agent, nil
+}
+
+// GetAgentByToken returns the agent a token belongs to, unless it is revoked
+func (s *Service) GetAgentByToken(token string) (models.Agent, error) {
+	if db.Pool == nil {
+		return models.Agent{}, fmt.Errorf("database not connected")
+	}
+
+	agentID, secret, ok := parseAgentToken(token)
+	if !ok {
+		return models.Agent{}, errInvalidAgentToken
+	}
+
+	var a models.Agent
+	var storedHash string
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT "+agentColumns+", COALESCE(token_hash, '') FROM agents WHERE id = $1 AND revoked_at IS NULL", agentID).
+		Scan(&a.ID, &a.ProjectID, &a.Name, &a.Status, &a.LastSeenAt, &a.TokenRotatedAt, &a.RevokedAt, &a.CreatedAt, &storedHash)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		fmt.Printf("Error looking up agent %s: %v\n", agentID, err)
+	}
+
+	// Compare even when there is no row, so timing doesn't reveal which agents exist
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(storedHash)) != 1 || err != nil {
+		return models.Agent{}, errInvalidAgentToken
+	}
+	return a, nil
+}
+
+// AuthenticateAgent checks the token an agent sent in IDENTIFY and returns the
+// agent's ID. The token must belong to the project the agent connects to.
+func (s *Service) AuthenticateAgent(projectID string, token string) (string, error) {
+	agent, err := s.GetAgentByToken(token)
+	if err != nil {
+		return "", err
+	}
+	if agent.ProjectID != projectID {
+		return "", errInvalidAgentToken
+	}
+
+	if _, err := db.Pool.Exec(context.Background(),
+		"UPDATE agents SET last_seen_at = $2 WHERE id = $1", agent.ID, time.Now()); err != nil {
+		fmt.Printf("Error updating agent %s: %v\n", agent.ID, err)
+	}
+	return agent.ID, nil
+}
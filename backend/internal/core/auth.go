@@ -0,0 +1,172 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rohaaaaaan/devair-backend/internal/db"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionTTL        = 30 * 24 * time.Hour
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores everything after 72 bytes
+)
+
+var (
+	ErrInvalidEmail       = errors.New("invalid email address")
+	ErrInvalidPassword    = fmt.Errorf("password must be %d to %d characters long", minPasswordLength, maxPasswordLength)
+	ErrEmailTaken         = errors.New("email is already registered")
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrInvalidSession     = errors.New("invalid or expired session")
+)
+
+// Compared against when the email is unknown, so both cases take as long
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// newSecret returns a random token secret and the hash stored for it. Secrets
+// are 256 random bits, so a plain SHA-256 is enough (no password hashing).
+func newSecret() (string, string) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	secret := hex.EncodeToString(b)
+	return secret, hashSecret(secret)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Register creates a user with an email and password
+func (s *Service) Register(email string, password string) (models.User, error) {
+	if db.Pool == nil {
+		return models.User{}, fmt.Errorf("database not connected")
+	}
+
+	email = normalizeEmail(email)
+	if at := strings.Index(email, "@"); at <= 0 || at == len(email)-1 {
+		return models.User{}, ErrInvalidEmail
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return models.User{}, ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	var u models.User
+	err = db.Pool.QueryRow(context.Background(),
+		"INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id, email, created_at",
+		email, string(hash)).Scan(&u.ID, &u.Email, &u.CreatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
+		return models.User{}, ErrEmailTaken
+	}
+	return u, err
+}
+
+// Login checks a user's password and starts a session
+func (s *Service) Login(email string, password string) (models.Session, error) {
+	if db.Pool == nil {
+		return models.Session{}, fmt.Errorf("database not connected")
+	}
+
+	var u models.User
+	var passwordHash string
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT id, email, created_at, COALESCE(password_hash, '') FROM users WHERE email = $1",
+		normalizeEmail(email)).Scan(&u.ID, &u.Email, &u.CreatedAt, &passwordHash)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return models.Session{}, err
+	}
+	if err != nil || passwordHash == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return models.Session{}, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) != nil {
+		return models.Session{}, ErrInvalidCredentials
+	}
+
+	token, hash := newSecret()
+	expiresAt := time.Now().Add(sessionTTL)
+	if _, err := db.Pool.Exec(context.Background(),
+		"INSERT INTO sessions (user_id, token_hash, expires_at) VALUES ($1, $2, $3)", u.ID, hash, expiresAt); err != nil {
+		return models.Session{}, err
+	}
+	// Housekeeping: this user's expired sessions
+	db.Pool.Exec(context.Background(), "DELETE FROM sessions WHERE user_id = $1 AND expires_at <= NOW()", u.ID)
+
+	return models.Session{Token: token, ExpiresAt: expiresAt, User: u}, nil
+}
+
+// Logout ends the session of a token
+func (s *Service) Logout(token string) error {
+	if db.Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+	_, err := db.Pool.Exec(context.Background(), "DELETE FROM sessions WHERE token_hash = $1", hashSecret(token))
+	return err
+}
+
+// AuthenticateUser returns the user of a session token
+func (s *Service) AuthenticateUser(token string) (models.User, error) {
+	if db.Pool == nil {
+		return models.User{}, fmt.Errorf("database not connected")
+	}
+	if token == "" {
+		return models.User{}, ErrInvalidSession
+	}
+
+	// Looked up by hash: timing can't reveal anything about valid tokens
+	var u models.User
+	var sessionID string
+	err := db.Pool.QueryRow(context.Background(), `
+		SELECT s.id, u.id, u.email, u.created_at
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = $1 AND s.expires_at > NOW()`,
+		hashSecret(token)).Scan(&sessionID, &u.ID, &u.Email, &u.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.User{}, ErrInvalidSession
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+
+	db.Pool.Exec(context.Background(), "UPDATE sessions SET last_used_at = NOW() WHERE id = $1", sessionID)
+	return u, nil
+}
+
+// AuthenticateClient checks the session token a browser sent in IDENTIFY and
+// returns the user's ID. The user must be a member of the project.
+func (s *Service) AuthenticateClient(projectID string, token string) (string, error) {
+	u, err := s.AuthenticateUser(token)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Authorize(projectID, u.ID, RoleViewer); err != nil {
+		return "", err
+	}
+	return u.ID, nil
+}
+
+// AuthorizeCommand checks that a client's user may start jobs in the project
+func (s *Service) AuthorizeCommand(projectID string, userID string) error {
+	return s.Authorize(projectID, userID, RoleOperator)
+}
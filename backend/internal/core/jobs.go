@@ -0,0 +1,141 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rohaaaaaan/devair-backend/internal/db"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// jobTransitions lists the statuses a job may move to from each status.
+// QUEUED may end without RUNNING (e.g. an unknown app, a cache hit, expiry);
+// finished jobs never change again.
+var jobTransitions = map[string][]string{
+	protocol.JobStatusQueued: {
+		protocol.JobStatusRunning, protocol.JobStatusCompleted, protocol.JobStatusFailed, protocol.JobStatusCancelled,
+	},
+	protocol.JobStatusRunning: {
+		protocol.JobStatusCompleted, protocol.JobStatusFailed, protocol.JobStatusCancelled,
+	},
+}
+
+// jobResult is what jobs.result holds for a finished job
+type jobResult struct {
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Cached bool   `json:"cached,omitempty"`
+}
+
+func (r jobResult) String() string {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+// previousJobStatuses returns the statuses a job can be in to move to status
+func previousJobStatuses(status string) []string {
+	var from []string
+	for prev, next := range jobTransitions {
+		for _, s := range next {
+			if s == status {
+				from = append(from, prev)
+			}
+		}
+	}
+	return from
+}
+
+// ApplyJobUpdate stores a status change of a job reported by an agent. It
+// returns false if the change is not a legal transition, so the gateway drops
+// it instead of pushing it to clients.
+func (s *Service) ApplyJobUpdate(projectID string, update *protocol.JobUpdatePayload) bool {
+	if db.Pool == nil {
+		return true // Nothing to check against
+	}
+
+	if !uuidRegex.MatchString(update.JobID) {
+		fmt.Printf("Rejected update of job %q: not a job ID\n", update.JobID)
+		return false
+	}
+	from := previousJobStatuses(update.Status)
+	if len(from) == 0 {
+		fmt.Printf("Rejected update of job %s: unknown status %q\n", update.JobID, update.Status)
+		return false
+	}
+
+	var query string
+	var args []interface{}
+	if update.Status == protocol.JobStatusRunning {
+		query = `UPDATE jobs SET status = $3, started_at = COALESCE(started_at, NOW())
+			WHERE id = $1 AND project_id = $2 AND status = ANY($4) RETURNING id`
+		args = []interface{}{update.JobID, projectID, update.Status, from}
+	} else {
+		result := jobResult{Result: update.Result, Error: update.Error, Cached: update.Cached}
+		query = `UPDATE jobs SET status = $3, result = $5, completed_at = NOW()
+			WHERE id = $1 AND project_id = $2 AND status = ANY($4) RETURNING id`
+		args = []interface{}{update.JobID, projectID, update.Status, from, result.String()}
+	}
+
+	var jobID string
+	err := db.Pool.QueryRow(context.Background(), query, args...).Scan(&jobID)
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		// Keep the update flowing to clients; only the history is affected
+		fmt.Printf("Error updating job %s: %v\n", update.JobID, err)
+		return true
+	}
+
+	var current string
+	err = db.Pool.QueryRow(context.Background(),
+		"SELECT status FROM jobs WHERE id = $1 AND project_id = $2", update.JobID, projectID).Scan(&current)
+	if err != nil {
+		fmt.Printf("Rejected update of job %s to %s: no such job in Project %s\n", update.JobID, update.Status, projectID)
+	} else {
+		fmt.Printf("Rejected update of job %s: illegal transition %s -> %s\n", update.JobID, current, update.Status)
+	}
+	return false
+}
+
+// GetJob returns a job by ID
+func (s *Service) GetJob(jobID string) (models.Job, error) {
+	if db.Pool == nil {
+		return models.Job{}, fmt.Errorf("database not connected")
+	}
+	if !uuidRegex.MatchString(jobID) {
+		return models.Job{}, ErrJobNotFound
+	}
+	var job models.Job
+	err := db.Pool.QueryRow(context.Background(), `
+		SELECT id, project_id, type, status, COALESCE(result, ''), COALESCE(trigger_source, 'manual'), created_at
+		FROM jobs WHERE id = $1`, jobID).Scan(
+		&job.ID, &job.ProjectID, &job.Type, &job.Status, &job.Result, &job.TriggerSource, &job.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Job{}, ErrJobNotFound
+	}
+	return job, err
+}
+
+// FinalJobUpdate returns the last JOB_UPDATE of a finished job, or nil if the
+// job hasn't finished
+func FinalJobUpdate(job models.Job) *protocol.JobUpdatePayload {
+	switch job.Status {
+	case protocol.JobStatusCompleted, protocol.JobStatusFailed, protocol.JobStatusCancelled:
+	default:
+		return nil
+	}
+	var result jobResult
+	json.Unmarshal([]byte(job.Result), &result)
+	return &protocol.JobUpdatePayload{
+		JobID:  job.ID,
+		Status: job.Status,
+		Result: result.Result,
+		Error:  result.Error,
+		Cached: result.Cached,
+	}
+}
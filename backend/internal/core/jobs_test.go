@@ -0,0 +1,47 @@
+package core
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+func TestPreviousJobStatuses(t *testing.T) {
+	tests := []struct {
+		status string
+		want   []string
+	}{
+		{protocol.JobStatusRunning, []string{protocol.JobStatusQueued}},
+		{protocol.JobStatusCompleted, []string{protocol.JobStatusQueued, protocol.JobStatusRunning}},
+		{protocol.JobStatusFailed, []string{protocol.JobStatusQueued, protocol.JobStatusRunning}},
+		{protocol.JobStatusCancelled, []string{protocol.JobStatusQueued, protocol.JobStatusRunning}},
+		// Nothing moves back to QUEUED, and unknown statuses are never reached
+		{protocol.JobStatusQueued, nil},
+		{"PAUSED", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got := previousJobStatuses(tt.status)
+		sort.Strings(got)
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: previousJobStatuses = %q, want %q", tt.status, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q: previousJobStatuses = %q, want %q", tt.status, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestJobTransitionsFinal(t *testing.T) {
+	// Finished jobs never change again
+	for _, status := range []string{protocol.JobStatusCompleted, protocol.JobStatusFailed, protocol.JobStatusCancelled} {
+		if next := jobTransitions[status]; len(next) > 0 {
+			t.Errorf("%s: may move to %q, want no transitions", status, next)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Triggering jobs is limited by token buckets per user and per project, a cap on
+// the active (QUEUED or RUNNING) jobs of a project and a daily quota per project.
+// Buckets live in memory: each backend instance enforces its own rates.
+
+// How long a client should wait when a project has too many active jobs
+const activeJobsRetryAfter = 30 * time.Second
+
+// Rate allows Count triggers per Per, in bursts of up to Count. The zero Rate is unlimited.
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+// ParseRate parses "<count>/<duration>", e.g. "30/1m"; "0" is unlimited
+func ParseRate(s string) (Rate, error) {
+	if s == "0" {
+		return Rate{}, nil
+	}
+	count, per, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, want <count>/<duration> like 30/1m", s)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, want <count>/<duration> like 30/1m", s)
+	}
+	return Rate{Count: n, Per: d}, nil
+}
+
+// Limits of job triggering; zero values are unlimited
+type Limits struct {
+	UserRate      Rate
+	ProjectRate   Rate
+	MaxActiveJobs int // QUEUED or RUNNING jobs per project
+	DailyJobs     int // Jobs triggered per project per UTC day
+}
+
+// LimitError is returned when a trigger is over a limit
+type LimitError struct {
+	Reason string
+	Retry  time.Duration
+}
+
+func (e *LimitError) Error() string { return e.Reason }
+
+// RetryAfter is when the trigger may succeed, for the Retry-After header
+func (e *LimitError) RetryAfter() time.Duration { return e.Retry }
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type limiter struct {
+	mu        sync.Mutex
+	limits    Limits
+	buckets   map[string]*bucket // "user:<id>" / "project:<id>" -> Bucket
+	lastSweep time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{buckets: make(map[string]*bucket)}
+}
+
+// refill returns the bucket of key with the tokens it has now. Called with mu held.
+func (l *limiter) refill(key string, rate Rate, now time.Time) *bucket {
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(rate.Count), updated: now}
+		l.buckets[key] = b
+	}
+	perToken := rate.Per.Seconds() / float64(rate.Count)
+	b.tokens = math.Min(float64(rate.Count), b.tokens+now.Sub(b.updated).Seconds()/perToken)
+	b.updated = now
+	return b
+}
+
+// wait returns how long until the bucket has a token. Called with mu held.
+func wait(b *bucket, rate Rate) time.Duration {
+	perToken := rate.Per.Seconds() / float64(rate.Count)
+	return time.Duration((1 - b.tokens) * perToken * float64(time.Second))
+}
+
+// take takes a token from the user's and the project's bucket, or from neither
+func (l *limiter) take(projectID string, userID string) error {
+	return l.takeAt(projectID, userID, time.Now())
+}
+
+func (l *limiter) takeAt(projectID string, userID string, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	var userBucket, projectBucket *bucket
+	if l.limits.UserRate.Count > 0 && userID != "" {
+		userBucket = l.refill("user:"+userID, l.limits.UserRate, now)
+		if userBucket.tokens < 1 {
+			return &LimitError{
+				Reason: fmt.Sprintf("too many jobs triggered, at most %d per %s per user", l.limits.UserRate.Count, l.limits.UserRate.Per),
+				Retry:  wait(userBucket, l.limits.UserRate),
+			}
+		}
+	}
+	if l.limits.ProjectRate.Count > 0 {
+		projectBucket = l.refill("project:"+projectID, l.limits.ProjectRate, now)
+		if projectBucket.tokens < 1 {
+			return &LimitError{
+				Reason: fmt.Sprintf("too many jobs triggered, at most %d per %s per project", l.limits.ProjectRate.Count, l.limits.ProjectRate.Per),
+				Retry:  wait(projectBucket, l.limits.ProjectRate),
+			}
+		}
+	}
+	if userBucket != nil {
+		userBucket.tokens--
+	}
+	if projectBucket != nil {
+		projectBucket.tokens--
+	}
+	return nil
+}
+
+// giveBack returns the tokens take took, e.g. when the trigger failed
+func (l *limiter) giveBack(projectID string, userID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.limits.UserRate.Count > 0 && userID != "" {
+		b := l.refill("user:"+userID, l.limits.UserRate, now)
+		b.tokens = math.Min(float64(l.limits.UserRate.Count), b.tokens+1)
+	}
+	if l.limits.ProjectRate.Count > 0 {
+		b := l.refill("project:"+projectID, l.limits.ProjectRate, now)
+		b.tokens = math.Min(float64(l.limits.ProjectRate.Count), b.tokens+1)
+	}
+}
+
+// sweep drops buckets that have refilled, once a minute. Called with mu held.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		rate := l.limits.ProjectRate
+		if strings.HasPrefix(key, "user:") {
+			rate = l.limits.UserRate
+		}
+		if rate.Count == 0 || now.Sub(b.updated) >= rate.Per {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// SetLimits sets the limits of job triggering
+func (s *Service) SetLimits(limits Limits) {
+	s.limits.mu.Lock()
+	s.limits.limits = limits
+	s.limits.buckets = make(map[string]*bucket)
+	s.limits.mu.Unlock()
+}
+
+// CheckTrigger returns a *LimitError if the user may not trigger a job in the
+// project now, and otherwise counts the trigger against the rates. A trigger
+// that creates no job should be given back with RefundTrigger. userID is empty
+// if clients are not authenticated. The caps on active and daily jobs are
+// checked when the job is created (see checkJobCaps).
+func (s *Service) CheckTrigger(projectID string, userID string) error {
+	return s.limits.take(projectID, userID)
+}
+
+// RefundTrigger gives back the rate tokens of a trigger that created no job
+func (s *Service) RefundTrigger(projectID string, userID string) {
+	s.limits.giveBack(projectID, userID)
+}
+
+// checkJobCaps returns a *LimitError if the project is at its cap of active
+// jobs or its daily quota. It locks the project's job count until tx ends, so
+// concurrent triggers can't all pass on the same count: the job must be
+// inserted in tx.
+func (s *Service) checkJobCaps(ctx context.Context, tx pgx.Tx, projectID string) error {
+	s.limits.mu.Lock()
+	limits := s.limits.limits
+	s.limits.mu.Unlock()
+	if limits.MaxActiveJobs == 0 && limits.DailyJobs == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", projectID); err != nil {
+		return err
+	}
+	var active, today int
+	err := tx.QueryRow(ctx, `
+		SELECT
+			COUNT(*) FILTER (WHERE status IN ('QUEUED', 'RUNNING')),
+			COUNT(*) FILTER (WHERE trigger_source = 'manual' AND created_at >= date_trunc('day', NOW() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC')
+		FROM jobs WHERE project_id = $1`, projectID).Scan(&active, &today)
+	if err != nil {
+		return err
+	}
+	if limits.MaxActiveJobs > 0 && active >= limits.MaxActiveJobs {
+		return &LimitError{
+			Reason: fmt.Sprintf("the project already has %d queued or running jobs", active),
+			Retry:  activeJobsRetryAfter,
+		}
+	}
+	if limits.DailyJobs > 0 && today >= limits.DailyJobs {
+		now := time.Now().UTC()
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return &LimitError{
+			Reason: fmt.Sprintf("the project used its quota of %d jobs today", limits.DailyJobs),
+			Retry:  tomorrow.Sub(now),
+		}
+	}
+	return nil
+}
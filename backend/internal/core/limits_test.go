@@ -0,0 +1,121 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterTake(t *testing.T) {
+	type trigger struct {
+		projectID string
+		userID    string
+		after     time.Duration // Since the previous trigger
+		limited   bool
+	}
+	tests := []struct {
+		name     string
+		limits   Limits
+		triggers []trigger
+	}{
+		{
+			name:   "unlimited",
+			limits: Limits{},
+			triggers: []trigger{
+				{"p", "u", 0, false}, {"p", "u", 0, false}, {"p", "u", 0, false},
+			},
+		},
+		{
+			name:   "user burst then refill",
+			limits: Limits{UserRate: Rate{Count: 2, Per: time.Minute}},
+			triggers: []trigger{
+				{"p", "u", 0, false}, {"p", "u", 0, false}, {"p", "u", 0, true},
+				{"p", "other", 0, false}, // Buckets are per user
+				{"p", "u", 30 * time.Second, false},
+				{"p", "u", 0, true},
+			},
+		},
+		{
+			name:   "no user bucket without authentication",
+			limits: Limits{UserRate: Rate{Count: 1, Per: time.Minute}},
+			triggers: []trigger{
+				{"p", "", 0, false}, {"p", "", 0, false},
+			},
+		},
+		{
+			name:   "project rate across users",
+			limits: Limits{ProjectRate: Rate{Count: 2, Per: time.Minute}},
+			triggers: []trigger{
+				{"p", "a", 0, false}, {"p", "b", 0, false}, {"p", "c", 0, true},
+				{"q", "a", 0, false},
+			},
+		},
+		{
+			name:   "a rejected trigger takes no token",
+			limits: Limits{UserRate: Rate{Count: 5, Per: time.Minute}, ProjectRate: Rate{Count: 1, Per: time.Minute}},
+			triggers: []trigger{
+				{"p", "u", 0, false}, {"p", "u", 0, true}, {"p", "u", 0, true},
+				// The user still has 4 tokens for another project
+				{"q", "u", 0, false}, {"r", "u", 0, false}, {"s", "u", 0, false}, {"t", "u", 0, false},
+				{"v", "u", 0, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		l := newLimiter()
+		l.limits = tt.limits
+		now := time.Now()
+		for i, tr := range tt.triggers {
+			now = now.Add(tr.after)
+			err := l.takeAt(tr.projectID, tr.userID, now)
+			var limited *LimitError
+			if tr.limited != errors.As(err, &limited) {
+				t.Errorf("%s: trigger %d: err = %v, want limited %v", tt.name, i, err, tr.limited)
+			}
+			if limited != nil && limited.RetryAfter() <= 0 {
+				t.Errorf("%s: trigger %d: Retry-After %s, want > 0", tt.name, i, limited.RetryAfter())
+			}
+		}
+	}
+}
+
+func TestLimiterGiveBack(t *testing.T) {
+	l := newLimiter()
+	l.limits = Limits{UserRate: Rate{Count: 1, Per: time.Hour}, ProjectRate: Rate{Count: 1, Per: time.Hour}}
+	if err := l.take("p", "u"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.take("p", "u"); err == nil {
+		t.Error("second trigger: expected a LimitError")
+	}
+	l.giveBack("p", "u")
+	l.giveBack("p", "u") // Never more than Count
+	if err := l.take("p", "u"); err != nil {
+		t.Errorf("after giving back: %v", err)
+	}
+	if err := l.take("p", "u"); err == nil {
+		t.Error("after taking the returned token: expected a LimitError")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rate
+		ok   bool
+	}{
+		{"30/1m", Rate{Count: 30, Per: time.Minute}, true},
+		{"5/10s", Rate{Count: 5, Per: 10 * time.Second}, true},
+		{"0", Rate{}, true},
+		{"30", Rate{}, false},
+		{"0/1m", Rate{}, false},
+		{"30/0s", Rate{}, false},
+		{"x/1m", Rate{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseRate(%q) = %v, %v, want %v (ok %v)", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rohaaaaaan/devair-backend/internal/db"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// Replayed logs are sent in LOG_CHUNKs of up to this many bytes
+const maxReplayChunk = 64 * 1024
+
+var ErrJobNotFound = errors.New("job not found")
+
+// logStore hands out the byte offset of each chunk of a running job's log
+type logStore struct {
+	mu   sync.Mutex
+	next map[string]int64 // JobID -> Length of the log so far
+}
+
+func newLogStore() *logStore {
+	return &logStore{next: make(map[string]int64)}
+}
+
+// forget drops a finished job; a late chunk finds its offset in the database again
+func (l *logStore) forget(jobID string) {
+	l.mu.Lock()
+	delete(l.next, jobID)
+	l.mu.Unlock()
+}
+
+// AppendLog stores a LOG_CHUNK of a job of the project and sets its Offset.
+// The gateway calls it before the chunk is pushed to clients.
+func (s *Service) AppendLog(projectID string, chunk *protocol.LogChunkPayload) {
+	if db.Pool == nil || !uuidRegex.MatchString(chunk.JobID) {
+		return
+	}
+	// Postgres text can't hold NUL or invalid UTF-8; clients get the same cleaned chunk
+	chunk.Chunk = strings.ToValidUTF8(strings.ReplaceAll(chunk.Chunk, "\x00", ""), "\uFFFD")
+	if chunk.Chunk == "" {
+		return
+	}
+
+	s.logs.mu.Lock()
+	offset, ok := s.logs.next[chunk.JobID]
+	if !ok {
+		// First chunk since the backend started
+		err := db.Pool.QueryRow(context.Background(),
+			"SELECT COALESCE(MAX(byte_offset + octet_length(chunk)), 0) FROM job_logs WHERE job_id = $1",
+			chunk.JobID).Scan(&offset)
+		if err != nil {
+			fmt.Printf("Error reading log length of job %s: %v\n", chunk.JobID, err)
+		}
+	}
+	s.logs.next[chunk.JobID] = offset + int64(len(chunk.Chunk))
+	s.logs.mu.Unlock()
+	chunk.Offset = &offset
+
+	// Only into jobs of the agent's own project
+	_, err := db.Pool.Exec(context.Background(), `
+		INSERT INTO job_logs (job_id, byte_offset, chunk)
+		SELECT $1, $2, $3 WHERE EXISTS (SELECT 1 FROM jobs WHERE id = $1 AND project_id = $4)`,
+		chunk.JobID, offset, chunk.Chunk, projectID)
+	if err != nil {
+		fmt.Printf("Error storing log of job %s: %v\n", chunk.JobID, err)
+	}
+}
+
+// jobLogRows returns the stored chunks of a job that end after offset, in order.
+// With limit > 0, only chunks starting before offset+limit.
+func jobLogRows(jobID string, offset int64, limit int64) (pgx.Rows, error) {
+	var end *int64
+	if limit > 0 {
+		e := offset + limit
+		end = &e
+	}
+	return db.Pool.Query(context.Background(), `
+		SELECT byte_offset, chunk FROM job_logs
+		WHERE job_id = $1 AND byte_offset + octet_length(chunk) > $2 AND ($3::bigint IS NULL OR byte_offset < $3)
+		ORDER BY byte_offset`, jobID, offset, end)
+}
+
+// GetJobLog returns the log of a job from offset on, at most limit bytes
+// (0 for all of it). The range is adjusted to whole UTF-8 characters.
+func (s *Service) GetJobLog(jobID string, offset int64, limit int64) (models.JobLog, error) {
+	if db.Pool == nil {
+		return models.JobLog{}, fmt.Errorf("database not connected")
+	}
+	if !uuidRegex.MatchString(jobID) {
+		return models.JobLog{}, ErrJobNotFound
+	}
+
+	var status string
+	err := db.Pool.QueryRow(context.Background(), "SELECT status FROM jobs WHERE id = $1", jobID).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.JobLog{}, ErrJobNotFound
+	} else if err != nil {
+		return models.JobLog{}, err
+	}
+
+	rows, err := jobLogRows(jobID, offset, limit)
+	if err != nil {
+		return models.JobLog{}, err
+	}
+	defer rows.Close()
+
+	var text []byte
+	base := int64(-1)
+	for rows.Next() {
+		var chunkOffset int64
+		var chunk string
+		if err := rows.Scan(&chunkOffset, &chunk); err != nil {
+			return models.JobLog{}, err
+		}
+		if base < 0 {
+			base = chunkOffset
+		}
+		text = append(text, chunk...)
+	}
+	if err := rows.Err(); err != nil {
+		return models.JobLog{}, err
+	}
+
+	jobLog := models.JobLog{
+		JobID:      jobID,
+		Offset:     offset,
+		NextOffset: offset,
+		Finished:   status == protocol.JobStatusCompleted || status == protocol.JobStatusFailed || status == protocol.JobStatusCancelled,
+	}
+	if base < 0 {
+		return jobLog, nil
+	}
+
+	from := offset - base
+	if from < 0 {
+		from = 0
+	}
+	to := int64(len(text))
+	if limit > 0 && from+limit < to {
+		to = from + limit
+	}
+	for from < to && !utf8.RuneStart(text[from]) {
+		from++
+	}
+	for to > from && to < int64(len(text)) && !utf8.RuneStart(text[to]) {
+		to--
+	}
+
+	jobLog.Offset = base + from
+	jobLog.NextOffset = base + to
+	jobLog.Log = string(text[from:to])
+	return jobLog, nil
+}
+
+// ReplayJobLog calls send with the stored log of a job of the project from
+// offset on, in chunks of up to maxReplayChunk bytes. The gateway calls it
+// for LOG_SUBSCRIBE.
+func (s *Service) ReplayJobLog(projectID string, jobID string, offset int64, send func(protocol.LogChunkPayload) error) error {
+	if db.Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+	if !uuidRegex.MatchString(jobID) {
+		return ErrJobNotFound
+	}
+	var exists bool
+	if err := db.Pool.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM jobs WHERE id = $1 AND project_id = $2)", jobID, projectID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrJobNotFound
+	}
+
+	rows, err := jobLogRows(jobID, offset, 0)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var pending string
+	var pendingOffset int64
+	flush := func() error {
+		if pending == "" {
+			return nil
+		}
+		offset := pendingOffset
+		err := send(protocol.LogChunkPayload{JobID: jobID, Chunk: pending, Offset: &offset})
+		pending = ""
+		return err
+	}
+	for rows.Next() {
+		var chunkOffset int64
+		var chunk string
+		if err := rows.Scan(&chunkOffset, &chunk); err != nil {
+			return err
+		}
+		// Start mid-chunk at offset, on a character boundary
+		if chunkOffset < offset {
+			cut := int(offset - chunkOffset)
+			for cut < len(chunk) && !utf8.RuneStart(chunk[cut]) {
+				cut++
+			}
+			chunk = chunk[cut:]
+			chunkOffset += int64(cut)
+		}
+		if chunk == "" {
+			continue
+		}
+		// Merge consecutive chunks; a gap (a chunk that failed to store) starts a new one
+		if pending != "" && (pendingOffset+int64(len(pending)) != chunkOffset || len(pending)+len(chunk) > maxReplayChunk) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if pending == "" {
+			pendingOffset = chunkOffset
+		}
+		pending += chunk
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rohaaaaaan/devair-backend/internal/db"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+)
+
+// Roles of project members; each may do everything the one before may
+const (
+	RoleViewer   = "viewer"   // Jobs, logs, events, services and the preview
+	RoleOperator = "operator" // Also starts jobs and services
+	RoleAdmin    = "admin"    // Also manages agents and members
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+var (
+	ErrForbidden      = errors.New("not allowed in this project")
+	ErrInvalidRole    = errors.New("role must be viewer, operator or admin")
+	ErrUserNotFound   = errors.New("no user with this email")
+	ErrMemberNotFound = errors.New("not a member of this project")
+	ErrLastAdmin      = errors.New("a project needs at least one admin")
+)
+
+// ProjectRole returns the role of a user in a project, or "" if the user is not a member
+func (s *Service) ProjectRole(projectID string, userID string) (string, error) {
+	if db.Pool == nil {
+		return "", fmt.Errorf("database not connected")
+	}
+	if !uuidRegex.MatchString(projectID) || !uuidRegex.MatchString(userID) {
+		return "", nil
+	}
+	var role string
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT role FROM project_members WHERE project_id = $1 AND user_id = $2", projectID, userID).Scan(&role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+// Authorize returns ErrForbidden unless the user has at least role in the project
+func (s *Service) Authorize(projectID string, userID string, role string) error {
+	have, err := s.ProjectRole(projectID, userID)
+	if err != nil {
+		return err
+	}
+	if roleRanks[have] < roleRanks[role] {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// GetUserProjects returns the projects a user is a member of, with the user's role
+func (s *Service) GetUserProjects(userID string) ([]models.Project, error) {
+	if db.Pool == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+	rows, err := db.Pool.Query(context.Background(), `
+		SELECT p.id, p.name, p.repo_url, p.status, p.state, m.role
+		FROM projects p
+		JOIN project_members m ON m.project_id = p.id
+		WHERE m.user_id = $1
+		ORDER BY p.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []models.Project{}
+	for rows.Next() {
+		var p models.Project
+		if err := rows.Scan(&p.ID, &p.Name, &p.RepoURL, &p.Status, &p.State, &p.Role); err != nil {
+			return nil, err
+		}
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+// GetMembers returns the members of a project
+func (s *Service) GetMembers(projectID string) ([]models.ProjectMember, error) {
+	if db.Pool == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+	rows, err := db.Pool.Query(context.Background(), `
+		SELECT m.project_id, m.user_id, u.email, m.role, m.created_at
+		FROM project_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.project_id = $1
+		ORDER BY u.email`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.ProjectMember{}
+	for rows.Next() {
+		var m models.ProjectMember
+		if err := rows.Scan(&m.ProjectID, &m.UserID, &m.Email, &m.Role, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// SetMember adds the user with the given email to a project, or changes their role
+func (s *Service) SetMember(projectID string, email string, role string) (models.ProjectMember, error) {
+	if db.Pool == nil {
+		return models.ProjectMember{}, fmt.Errorf("database not connected")
+	}
+	if roleRanks[role] == 0 {
+		return models.ProjectMember{}, ErrInvalidRole
+	}
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return models.ProjectMember{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var m models.ProjectMember
+	err = tx.QueryRow(ctx, "SELECT id, email FROM users WHERE email = $1", normalizeEmail(email)).Scan(&m.UserID, &m.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.ProjectMember{}, ErrUserNotFound
+	} else if err != nil {
+		return models.ProjectMember{}, err
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO project_members (project_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (project_id, user_id) DO UPDATE SET role = EXCLUDED.role
+		RETURNING project_id, role, created_at`, projectID, m.UserID, role).Scan(&m.ProjectID, &m.Role, &m.CreatedAt)
+	if err != nil {
+		return models.ProjectMember{}, err
+	}
+	if err := checkAdminLeft(ctx, tx, projectID); err != nil {
+		return models.ProjectMember{}, err
+	}
+	return m, tx.Commit(ctx)
+}
+
+// RemoveMember takes a user out of a project
+func (s *Service) RemoveMember(projectID string, userID string) error {
+	if db.Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+	if !uuidRegex.MatchString(userID) {
+		return ErrMemberNotFound
+	}
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "DELETE FROM project_members WHERE project_id = $1 AND user_id = $2", projectID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMemberNotFound
+	}
+	if err := checkAdminLeft(ctx, tx, projectID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// checkAdminLeft keeps admins from locking everyone out of a project
+func checkAdminLeft(ctx context.Context, tx pgx.Tx, projectID string) error {
+	var admins int
+	// Lock the project's admins so two concurrent demotions can't both pass
+	err := tx.QueryRow(ctx, `
+		SELECT COUNT(*) FROM (
+			SELECT 1 FROM project_members WHERE project_id = $1 AND role = $2 FOR UPDATE
+		) a`, projectID, RoleAdmin).Scan(&admins)
+	if err != nil {
+		return err
+	}
+	if admins == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// JobProject returns the project of a job
+func (s *Service) JobProject(jobID string) (string, error) {
+	job, err := s.GetJob(jobID)
+	return job.ProjectID, err
+}
+
+// AgentProject returns the project of an agent, revoked or not
+func (s *Service) AgentProject(agentID string) (string, error) {
+	if db.Pool == nil {
+		return "", fmt.Errorf("database not connected")
+	}
+	if !uuidRegex.MatchString(agentID) {
+		return "", ErrAgentNotFound
+	}
+	var projectID string
+	err := db.Pool.QueryRow(context.Background(), "SELECT project_id FROM agents WHERE id = $1", agentID).Scan(&projectID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrAgentNotFound
+	}
+	return projectID, err
+}
@@ -0,0 +1,262 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rohaaaaaan/devair-backend/internal/db"
+	"github.com/rohaaaaaan/devair-backend/internal/gateway"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// Jobs no agent could take stay QUEUED (dispatched_at NULL) with their command
+// in input_params, and are sent when a matching agent connects. Secrets are
+// never written to the database; they wait in memory and are lost on restart.
+//
+// With several backend instances, any of them may deliver a job; the claim on
+// dispatched_at makes sure only one does. A job with secrets can only be sent
+// by the instance holding them, which looks for agents every minute.
+
+// queuedCommand is what input_params holds for a job created by TriggerCommand
+type queuedCommand struct {
+	protocol.CommandPayload
+	SecretNames []string `json:"secret_names,omitempty"` // Secrets are kept in memory only
+}
+
+type jobQueue struct {
+	ttl time.Duration // Set by StartJobQueue, 0 keeps jobs queued forever
+
+	// Serializes deliveries, so a job is never sent twice by TriggerCommand and
+	// an agent connecting at the same time
+	deliverMu sync.Mutex
+
+	mu      sync.Mutex
+	secrets map[string]heldSecrets // JobID -> Secrets of a job waiting for an agent
+}
+
+type heldSecrets struct {
+	projectID string
+	values    map[string]string
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{
+		secrets: make(map[string]heldSecrets),
+	}
+}
+
+// StartJobQueue sets how long a job may wait for an agent and starts expiring
+// jobs that waited longer (ttl 0 disables expiry)
+func (s *Service) StartJobQueue(ttl time.Duration) {
+	s.queue.ttl = ttl
+	if db.Pool == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.expireQueuedJobs()
+			if gateway.GlobalManager.Relay != nil {
+				s.deliverPending()
+			}
+		}
+	}()
+}
+
+// deliverPending retries the queued jobs that another instance's agents may
+// take: those of projects with an agent here, and those whose secrets are here
+func (s *Service) deliverPending() {
+	projects := make(map[string]bool)
+	for projectID, p := range gateway.GlobalManager.Presence() {
+		if len(p.Agents) > 0 {
+			projects[projectID] = true
+		}
+	}
+	s.queue.mu.Lock()
+	for _, held := range s.queue.secrets {
+		projects[held.projectID] = true
+	}
+	s.queue.mu.Unlock()
+
+	for projectID := range projects {
+		s.DeliverQueuedJobs(projectID)
+	}
+}
+
+func encodeQueuedCommand(cmd protocol.CommandPayload) string {
+	stored := queuedCommand{CommandPayload: cmd}
+	for name := range cmd.Secrets {
+		stored.SecretNames = append(stored.SecretNames, name)
+	}
+	stored.Secrets = nil
+	data, _ := json.Marshal(stored)
+	return string(data)
+}
+
+// dispatchQueued sends a QUEUED job to an agent, marking it dispatched first so
+// a disconnect during the send can put it back. It returns false without
+// sending if the job was claimed meanwhile. Called with deliverMu held.
+func (s *Service) dispatchQueued(projectID string, cmd protocol.CommandPayload) bool {
+	tag, err := db.Pool.Exec(context.Background(),
+		"UPDATE jobs SET dispatched_at = NOW() WHERE id = $1 AND status = 'QUEUED' AND dispatched_at IS NULL", cmd.JobID)
+	if err != nil {
+		fmt.Printf("Error marking job %s dispatched: %v\n", cmd.JobID, err)
+		return false
+	}
+	if tag.RowsAffected() == 0 {
+		return false
+	}
+	// The command carries the secrets from here on; RequeueJob puts them back
+	s.forgetQueuedJob(cmd.JobID)
+	if gateway.GlobalManager.DispatchJob(projectID, cmd) {
+		return true
+	}
+	s.RequeueJob(projectID, cmd)
+	return false
+}
+
+// DeliverQueuedJobs sends the QUEUED jobs of a project, oldest first, to its
+// agents. The gateway calls it when an agent connects.
+func (s *Service) DeliverQueuedJobs(projectID string) {
+	if db.Pool == nil {
+		return
+	}
+	s.queue.deliverMu.Lock()
+	defer s.queue.deliverMu.Unlock()
+
+	s.expireQueuedJobs()
+
+	rows, err := db.Pool.Query(context.Background(), `
+		SELECT id, type, COALESCE(input_params, '{}') FROM jobs
+		WHERE project_id = $1 AND status = 'QUEUED' AND dispatched_at IS NULL
+		ORDER BY created_at`, projectID)
+	if err != nil {
+		fmt.Printf("Error querying queued jobs of Project %s: %v\n", projectID, err)
+		return
+	}
+	var queued []queuedCommand
+	for rows.Next() {
+		var jobID, jobType, params string
+		if err := rows.Scan(&jobID, &jobType, &params); err != nil {
+			continue
+		}
+		var q queuedCommand
+		if err := json.Unmarshal([]byte(params), &q); err != nil {
+			fmt.Printf("Error decoding queued job %s: %v\n", jobID, err)
+			continue
+		}
+		q.JobID = jobID
+		if q.Type == "" {
+			q.Type = jobType // Queued before input_params held the command
+		}
+		queued = append(queued, q)
+	}
+	rows.Close()
+
+	sent := 0
+	for _, q := range queued {
+		cmd := q.CommandPayload
+		if len(q.SecretNames) > 0 {
+			s.queue.mu.Lock()
+			cmd.Secrets = s.queue.secrets[cmd.JobID].values
+			s.queue.mu.Unlock()
+			if cmd.Secrets == nil {
+				// Another instance may hold them; if none does, the job expires
+				if gateway.GlobalManager.Relay != nil {
+					continue
+				}
+				s.failQueuedJob(projectID, cmd.JobID, "its secrets were lost when the backend restarted, trigger it again")
+				continue
+			}
+		}
+		// Jobs whose labels no connected agent has keep waiting
+		if s.dispatchQueued(projectID, cmd) {
+			sent++
+		}
+	}
+	if sent > 0 {
+		fmt.Printf("Delivered %d queued job(s) to Project %s\n", sent, projectID)
+	}
+}
+
+// RequeueJob puts back a dispatched job whose agent disconnected before
+// starting it, with a full TTL to wait for another. The gateway calls it when
+// no other agent can take the job.
+func (s *Service) RequeueJob(projectID string, cmd protocol.CommandPayload) {
+	if db.Pool == nil {
+		return
+	}
+	if len(cmd.Secrets) > 0 {
+		s.queue.mu.Lock()
+		s.queue.secrets[cmd.JobID] = heldSecrets{projectID: projectID, values: cmd.Secrets}
+		s.queue.mu.Unlock()
+	}
+	if _, err := db.Pool.Exec(context.Background(),
+		"UPDATE jobs SET dispatched_at = NULL, queued_at = NOW() WHERE id = $1 AND status = 'QUEUED'", cmd.JobID); err != nil {
+		fmt.Printf("Error queueing job %s again: %v\n", cmd.JobID, err)
+	}
+}
+
+// expireQueuedJobs fails the jobs that waited longer than the TTL for an agent
+// since they were queued (or queued again)
+func (s *Service) expireQueuedJobs() {
+	if s.queue.ttl <= 0 {
+		return
+	}
+	reason := fmt.Sprintf("no agent picked the job up within %s", s.queue.ttl)
+	rows, err := db.Pool.Query(context.Background(), `
+		UPDATE jobs SET status = 'FAILED', completed_at = NOW(), result = $2
+		WHERE status = 'QUEUED' AND dispatched_at IS NULL AND queued_at < NOW() - make_interval(secs => $1)
+		RETURNING id, project_id`, s.queue.ttl.Seconds(), jobResult{Error: reason}.String())
+	if err != nil {
+		fmt.Printf("Error expiring queued jobs: %v\n", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var jobID, projectID string
+		if err := rows.Scan(&jobID, &projectID); err != nil {
+			continue
+		}
+		s.forgetQueuedJob(jobID)
+		fmt.Printf("Queued job %s of Project %s expired\n", jobID, projectID)
+		broadcastJobFailed(projectID, jobID, reason)
+	}
+}
+
+// failQueuedJob fails a job that can never be delivered
+func (s *Service) failQueuedJob(projectID string, jobID string, reason string) {
+	if _, err := db.Pool.Exec(context.Background(),
+		"UPDATE jobs SET status = 'FAILED', completed_at = NOW(), result = $2 WHERE id = $1",
+		jobID, jobResult{Error: reason}.String()); err != nil {
+		fmt.Printf("Error failing job %s: %v\n", jobID, err)
+		return
+	}
+	s.forgetQueuedJob(jobID)
+	fmt.Printf("Queued job %s of Project %s failed: %s\n", jobID, projectID, reason)
+	broadcastJobFailed(projectID, jobID, reason)
+}
+
+func (s *Service) forgetQueuedJob(jobID string) {
+	s.queue.mu.Lock()
+	delete(s.queue.secrets, jobID)
+	s.queue.mu.Unlock()
+}
+
+// broadcastJobFailed tells the project's clients about a job that failed
+// without reaching an agent
+func broadcastJobFailed(projectID string, jobID string, reason string) {
+	msg, err := protocol.NewMessage(protocol.EventTypeJobUpdate, protocol.JobUpdatePayload{
+		JobID:  jobID,
+		Status: protocol.JobStatusFailed,
+		Error:  reason,
+	})
+	if err == nil {
+		gateway.GlobalManager.BroadcastToClients(projectID, msg)
+	}
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rohaaaaaan/devair-backend/internal/db"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// SaveResourceUsage stores the resource summary sent with a job's final update
+func (s *Service) SaveResourceUsage(jobID string, summary protocol.ResourceSummary) error {
+	if db.Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+	if jobID == "" {
+		return fmt.Errorf("missing job_id")
+	}
+
+	_, err := db.Pool.Exec(context.Background(), `
+		INSERT INTO job_resource_usage
+			(job_id, samples, duration_ms, peak_cpu_percent, avg_cpu_percent, peak_rss_bytes, avg_rss_bytes, read_bytes, write_bytes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (job_id) DO UPDATE SET
+			samples = EXCLUDED.samples,
+			duration_ms = EXCLUDED.duration_ms,
+			peak_cpu_percent = EXCLUDED.peak_cpu_percent,
+			avg_cpu_percent = EXCLUDED.avg_cpu_percent,
+			peak_rss_bytes = EXCLUDED.peak_rss_bytes,
+			avg_rss_bytes = EXCLUDED.avg_rss_bytes,
+			read_bytes = EXCLUDED.read_bytes,
+			write_bytes = EXCLUDED.write_bytes`,
+		jobID, summary.Samples, summary.DurationMs, summary.PeakCPUPercent, summary.AvgCPUPercent,
+		int64(summary.PeakRSSBytes), int64(summary.AvgRSSBytes), int64(summary.ReadBytes), int64(summary.WriteBytes))
+	return err
+}
+
+// GetResourceUsage lists the resource summaries of a project's jobs.
+// sortBy is "peak_rss" (heaviest first) or "recent" (newest first).
+func (s *Service) GetResourceUsage(projectID string, sortBy string, limit int) ([]models.JobResourceUsage, error) {
+	if db.Pool == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	orderBy := "r.peak_rss_bytes DESC"
+	if sortBy == "recent" {
+		orderBy = "r.created_at DESC"
+	}
+
+	rows, err := db.Pool.Query(context.Background(), `
+		SELECT r.job_id, j.project_id, j.type, r.samples, r.duration_ms, r.peak_cpu_percent, r.avg_cpu_percent,
+			r.peak_rss_bytes, r.avg_rss_bytes, r.read_bytes, r.write_bytes, r.created_at
+		FROM job_resource_usage r
+		JOIN jobs j ON j.id = r.job_id
+		WHERE j.project_id = $1
+		ORDER BY `+orderBy+`
+		LIMIT $2`, projectID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []models.JobResourceUsage{}
+	for rows.Next() {
+		var u models.JobResourceUsage
+		var peakRSS, avgRSS, read, write int64
+		if err := rows.Scan(&u.JobID, &u.ProjectID, &u.JobType, &u.Samples, &u.DurationMs, &u.PeakCPUPercent, &u.AvgCPUPercent,
+			&peakRSS, &avgRSS, &read, &write, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		u.PeakRSSBytes, u.AvgRSSBytes = uint64(peakRSS), uint64(avgRSS)
+		u.ReadBytes, u.WriteBytes = uint64(read), uint64(write)
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
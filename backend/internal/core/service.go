@@ -2,20 +2,31 @@ package core
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/rohaaaaaan/devair-backend/internal/db"
-	"github.com/rohaaaaaan/devair-backend/internal/gateway"
 	"github.com/rohaaaaaan/devair-backend/internal/models"
+	"github.com/rohaaaaaan/devair-protocol"
 )
 
 // Service handles core business logic
 type Service struct {
 	// db *pgxpool.Pool
+
+	services *serviceRegistry
+	queue    *jobQueue
+	logs     *logStore
+	limits   *limiter
 }
 
 func NewService() *Service {
-	return &Service{}
+	return &Service{
+		services: newServiceRegistry(),
+		queue:    newJobQueue(),
+		logs:     newLogStore(),
+		limits:   newLimiter(),
+	}
 }
 
 // GetProjects returns the list of projects from DB
@@ -58,53 +69,178 @@ func (s *Service) TriggerJob(projectID string, jobType string) (models.Job, erro
 
 // TriggerJobWithParams allows passing app name, prompts, or UI action details
 func (s *Service) TriggerJobWithParams(projectID string, jobType string, appName string, prompt string, action string, target string, value string) (models.Job, error) {
-	// 1. Create Job in DB
+	return s.TriggerCommand(projectID, protocol.CommandPayload{
+		Type:   jobType,
+		App:    appName,
+		Prompt: prompt,
+		Action: action,
+		Target: target,
+		Value:  value,
+	})
+}
+
+// TriggerCommand creates a job for the given command and dispatches it to an
+// agent of the project that has cmd.Labels, or queues it until one connects.
+// JobID is assigned here; an empty Command falls back to the default for the job type.
+// It returns a *LimitError if the project is at its cap of active or daily jobs.
+func (s *Service) TriggerCommand(projectID string, cmd protocol.CommandPayload) (models.Job, error) {
+	return s.triggerCommand(projectID, cmd, nil)
+}
+
+// SubmitCommand is TriggerCommand for a client's COMMAND_REQUEST, within the
+// limits of CheckTrigger. created is called once the job exists and before it is
+// dispatched, so the client learns the job ID before any event of the job. The
+// gateway calls it.
+func (s *Service) SubmitCommand(projectID string, userID string, cmd protocol.CommandPayload, created func(jobID string)) error {
+	if err := s.CheckTrigger(projectID, userID); err != nil {
+		return err
+	}
+	if _, err := s.triggerCommand(projectID, cmd, created); err != nil {
+		s.RefundTrigger(projectID, userID)
+		return err
+	}
+	return nil
+}
+
+func (s *Service) triggerCommand(projectID string, cmd protocol.CommandPayload, created func(jobID string)) (models.Job, error) {
+	if db.Pool == nil {
+		return models.Job{}, fmt.Errorf("database not connected")
+	}
+	if err := protocol.ValidateSteps(cmd.Steps); err != nil {
+		return models.Job{}, err
+	}
+
+	// BUILD and TEST run the project's command, never one from the request:
+	// custom commands go in Steps. Other types default to the command of the
+	// type. Multi-step jobs have none.
+	switch {
+	case len(cmd.Steps) > 0:
+		cmd.Command = ""
+	case cmd.Type == protocol.CommandTypeBuild:
+		cmd.Command = "npm run build"
+	case cmd.Type == protocol.CommandTypeTest:
+		command, err := s.testCommand(projectID)
+		if err != nil {
+			return models.Job{}, err
+		}
+		cmd.Command = command
+	case cmd.Command != "":
+	case cmd.Type == protocol.CommandTypeOpenIDE:
+		cmd.Command = "code ."
+	case cmd.Type == protocol.CommandTypeServiceStart:
+		cmd.Command = "npm run dev"
+	}
+
+	// 1. Create Job in DB, with the command to deliver later if no agent can take it now.
+	// The caps on the project's jobs are checked in the same transaction.
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return models.Job{}, err
+	}
+	defer tx.Rollback(ctx)
+	if err := s.checkJobCaps(ctx, tx, projectID); err != nil {
+		return models.Job{}, err
+	}
 	var jobID string
-	err := db.Pool.QueryRow(context.Background(),
+	err = tx.QueryRow(ctx,
 		"INSERT INTO jobs (project_id, type, status, input_params) VALUES ($1, $2, $3, $4) RETURNING id",
-		projectID, jobType, "QUEUED", "{}").Scan(&jobID)
-
+		projectID, cmd.Type, "QUEUED", encodeQueuedCommand(cmd)).Scan(&jobID)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
 	if err != nil {
 		fmt.Printf("Error creating job: %v\n", err)
 		return models.Job{}, err
 	}
+	cmd.JobID = jobID
 
-	// 2. Dispatch to Agent
-	// Default command for known types
-	cmdStr := ""
-	switch jobType {
-	case models.CommandTypeBuild:
-		cmdStr = "npm run build"
-	case models.CommandTypeOpenIDE:
-		cmdStr = "code ."
-	}
-
-	cmd := models.CommandPayload{
-		JobID:   jobID,
-		Type:    jobType,
-		Command: cmdStr,
-		App:     appName,
-		Prompt:  prompt,
-		Action:  action,
-		Target:  target,
-		Value:   value,
+	if len(cmd.Steps) > 0 {
+		if err := s.createSteps(jobID, cmd.Steps); err != nil {
+			fmt.Printf("Error creating steps of job %s: %v\n", jobID, err)
+		}
 	}
 
-	msg := models.WSMessage{
-		Type:    models.EventTypeCommand,
-		Payload: cmd,
+	if created != nil {
+		created(jobID)
 	}
 
-	if sent := gateway.GlobalManager.SendToAgent(projectID, msg); sent {
+	// 2. Dispatch to Agent
+	s.queue.deliverMu.Lock()
+	sent := s.dispatchQueued(projectID, cmd)
+	s.queue.deliverMu.Unlock()
+	if sent {
 		fmt.Printf("Command dispatched to Agent for Project %s\n", projectID)
 	} else {
-		fmt.Printf("No agent connected for Project %s. Job queued.\n", projectID)
+		fmt.Printf("No matching agent connected for Project %s. Job queued.\n", projectID)
 	}
 
 	return models.Job{
-		ID:        jobID,
-		ProjectID: projectID,
-		Type:      jobType,
-		Status:    "QUEUED",
+		ID:            jobID,
+		ProjectID:     projectID,
+		Type:          cmd.Type,
+		Status:        "QUEUED",
+		TriggerSource: protocol.TriggerSourceManual,
 	}, nil
 }
+
+// RecordAgentJob stores a job the agent started on its own (e.g. in watch mode).
+// The agent is already running it, so it starts out RUNNING.
+func (s *Service) RecordAgentJob(projectID string, created protocol.JobCreatedPayload) error {
+	if db.Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+	if created.JobID == "" || created.Type == "" {
+		return fmt.Errorf("missing job_id or type")
+	}
+	source := created.TriggerSource
+	if source == "" {
+		source = protocol.TriggerSourceWatch
+	}
+
+	params, _ := json.Marshal(map[string]interface{}{
+		"command": created.Command,
+		"params":  created.Params,
+	})
+	_, err := db.Pool.Exec(context.Background(), `
+		INSERT INTO jobs (id, project_id, type, status, input_params, trigger_source, started_at)
+		VALUES ($1, $2, $3, 'RUNNING', $4, $5, NOW())
+		ON CONFLICT (id) DO NOTHING`,
+		created.JobID, projectID, created.Type, string(params), source)
+	return err
+}
+
+// HandleAgentMessage is called by the gateway for every valid message an agent sends,
+// after it has been broadcast to the project's clients.
+func (s *Service) HandleAgentMessage(projectID string, msg protocol.WSMessage, payload protocol.Payload) {
+	switch p := payload.(type) {
+	case *protocol.TestResultsPayload:
+		if err := s.SaveTestResults(*p); err != nil {
+			fmt.Printf("Error saving test results for job %s: %v\n", p.JobID, err)
+		}
+
+	case *protocol.JobCreatedPayload:
+		if err := s.RecordAgentJob(projectID, *p); err != nil {
+			fmt.Printf("Error recording agent job %s: %v\n", p.JobID, err)
+		}
+
+	case *protocol.StepUpdatePayload:
+		if err := s.SaveStepUpdate(*p); err != nil {
+			fmt.Printf("Error saving step %d of job %s: %v\n", p.Index, p.JobID, err)
+		}
+
+	case *protocol.ServiceStatusPayload:
+		s.services.update(projectID, *p)
+
+	case *protocol.JobUpdatePayload:
+		switch p.Status {
+		case protocol.JobStatusCompleted, protocol.JobStatusFailed, protocol.JobStatusCancelled:
+			s.logs.forget(p.JobID)
+		}
+		if p.Resources != nil {
+			if err := s.SaveResourceUsage(p.JobID, *p.Resources); err != nil {
+				fmt.Printf("Error saving resource usage for job %s: %v\n", p.JobID, err)
+			}
+		}
+	}
+}
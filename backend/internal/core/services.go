@@ -0,0 +1,84 @@
+package core
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// serviceRegistry keeps the last reported status of every agent-supervised service,
+// so that clients which connect later (e.g. the Preview view) can find a running dev server
+type serviceRegistry struct {
+	mu       sync.RWMutex
+	statuses map[string]map[string]protocol.ServiceStatusPayload // ProjectID -> Name -> Status
+}
+
+func newServiceRegistry() *serviceRegistry {
+	return &serviceRegistry{
+		statuses: make(map[string]map[string]protocol.ServiceStatusPayload),
+	}
+}
+
+func (r *serviceRegistry) update(projectID string, status protocol.ServiceStatusPayload) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	services, ok := r.statuses[projectID]
+	if !ok {
+		services = make(map[string]protocol.ServiceStatusPayload)
+		r.statuses[projectID] = services
+	}
+	// Agents report in order, but guard against stale updates after a reconnect
+	if prev, ok := services[status.Name]; ok && prev.UpdatedAt > status.UpdatedAt {
+		return
+	}
+	services[status.Name] = status
+}
+
+func (r *serviceRegistry) list(projectID string) []protocol.ServiceStatusPayload {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := []protocol.ServiceStatusPayload{}
+	for _, status := range r.statuses[projectID] {
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GetServices returns the last known status of the project's dev servers
+func (s *Service) GetServices(projectID string) []protocol.ServiceStatusPayload {
+	return s.services.list(projectID)
+}
+
+// StartService asks the agent to start (and supervise) a long-running command.
+// An empty command uses the default dev server command.
+func (s *Service) StartService(projectID string, name string, command string, params map[string]string) (models.Job, error) {
+	return s.TriggerCommand(projectID, protocol.CommandPayload{
+		Type:    protocol.CommandTypeServiceStart,
+		Command: command,
+		Params:  withServiceName(params, name),
+	})
+}
+
+// StopService asks the agent to stop a supervised service
+func (s *Service) StopService(projectID string, name string) (models.Job, error) {
+	return s.TriggerCommand(projectID, protocol.CommandPayload{
+		Type:   protocol.CommandTypeServiceStop,
+		Params: withServiceName(nil, name),
+	})
+}
+
+func withServiceName(params map[string]string, name string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range params {
+		merged[k] = v
+	}
+	if name != "" {
+		merged["name"] = name
+	}
+	return merged
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rohaaaaaan/devair-backend/internal/db"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// createSteps stores the steps of a new job as PENDING, so clients can show
+// the whole pipeline before the agent reaches each step
+func (s *Service) createSteps(jobID string, steps []protocol.JobStep) error {
+	batch := &pgx.Batch{}
+	for i, step := range steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step %d", i+1)
+		}
+		batch.Queue(
+			"INSERT INTO job_steps (job_id, step_index, name, command, status) VALUES ($1, $2, $3, $4, $5)",
+			jobID, i, name, step.Command, protocol.StepStatusPending)
+	}
+	return db.Pool.SendBatch(context.Background(), batch).Close()
+}
+
+// SaveStepUpdate records a step start/end reported by the agent
+func (s *Service) SaveStepUpdate(update protocol.StepUpdatePayload) error {
+	if db.Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+
+	var startedAt, finishedAt *time.Time
+	if update.StartedAt != 0 {
+		t := time.UnixMilli(update.StartedAt)
+		startedAt = &t
+	}
+	if update.FinishedAt != 0 {
+		t := time.UnixMilli(update.FinishedAt)
+		finishedAt = &t
+	}
+
+	// The row normally exists already; upsert in case the job came from elsewhere
+	_, err := db.Pool.Exec(context.Background(), `
+		INSERT INTO job_steps (job_id, step_index, name, status, exit_code, error, started_at, finished_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8)
+		ON CONFLICT (job_id, step_index) DO UPDATE SET
+			status = EXCLUDED.status,
+			exit_code = COALESCE(EXCLUDED.exit_code, job_steps.exit_code),
+			error = COALESCE(EXCLUDED.error, job_steps.error),
+			started_at = COALESCE(EXCLUDED.started_at, job_steps.started_at),
+			finished_at = COALESCE(EXCLUDED.finished_at, job_steps.finished_at)`,
+		update.JobID, update.Index, update.Name, update.Status, update.ExitCode, update.Error, startedAt, finishedAt)
+	return err
+}
+
+// GetJobSteps returns the steps of a job in order
+func (s *Service) GetJobSteps(jobID string) ([]models.JobStep, error) {
+	if db.Pool == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	rows, err := db.Pool.Query(context.Background(), `
+		SELECT id, job_id, step_index, name, COALESCE(command, ''), status, exit_code, COALESCE(error, ''), started_at, finished_at
+		FROM job_steps
+		WHERE job_id = $1
+		ORDER BY step_index`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := []models.JobStep{}
+	for rows.Next() {
+		var st models.JobStep
+		if err := rows.Scan(&st.ID, &st.JobID, &st.Index, &st.Name, &st.Command, &st.Status, &st.ExitCode, &st.Error, &st.StartedAt, &st.FinishedAt); err != nil {
+			return nil, err
+		}
+		steps = append(steps, st)
+	}
+	return steps, rows.Err()
+}
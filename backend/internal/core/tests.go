@@ -0,0 +1,105 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rohaaaaaan/devair-backend/internal/db"
+	"github.com/rohaaaaaan/devair-backend/internal/models"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// TriggerTest creates a TEST job running the project's test command
+func (s *Service) TriggerTest(projectID string, params map[string]string) (models.Job, error) {
+	return s.TriggerCommand(projectID, protocol.CommandPayload{
+		Type:   protocol.CommandTypeTest,
+		Params: params,
+	})
+}
+
+// testCommand returns the test command configured for a project, or "npm test"
+func (s *Service) testCommand(projectID string) (string, error) {
+	var command *string
+	err := db.Pool.QueryRow(context.Background(), "SELECT test_command FROM projects WHERE id = $1", projectID).Scan(&command)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+	if command == nil || *command == "" {
+		return "npm test", nil
+	}
+	return *command, nil
+}
+
+// SetTestCommand configures the command TEST jobs of a project run; "" restores "npm test"
+func (s *Service) SetTestCommand(projectID string, command string) error {
+	if db.Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+	_, err := db.Pool.Exec(context.Background(),
+		"UPDATE projects SET test_command = NULLIF($2, '') WHERE id = $1", projectID, strings.TrimSpace(command))
+	return err
+}
+
+// SaveTestResults replaces the stored results of a job with the ones reported by the agent
+func (s *Service) SaveTestResults(results protocol.TestResultsPayload) error {
+	if db.Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+	if results.JobID == "" {
+		return fmt.Errorf("missing job_id")
+	}
+
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Agents may re-send results (e.g. retries), keep only the latest report
+	if _, err := tx.Exec(ctx, "DELETE FROM test_results WHERE job_id = $1", results.JobID); err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	for _, r := range results.Results {
+		batch.Queue(
+			"INSERT INTO test_results (job_id, suite, name, status, duration_ms, output) VALUES ($1, $2, $3, $4, $5, $6)",
+			results.JobID, r.Suite, r.Name, r.Status, r.DurationMs, r.Output)
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetTestResults returns the per-test results of a job, failures first
+func (s *Service) GetTestResults(jobID string) ([]models.TestResult, error) {
+	if db.Pool == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	rows, err := db.Pool.Query(context.Background(), `
+		SELECT id, job_id, COALESCE(suite, ''), name, status, duration_ms, COALESCE(output, ''), created_at
+		FROM test_results
+		WHERE job_id = $1
+		ORDER BY CASE status WHEN 'FAIL' THEN 0 WHEN 'PASS' THEN 1 ELSE 2 END, suite, name`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []models.TestResult{}
+	for rows.Next() {
+		var r models.TestResult
+		if err := rows.Scan(&r.ID, &r.JobID, &r.Suite, &r.Name, &r.Status, &r.DurationMs, &r.Output, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
@@ -30,6 +30,29 @@ CREATE TABLE IF NOT EXISTS agents (
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Login sessions (only a SHA-256 of the session token is stored)
+CREATE TABLE IF NOT EXISTS sessions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Who may do what in a project. Roles: viewer (sees jobs, logs and the preview), operator
+-- (also runs jobs and services), admin (also manages agents and members). Grant the first
+-- admin of a project by hand:
+--   INSERT INTO project_members (project_id, user_id, role)
+--   SELECT '<project id>', id, 'admin' FROM users WHERE email = '<email>';
+CREATE TABLE IF NOT EXISTS project_members (
+    project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL, -- viewer, operator, admin
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (project_id, user_id)
+);
+
 -- Jobs Table
 CREATE TABLE IF NOT EXISTS jobs (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -38,7 +61,96 @@ CREATE TABLE IF NOT EXISTS jobs (
     status VARCHAR(50) DEFAULT 'CREATED', -- CREATED, QUEUED, RUNNING, COMPLETED, FAILED, CANCELLED
     result TEXT, -- JSON result
     input_params TEXT, -- JSON params
+    trigger_source VARCHAR(20) DEFAULT 'manual', -- manual, watch
     started_at TIMESTAMP WITH TIME ZONE,
     completed_at TIMESTAMP WITH TIME ZONE,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
+
+-- Columns added after the initial release (no-ops on fresh databases)
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS trigger_source VARCHAR(20) DEFAULT 'manual';
+-- Set once a QUEUED job is sent to an agent; jobs without it wait for one to connect.
+-- Rows that existed before count as sent (the default only applies while the column is added).
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS dispatched_at TIMESTAMP WITH TIME ZONE DEFAULT NOW();
+ALTER TABLE jobs ALTER COLUMN dispatched_at DROP DEFAULT;
+-- When a job last started waiting for an agent (created or requeued); the queue TTL counts from it
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS queued_at TIMESTAMP WITH TIME ZONE DEFAULT NOW();
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash VARCHAR(255); -- bcrypt
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS test_command TEXT; -- Run by TEST jobs, npm test if NULL
+
+-- Agent tokens: only a SHA-256 of the secret part is stored, the token is shown once
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS name VARCHAR(255);
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64);
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS token_rotated_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP WITH TIME ZONE;
+
+-- Test Results Table (one row per test case of a TEST job)
+CREATE TABLE IF NOT EXISTS test_results (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    job_id UUID REFERENCES jobs(id) ON DELETE CASCADE,
+    suite VARCHAR(255),
+    name TEXT NOT NULL,
+    status VARCHAR(10) NOT NULL, -- PASS, FAIL, SKIP
+    duration_ms DOUBLE PRECISION DEFAULT 0,
+    output TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_test_results_job_id ON test_results(job_id);
+
+-- Steps of multi-step jobs (install -> lint -> test -> build)
+CREATE TABLE IF NOT EXISTS job_steps (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    job_id UUID REFERENCES jobs(id) ON DELETE CASCADE,
+    step_index INTEGER NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    command TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING', -- PENDING, RUNNING, COMPLETED, FAILED, SKIPPED
+    exit_code INTEGER,
+    error TEXT,
+    started_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (job_id, step_index)
+);
+
+-- Resource usage summary per job (peak/average of the sampled process tree)
+CREATE TABLE IF NOT EXISTS job_resource_usage (
+    job_id UUID PRIMARY KEY REFERENCES jobs(id) ON DELETE CASCADE,
+    samples INTEGER NOT NULL DEFAULT 0,
+    duration_ms BIGINT NOT NULL DEFAULT 0,
+    peak_cpu_percent DOUBLE PRECISION NOT NULL DEFAULT 0,
+    avg_cpu_percent DOUBLE PRECISION NOT NULL DEFAULT 0,
+    peak_rss_bytes BIGINT NOT NULL DEFAULT 0,
+    avg_rss_bytes BIGINT NOT NULL DEFAULT 0,
+    read_bytes BIGINT NOT NULL DEFAULT 0,
+    write_bytes BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Log output of jobs, one row per LOG_CHUNK. byte_offset is where the chunk starts in the
+-- job's log, so clients can fetch a range or resume a stream.
+CREATE TABLE IF NOT EXISTS job_logs (
+    job_id UUID REFERENCES jobs(id) ON DELETE CASCADE,
+    byte_offset BIGINT NOT NULL,
+    chunk TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (job_id, byte_offset)
+);
+
+-- Sockets held by each backend instance, so instances sharing this database can route
+-- commands and broadcasts to each other. Rows of an instance that stops heartbeating expire.
+CREATE TABLE IF NOT EXISTS gateway_presence (
+    instance_id TEXT NOT NULL,
+    project_id TEXT NOT NULL,
+    agents JSONB NOT NULL DEFAULT '[]',
+    clients INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (instance_id, project_id)
+);
+
+-- Relayed messages too large for a NOTIFY payload. Never holds secrets.
+CREATE TABLE IF NOT EXISTS gateway_messages (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
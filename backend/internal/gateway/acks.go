@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// A successful send only means the COMMAND reached the socket, so agents
+// (protocol.CommandAckVersion and later) acknowledge each one with a
+// COMMAND_ACK as soon as it arrives. A COMMAND that isn't acknowledged within
+// commandAckTimeout is sent again, and a reconnecting agent gets the ones its
+// old connection didn't acknowledge. Agents run a job ID only once, so a
+// resent COMMAND is acknowledged again but not run twice. An agent that
+// leaves maxCommandSends sends unanswered is dropped, which hands the job to
+// another agent.
+
+const (
+	commandAckTimeout = 10 * time.Second
+	maxCommandSends   = 3
+)
+
+// StartCommandResends starts resending the COMMANDs agents haven't acknowledged
+func (m *Manager) StartCommandResends() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.resendUnacked(time.Now())
+		}
+	}()
+}
+
+type agentCommands struct {
+	projectID string
+	agent     *agentConn
+	jobs      []*assignedJob
+}
+
+// resendUnacked sends the COMMANDs that have waited commandAckTimeout for an
+// acknowledgement again, and drops the agents that never answer
+func (m *Manager) resendUnacked(now time.Time) {
+	var resends, unresponsive []agentCommands
+	m.lock.Lock()
+	for projectID, agents := range m.agents {
+		for _, a := range agents {
+			if !a.acks {
+				continue
+			}
+			due := agentCommands{projectID: projectID, agent: a}
+			dead := false
+			for _, job := range a.jobs {
+				if job.acked || now.Sub(job.sentAt) < commandAckTimeout {
+					continue
+				}
+				if job.sends >= maxCommandSends {
+					dead = true
+					break
+				}
+				due.jobs = append(due.jobs, job)
+			}
+			switch {
+			case dead:
+				unresponsive = append(unresponsive, due)
+			case len(due.jobs) > 0:
+				for _, job := range due.jobs {
+					job.sends++
+					job.sentAt = now
+				}
+				resends = append(resends, due)
+			}
+		}
+	}
+	m.lock.Unlock()
+
+	for _, u := range unresponsive {
+		log.Printf("Agent of Project %s acknowledged none of %d COMMAND sends, dropping it", u.projectID, maxCommandSends)
+		m.Unregister(u.projectID, u.agent.conn)
+	}
+	for _, r := range resends {
+		log.Printf("Resending %d unacknowledged COMMAND(s) to an agent of Project %s", len(r.jobs), r.projectID)
+		m.sendCommands(r.projectID, r.agent, r.jobs)
+	}
+}
+
+// takeUnacked moves the jobs of a replaced connection that were never
+// acknowledged to the agent's new connection, to be sent again. Called with
+// lock held.
+func takeUnacked(replaced *agentConn, agent *agentConn, now time.Time) []*assignedJob {
+	if !replaced.acks || !agent.acks {
+		// An older agent may have run what it didn't acknowledge
+		return nil
+	}
+	var moved []*assignedJob
+	for jobID, job := range replaced.jobs {
+		if job.acked || job.started || !hasLabels(agent.labels, job.cmd.Labels) {
+			continue
+		}
+		delete(replaced.jobs, jobID)
+		job.sends = 1
+		job.sentAt = now
+		agent.jobs[jobID] = job
+		moved = append(moved, job)
+	}
+	return moved
+}
+
+// sendCommands sends the COMMANDs of jobs to an agent in the order they were
+// dispatched. On failure the agent is unregistered, which hands the jobs on.
+func (m *Manager) sendCommands(projectID string, agent *agentConn, jobs []*assignedJob) {
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].dispatchedAt.Before(jobs[j].dispatchedAt) })
+	for _, job := range jobs {
+		if !m.sendToAgent(projectID, agent, protocol.EventTypeCommand, job.cmd) {
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// testConn returns a connected socket whose other end discards everything, for
+// agents the test drops
+func testConn(t *testing.T) *websocket.Conn {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestResendUnacked(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		acks      bool
+		job       assignedJob
+		wantSends int
+		resent    bool
+		dropped   bool
+	}{
+		{"acknowledged", true, assignedJob{sends: 1, sentAt: now.Add(-time.Minute), acked: true}, 1, false, false},
+		{"not due yet", true, assignedJob{sends: 1, sentAt: now.Add(-commandAckTimeout + time.Second)}, 1, false, false},
+		{"due", true, assignedJob{sends: 1, sentAt: now.Add(-commandAckTimeout)}, 2, true, false},
+		{"last send due", true, assignedJob{sends: maxCommandSends - 1, sentAt: now.Add(-time.Minute)}, maxCommandSends, true, false},
+		{"agent without acks", false, assignedJob{sends: 1, sentAt: now.Add(-time.Minute)}, 1, false, false},
+		{"unanswered", true, assignedJob{sends: maxCommandSends, sentAt: now.Add(-commandAckTimeout)}, maxCommandSends, false, true},
+	}
+	for _, tt := range tests {
+		var requeued []string
+		m := &Manager{
+			agents:          make(map[string][]*agentConn),
+			clients:         make(map[string][]*clientConn),
+			events:          make(map[string]*eventLog),
+			OnJobUnassigned: func(projectID string, cmd protocol.CommandPayload) { requeued = append(requeued, cmd.JobID) },
+		}
+		a := testAgent("agent", nil, 0)
+		a.acks = tt.acks
+		a.conn = testConn(t)
+		job := tt.job
+		job.cmd = protocol.CommandPayload{JobID: "job", Type: "BUILD"}
+		a.jobs["job"] = &job
+		m.agents["p"] = []*agentConn{a}
+
+		m.resendUnacked(now)
+
+		if job.sends != tt.wantSends {
+			t.Errorf("%s: sends = %d, want %d", tt.name, job.sends, tt.wantSends)
+		}
+		if resent := len(a.out) > 0; resent != tt.resent {
+			t.Errorf("%s: resent = %v, want %v", tt.name, resent, tt.resent)
+		}
+		if tt.resent && !job.sentAt.Equal(now) {
+			t.Errorf("%s: sentAt not updated", tt.name)
+		}
+		if dropped := len(m.agents["p"]) == 0; dropped != tt.dropped {
+			t.Errorf("%s: dropped = %v, want %v", tt.name, dropped, tt.dropped)
+		}
+		// The job of a dropped agent waits for another one
+		if tt.dropped && (len(requeued) != 1 || requeued[0] != "job") {
+			t.Errorf("%s: requeued %q, want the job", tt.name, requeued)
+		}
+	}
+}
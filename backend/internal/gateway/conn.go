@@ -0,0 +1,231 @@
+package gateway
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// gorilla/websocket allows only one concurrent writer. Every socket gets an
+// outbound queue drained by its own writer goroutine, so senders (request
+// handlers, agent read loops, tunnels) never write to the socket themselves.
+
+const (
+	sendQueueSize = 256
+	writeWait     = 10 * time.Second // Per frame; a stuck peer is dropped
+)
+
+var (
+	errConnClosed     = errors.New("connection closed")
+	errSendQueueFull  = errors.New("send queue full")
+	errSendQueueStuck = errors.New("send queue full for " + writeWait.String())
+)
+
+type outboundFrame struct {
+	frameType int
+	data      []byte
+}
+
+// peerConn is a socket with an outbound queue and a writer goroutine
+type peerConn struct {
+	conn     *websocket.Conn
+	encoding string // Granted at IDENTIFY, JSON for browsers
+
+	out       chan outboundFrame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPeerConn(conn *websocket.Conn, encoding string) *peerConn {
+	p := &peerConn{
+		conn:     conn,
+		encoding: encoding,
+		out:      make(chan outboundFrame, sendQueueSize),
+		done:     make(chan struct{}),
+	}
+	go p.writeLoop()
+	return p
+}
+
+func (p *peerConn) writeLoop() {
+	for {
+		select {
+		case f := <-p.out:
+			p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := p.conn.WriteMessage(f.frameType, f.data)
+			if err != nil || f.frameType == websocket.CloseMessage {
+				p.close()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// close drops the socket and whatever is still queued. The read loop of the
+// connection then fails and unregisters it.
+func (p *peerConn) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.conn.Close()
+	})
+}
+
+// closeWith sends a close frame after the frames already queued, then closes
+func (p *peerConn) closeWith(code int, reason string) {
+	if p.enqueue(outboundFrame{websocket.CloseMessage, websocket.FormatCloseMessage(code, reason)}, false) != nil {
+		p.close()
+	}
+}
+
+// enqueue queues a frame. If the queue is full it fails at once, or with wait
+// after writeWait; either way the peer can't keep up and is closed.
+func (p *peerConn) enqueue(f outboundFrame, wait bool) error {
+	select {
+	case <-p.done:
+		return errConnClosed
+	default:
+	}
+
+	select {
+	case p.out <- f:
+		return nil
+	case <-p.done:
+		return errConnClosed
+	default:
+	}
+	if !wait {
+		p.close()
+		return errSendQueueFull
+	}
+
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+	select {
+	case p.out <- f:
+		return nil
+	case <-p.done:
+		return errConnClosed
+	case <-timer.C:
+		p.close()
+		return errSendQueueStuck
+	}
+}
+
+// agentConn is an agent socket. Sends wait for room in the queue: they come
+// from request handlers, which can afford to, and a job or tunnel frame
+// shouldn't be lost to a short burst.
+type agentConn struct {
+	*peerConn
+	agentID string   // Row in the agents table, empty if agents are not authenticated
+	labels  []string // Reported at IDENTIFY
+	acks    bool     // Sends a COMMAND_ACK for each COMMAND (protocol.CommandAckVersion and later)
+
+	// Scheduling state, guarded by Manager.lock
+	jobs         map[string]*assignedJob // Dispatched jobs that haven't finished
+	services     map[string]int64        // Services running on the agent -> UpdatedAt of their last status
+	lastAssigned time.Time
+}
+
+func newAgentConn(conn *websocket.Conn, agentID string, labels []string, encoding string, acks bool) *agentConn {
+	return &agentConn{
+		peerConn: newPeerConn(conn, encoding),
+		agentID:  agentID,
+		labels:   labels,
+		acks:     acks,
+		jobs:     make(map[string]*assignedJob),
+		services: make(map[string]int64),
+	}
+}
+
+func (a *agentConn) send(t protocol.EventType, payload interface{}) error {
+	frameType, data, err := protocol.EncodeFrame(a.encoding, t, payload)
+	if err != nil {
+		return err
+	}
+	return a.enqueue(outboundFrame{frameType, data}, true)
+}
+
+// clientConn is a browser socket. Sends never wait: one slow phone must not
+// stall the broadcasts to everyone else, so a client whose queue is full is
+// disconnected (it can reconnect and replay the logs it missed).
+type clientConn struct {
+	*peerConn
+	userID string // Empty if clients are not authenticated
+
+	// While a LOG_SUBSCRIBE replays a job's log, live chunks of that job are
+	// held back and sent after the replay
+	mu        sync.Mutex
+	replaying map[string][]outboundFrame // JobID -> Held chunks
+}
+
+func newClientConn(conn *websocket.Conn, userID string) *clientConn {
+	return &clientConn{
+		peerConn:  newPeerConn(conn, protocol.EncodingJSON),
+		userID:    userID,
+		replaying: make(map[string][]outboundFrame),
+	}
+}
+
+func (c *clientConn) send(t protocol.EventType, payload interface{}) error {
+	_, data, err := protocol.EncodeFrame(protocol.EncodingJSON, t, payload)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(outboundFrame{websocket.TextMessage, data}, false)
+}
+
+// sendBroadcast queues an encoded message; logJobID is set for LOG_CHUNKs
+func (c *clientConn) sendBroadcast(data []byte, logJobID string) error {
+	f := outboundFrame{websocket.TextMessage, data}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if held, ok := c.replaying[logJobID]; ok && logJobID != "" {
+		if len(held) >= sendQueueSize {
+			c.close()
+			return errSendQueueFull
+		}
+		c.replaying[logJobID] = append(held, f)
+		return nil
+	}
+	return c.enqueue(f, false)
+}
+
+// replay sends the stored log of a job through send and then the live chunks
+// that arrived meanwhile. Clients drop what they got twice by offset.
+func (c *clientConn) replay(jobID string, read func(send func(protocol.LogChunkPayload) error) error) error {
+	c.mu.Lock()
+	c.replaying[jobID] = nil
+	c.mu.Unlock()
+
+	err := read(func(chunk protocol.LogChunkPayload) error {
+		_, data, err := protocol.EncodeFrame(protocol.EncodingJSON, protocol.EventTypeLogChunk, chunk)
+		if err != nil {
+			return err
+		}
+		// The replay runs on the client's own read loop, so it may wait for the writer
+		return c.enqueue(outboundFrame{websocket.TextMessage, data}, true)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.replaying[jobID] {
+		if c.enqueue(f, false) != nil {
+			break
+		}
+	}
+	delete(c.replaying, jobID)
+	return err
+}
+
+// logSendError logs a failed send unless the peer is simply gone
+func logSendError(peer string, err error) {
+	if !errors.Is(err, errConnClosed) {
+		log.Printf("Error sending to %s: %v", peer, err)
+	}
+}
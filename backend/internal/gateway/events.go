@@ -0,0 +1,352 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// Server-Sent Events carry the LOG_CHUNK, JOB_UPDATE and AI_STAGE_UPDATE
+// broadcasts of a project to HTTP clients. Once a project has had a stream, its
+// recent events are kept so a stream can resume from Last-Event-ID. IDs are
+// "<epoch>-<seq>"; an ID from another instance or from before a restart is not
+// resumable, and a job stream then replays the stored log instead. A log
+// without streams is dropped after eventLogIdleTTL.
+
+const (
+	eventLogSize     = 1024
+	eventLogBytes    = 4 << 20          // Payload bytes kept per project
+	eventPingPeriod  = 15 * time.Second // Comment line that keeps proxies from timing out the stream
+	eventRetryMillis = 3000
+	eventLogIdleTTL  = 5 * time.Minute // How long a log is kept for streams to resume once the last one closed
+)
+
+// streamEvent is a broadcast kept for the streams of a project
+type streamEvent struct {
+	seq     uint64
+	typ     protocol.EventType
+	jobID   string
+	payload json.RawMessage
+	logEnd  int64 // LOG_CHUNK: offset just past the chunk, 0 if unknown
+}
+
+type eventLog struct {
+	epoch string
+
+	mu      sync.Mutex
+	events  []streamEvent // The last events (up to eventLogSize and eventLogBytes), oldest first
+	size    int           // Payload bytes of events
+	next    uint64        // seq of the next event
+	streams map[chan struct{}]bool
+	idle    time.Time // When the last stream closed
+}
+
+func newEventLog() *eventLog {
+	epochBytes := make([]byte, 4)
+	rand.Read(epochBytes)
+	return &eventLog{
+		epoch:   hex.EncodeToString(epochBytes),
+		next:    1,
+		streams: make(map[chan struct{}]bool),
+		idle:    time.Now(),
+	}
+}
+
+func (l *eventLog) id(seq uint64) string {
+	return fmt.Sprintf("%s-%d", l.epoch, seq)
+}
+
+// parseID returns the seq of an event ID of this log
+func (l *eventLog) parseID(id string) (uint64, bool) {
+	epoch, seq, ok := strings.Cut(id, "-")
+	if !ok || epoch != l.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil && n < l.next
+}
+
+func (l *eventLog) append(e streamEvent) {
+	l.mu.Lock()
+	e.seq = l.next
+	l.next++
+	l.events = append(l.events, e)
+	l.size += len(e.payload)
+	for len(l.events) > eventLogSize || (l.size > eventLogBytes && len(l.events) > 1) {
+		l.size -= len(l.events[0].payload)
+		l.events[0] = streamEvent{}
+		l.events = l.events[1:]
+	}
+	for wake := range l.streams {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	l.mu.Unlock()
+}
+
+// since returns the events after seq. ok is false if some were already dropped.
+func (l *eventLog) since(seq uint64) (events []streamEvent, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) == 0 || l.events[len(l.events)-1].seq <= seq {
+		return nil, true
+	}
+	first := l.events[0].seq
+	if seq+1 < first {
+		return nil, false
+	}
+	return append([]streamEvent(nil), l.events[seq+1-first:]...), true
+}
+
+// head returns the seq of the last event, tail the seq before the oldest one kept
+func (l *eventLog) head() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next - 1
+}
+
+func (l *eventLog) tail() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) == 0 {
+		return l.next - 1
+	}
+	return l.events[0].seq - 1
+}
+
+// eventLog returns the log of a project, or nil if it has none
+func (m *Manager) eventLog(projectID string) *eventLog {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	return m.events[projectID]
+}
+
+// openStream registers a stream with the log of a project, creating the log
+// if needed. Events recorded from here on reach the stream.
+func (m *Manager) openStream(projectID string) (*eventLog, chan struct{}) {
+	wake := make(chan struct{}, 1)
+	m.eventsMu.Lock()
+	l := m.events[projectID]
+	if l == nil {
+		l = newEventLog()
+		m.events[projectID] = l
+	}
+	l.mu.Lock()
+	l.streams[wake] = true
+	l.mu.Unlock()
+	m.eventsMu.Unlock()
+	m.presenceChanged()
+	return l, wake
+}
+
+func (m *Manager) closeStream(l *eventLog, wake chan struct{}) {
+	l.mu.Lock()
+	delete(l.streams, wake)
+	if len(l.streams) == 0 {
+		l.idle = time.Now()
+	}
+	l.mu.Unlock()
+	m.presenceChanged()
+}
+
+// StartEventLogCleanup starts dropping the event logs no stream used for eventLogIdleTTL
+func (m *Manager) StartEventLogCleanup() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.dropIdleLogs(time.Now())
+		}
+	}()
+}
+
+func (m *Manager) dropIdleLogs(now time.Time) {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	for projectID, l := range m.events {
+		l.mu.Lock()
+		if len(l.streams) == 0 && now.Sub(l.idle) >= eventLogIdleTTL {
+			delete(m.events, projectID)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// recordEvent keeps an encoded broadcast for the project's streams
+func (m *Manager) recordEvent(projectID string, data []byte) {
+	l := m.eventLog(projectID)
+	if l == nil {
+		return
+	}
+	var msg struct {
+		Type    protocol.EventType `json:"type"`
+		Payload json.RawMessage    `json:"payload"`
+	}
+	if json.Unmarshal(data, &msg) != nil {
+		return
+	}
+	switch msg.Type {
+	case protocol.EventTypeLogChunk, protocol.EventTypeJobUpdate, protocol.EventTypeAIStageUpdate:
+	default:
+		return
+	}
+	var payload struct {
+		JobID  string `json:"job_id"`
+		Chunk  string `json:"chunk"`
+		Offset *int64 `json:"offset"`
+	}
+	json.Unmarshal(msg.Payload, &payload)
+	e := streamEvent{typ: msg.Type, jobID: payload.JobID, payload: msg.Payload}
+	if payload.Offset != nil {
+		e.logEnd = *payload.Offset + int64(len(payload.Chunk))
+	}
+	l.append(e)
+}
+
+// streamCount returns the number of open event streams of each project
+func (m *Manager) streamCount() map[string]int {
+	m.eventsMu.Lock()
+	logs := make(map[string]*eventLog, len(m.events))
+	for projectID, l := range m.events {
+		logs[projectID] = l
+	}
+	m.eventsMu.Unlock()
+
+	counts := make(map[string]int)
+	for projectID, l := range logs {
+		l.mu.Lock()
+		if n := len(l.streams); n > 0 {
+			counts[projectID] = n
+		}
+		l.mu.Unlock()
+	}
+	return counts
+}
+
+// ServeEvents streams the events of a project, or of one of its jobs if jobID
+// is set, as Server-Sent Events until the client goes away. finished returns
+// the final update of a job that is already over: the stream then ends after
+// the stored log. It is called once the stream is registered, so an update
+// that comes in meanwhile is never missed. A job stream also ends after the
+// job's final JOB_UPDATE.
+func (m *Manager) ServeEvents(c *gin.Context, projectID string, jobID string, finished func() *protocol.JobUpdatePayload) {
+	l, wake := m.openStream(projectID)
+	defer m.closeStream(l, wake)
+	var final *protocol.JobUpdatePayload
+	if finished != nil {
+		final = finished()
+	}
+
+	// sse.Encode doesn't set it, and EventSource rejects a sniffed text/plain
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // Don't let nginx buffer the stream
+	c.Status(http.StatusOK)
+	w := c.Writer
+	write := func(id string, t protocol.EventType, payload []byte) bool {
+		err := sse.Encode(w, sse.Event{Id: id, Event: string(t), Data: payload})
+		w.Flush()
+		return err == nil
+	}
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetryMillis)
+	w.Flush()
+
+	seq, resumed := l.parseID(c.GetHeader("Last-Event-ID"))
+	if resumed {
+		_, resumed = l.since(seq)
+	}
+	if !resumed {
+		// A project stream starts with what comes next, a job stream with
+		// whatever is still kept of the job
+		seq = l.head()
+		if jobID != "" {
+			seq = l.tail()
+		}
+	}
+
+	// A job stream that can't resume starts with the job's stored log; the
+	// events it already covers are skipped below
+	var logEnd int64
+	if jobID != "" && !resumed && m.ReplayLogs != nil {
+		err := m.ReplayLogs(projectID, jobID, 0, func(chunk protocol.LogChunkPayload) error {
+			data, err := json.Marshal(chunk)
+			if err != nil {
+				return err
+			}
+			logEnd = *chunk.Offset + int64(len(chunk.Chunk))
+			// No ID: a stream that breaks off here replays the log again
+			if !write("", protocol.EventTypeLogChunk, data) {
+				return errConnClosed
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	if final != nil {
+		data, _ := json.Marshal(final)
+		write("", protocol.EventTypeJobUpdate, data)
+		return
+	}
+
+	ping := time.NewTicker(eventPingPeriod)
+	defer ping.Stop()
+	for {
+		events, ok := l.since(seq)
+		if !ok {
+			// Fell too far behind; the client reconnects and resumes as far as it can
+			return
+		}
+		for _, e := range events {
+			seq = e.seq
+			if jobID != "" && e.jobID != jobID {
+				continue
+			}
+			if e.typ == protocol.EventTypeLogChunk && e.logEnd > 0 && e.logEnd <= logEnd {
+				continue
+			}
+			if !write(l.id(e.seq), e.typ, e.payload) {
+				return
+			}
+			if jobID != "" && e.typ == protocol.EventTypeJobUpdate && isFinalUpdate(e.payload) {
+				return
+			}
+		}
+
+		select {
+		case <-wake:
+		case <-ping.C:
+			if _, err := w.WriteString(": ping\n\n"); err != nil {
+				return
+			}
+			w.Flush()
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+func isFinalUpdate(payload []byte) bool {
+	var update protocol.JobUpdatePayload
+	if json.Unmarshal(payload, &update) != nil {
+		return false
+	}
+	switch update.Status {
+	case protocol.JobStatusCompleted, protocol.JobStatusFailed, protocol.JobStatusCancelled:
+		return true
+	}
+	return false
+}
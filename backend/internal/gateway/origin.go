@@ -0,0 +1,40 @@
+package gateway
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Browser origins allowed to open sockets and call the API, set once at startup
+var (
+	allowedOrigins = make(map[string]bool)
+	allowAnyOrigin bool
+)
+
+// SetAllowedOrigins sets the origins ("https://app.example.com") browsers may
+// connect from; "*" allows any origin
+func SetAllowedOrigins(origins []string) {
+	for _, origin := range origins {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		switch origin {
+		case "":
+		case "*":
+			allowAnyOrigin = true
+		default:
+			allowedOrigins[strings.ToLower(origin)] = true
+		}
+	}
+}
+
+// OriginAllowed reports whether the request may be served to its origin.
+// Requests without an Origin header don't come from a browser page (agents,
+// curl), and pages of the backend itself (/preview) are always allowed.
+func OriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || allowAnyOrigin || allowedOrigins[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,114 @@
+package gateway
+
+import (
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// Relay connects the gateways of several backend instances, so a REST call or a
+// broadcast reaches the sockets held by another instance. Preview tunnels are
+// not relayed: /preview must be routed to the instance holding the agent.
+type Relay interface {
+	// Broadcast forwards a client message, already encoded, to the other instances
+	Broadcast(projectID string, data []byte, logJobID string)
+	// DispatchJob hands a job no local agent can run to an instance with an agent that can
+	DispatchJob(projectID string, cmd protocol.CommandPayload) bool
+	// DisconnectAgent drops an agent wherever it is connected, and fails if
+	// the other instances could not be told
+	DisconnectAgent(agentID string, reason string) error
+	// AgentStatus returns the state of an agent connected to another instance
+	AgentStatus(agentID string) (AgentStatus, bool)
+	// PresenceChanged is called when an agent or client connects or disconnects
+	PresenceChanged()
+}
+
+// AgentPresence is what other instances know about a connected agent
+type AgentPresence struct {
+	AgentID    string   `json:"agent_id,omitempty"`
+	Labels     []string `json:"labels,omitempty"`
+	Services   []string `json:"services,omitempty"`
+	ActiveJobs int      `json:"active_jobs"`
+}
+
+// ProjectPresence is what other instances know about the sockets of a project
+type ProjectPresence struct {
+	Agents  []AgentPresence `json:"agents"`
+	Clients int             `json:"clients"`
+}
+
+// Presence returns the sockets connected to this instance, by project
+func (m *Manager) Presence() map[string]ProjectPresence {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	presence := make(map[string]ProjectPresence)
+	for projectID, agents := range m.agents {
+		p := presence[projectID]
+		for _, a := range agents {
+			services := make([]string, 0, len(a.services))
+			for name := range a.services {
+				services = append(services, name)
+			}
+			p.Agents = append(p.Agents, AgentPresence{
+				AgentID:    a.agentID,
+				Labels:     a.labels,
+				Services:   services,
+				ActiveJobs: len(a.jobs),
+			})
+		}
+		presence[projectID] = p
+	}
+	for projectID, clients := range m.clients {
+		if len(clients) == 0 {
+			continue
+		}
+		p := presence[projectID]
+		p.Clients = len(clients)
+		presence[projectID] = p
+	}
+	// Event streams receive broadcasts too
+	for projectID, n := range m.streamCount() {
+		p := presence[projectID]
+		p.Clients += n
+		presence[projectID] = p
+	}
+	return presence
+}
+
+// RankAgent scores an agent of another instance for cmd the way pickAgent
+// does locally: ok is false if it can't run the job, lower scores win
+func RankAgent(a AgentPresence, cmd protocol.CommandPayload) (score int, ok bool) {
+	if !hasLabels(a.Labels, cmd.Labels) {
+		return 0, false
+	}
+	switch cmd.Type {
+	case protocol.CommandTypeServiceStop, protocol.CommandTypeServiceStatus:
+		for _, name := range a.Services {
+			if name != "" && name == cmd.Params["name"] {
+				return -1, true
+			}
+		}
+	}
+	return a.ActiveJobs, true
+}
+
+// DeliverLocal queues an encoded message for the clients and event streams of
+// the project connected to this instance
+func (m *Manager) DeliverLocal(projectID string, data []byte, logJobID string) {
+	m.recordEvent(projectID, data)
+
+	m.lock.RLock()
+	clients := m.clients[projectID]
+	m.lock.RUnlock()
+
+	for _, client := range clients {
+		if err := client.sendBroadcast(data, logJobID); err != nil {
+			logSendError("client", err)
+		}
+	}
+}
+
+func (m *Manager) presenceChanged() {
+	if m.Relay != nil {
+		m.Relay.PresenceChanged()
+	}
+}
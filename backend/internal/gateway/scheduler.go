@@ -0,0 +1,283 @@
+package gateway
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// A project can have several agents. Each job goes to the least loaded agent
+// that has all of the job's labels. When an agent disconnects, the jobs it had
+// not received yet are handed to another agent (or wait for one, see
+// OnJobUnassigned); the ones it received fail, it may still be running them.
+
+// assignedJob is a job dispatched to an agent that hasn't finished yet
+type assignedJob struct {
+	cmd          protocol.CommandPayload
+	dispatchedAt time.Time
+	sentAt       time.Time // Last time the COMMAND was sent, see resendUnacked
+	sends        int       // COMMANDs sent to the current connection
+	acked        bool      // The agent acknowledged the COMMAND, so the job can't move to another agent
+	started      bool      // The agent reported progress, which also means it got the COMMAND
+}
+
+// AgentStatus is the live state of an agent, for the agents API
+type AgentStatus struct {
+	Online     bool
+	Labels     []string
+	ActiveJobs int
+}
+
+// DispatchJob sends a job to an agent of the project, picked by labels and load,
+// on this instance or through the Relay on another one. It returns false if no
+// connected agent can run the job.
+func (m *Manager) DispatchJob(projectID string, cmd protocol.CommandPayload) bool {
+	if m.DispatchLocal(projectID, cmd) {
+		return true
+	}
+	return m.Relay != nil && m.Relay.DispatchJob(projectID, cmd)
+}
+
+// DispatchLocal is DispatchJob for the agents connected to this instance
+func (m *Manager) DispatchLocal(projectID string, cmd protocol.CommandPayload) bool {
+	m.lock.Lock()
+	agent := m.pickAgent(projectID, cmd)
+	if agent == nil {
+		m.lock.Unlock()
+		return false
+	}
+	now := time.Now()
+	agent.jobs[cmd.JobID] = &assignedJob{cmd: cmd, dispatchedAt: now, sentAt: now, sends: 1}
+	agent.lastAssigned = now
+	m.lock.Unlock()
+
+	// On failure the agent is unregistered, which hands the job to another agent
+	m.sendToAgent(projectID, agent, protocol.EventTypeCommand, cmd)
+	return true
+}
+
+// pickAgent returns the agent to run cmd, or nil. Service commands go to the
+// agent running the service. Called with lock held.
+func (m *Manager) pickAgent(projectID string, cmd protocol.CommandPayload) *agentConn {
+	var candidates []*agentConn
+	for _, a := range m.agents[projectID] {
+		if hasLabels(a.labels, cmd.Labels) {
+			candidates = append(candidates, a)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch cmd.Type {
+	case protocol.CommandTypeServiceStop, protocol.CommandTypeServiceStatus:
+		for _, a := range candidates {
+			if _, ok := a.services[cmd.Params["name"]]; ok {
+				return a
+			}
+		}
+	}
+
+	// Least loaded, then least recently assigned (round robin among idle agents)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if len(a.jobs) != len(b.jobs) {
+			return len(a.jobs) < len(b.jobs)
+		}
+		return a.lastAssigned.Before(b.lastAssigned)
+	})
+	return candidates[0]
+}
+
+func hasLabels(have []string, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// trackAgentMessage updates an agent's load and services from a message it sent
+func (m *Manager) trackAgentMessage(agent *agentConn, payload protocol.Payload) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	switch p := payload.(type) {
+	case *protocol.CommandAckPayload:
+		if job, ok := agent.jobs[p.JobID]; ok {
+			job.acked = true
+		}
+
+	case *protocol.JobCreatedPayload:
+		// Started by the agent itself (watch mode), it still counts towards its load
+		agent.jobs[p.JobID] = &assignedJob{
+			cmd:          protocol.CommandPayload{JobID: p.JobID, Type: p.Type, Command: p.Command},
+			dispatchedAt: time.Now(),
+			started:      true,
+		}
+
+	case *protocol.JobUpdatePayload:
+		switch p.Status {
+		case protocol.JobStatusCompleted, protocol.JobStatusFailed, protocol.JobStatusCancelled:
+			delete(agent.jobs, p.JobID)
+		default:
+			agent.markStarted(p.JobID)
+		}
+
+	case *protocol.ServiceStatusPayload:
+		switch p.Status {
+		case protocol.ServiceStatusStopped, protocol.ServiceStatusFailed:
+			delete(agent.services, p.Name)
+		default:
+			agent.services[p.Name] = p.UpdatedAt
+		}
+
+	case *protocol.LogChunkPayload:
+		agent.markStarted(p.JobID)
+	case *protocol.StepUpdatePayload:
+		agent.markStarted(p.JobID)
+	case *protocol.AIStagePayload:
+		agent.markStarted(p.JobID)
+	case *protocol.TestResultsPayload:
+		agent.markStarted(p.JobID)
+	case *protocol.ResourceSample:
+		agent.markStarted(p.JobID)
+	}
+}
+
+func (a *agentConn) markStarted(jobID string) {
+	if job, ok := a.jobs[jobID]; ok {
+		job.started = true
+		job.acked = true
+	}
+}
+
+// reassignJobs hands the jobs a removed agent didn't receive to other agents, in
+// the order they were dispatched, and reports the ones it received as FAILED
+func (m *Manager) reassignJobs(projectID string, jobs map[string]*assignedJob, reason string) {
+	pending := make([]*assignedJob, 0, len(jobs))
+	for _, job := range jobs {
+		pending = append(pending, job)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].dispatchedAt.Before(pending[j].dispatchedAt) })
+
+	for _, job := range pending {
+		if job.started || job.acked {
+			m.failJob(projectID, job.cmd.JobID, reason)
+			continue
+		}
+		if m.DispatchJob(projectID, job.cmd) {
+			log.Printf("Job %s handed to another agent of Project %s (%s)", job.cmd.JobID, projectID, reason)
+			continue
+		}
+		m.Unassigned(projectID, job.cmd, reason)
+	}
+}
+
+// Unassigned queues a job no agent could take again (see OnJobUnassigned), or fails it
+func (m *Manager) Unassigned(projectID string, cmd protocol.CommandPayload, reason string) {
+	if m.OnJobUnassigned != nil {
+		log.Printf("Job %s of Project %s is queued again (%s)", cmd.JobID, projectID, reason)
+		m.OnJobUnassigned(projectID, cmd)
+		return
+	}
+	m.failJob(projectID, cmd.JobID, reason+", no other agent can run the job")
+}
+
+// failJob reports a job as FAILED on behalf of an agent that is gone, to
+// OnJobUpdate, clients and OnAgentMessage alike
+func (m *Manager) failJob(projectID string, jobID string, reason string) {
+	log.Printf("Job %s of Project %s failed: %s", jobID, projectID, reason)
+	update := protocol.JobUpdatePayload{JobID: jobID, Status: protocol.JobStatusFailed, Error: reason}
+	if m.OnJobUpdate != nil && !m.OnJobUpdate(projectID, &update) {
+		return
+	}
+	msg, err := protocol.NewMessage(protocol.EventTypeJobUpdate, update)
+	if err != nil {
+		return
+	}
+	m.BroadcastToClients(projectID, msg)
+	if m.OnAgentMessage != nil {
+		m.OnAgentMessage(projectID, msg, &update)
+	}
+}
+
+// stopServices reports the services of an agent that is gone as STOPPED, to
+// clients and OnAgentMessage alike, so no one waits for a dev server that no
+// longer runs
+func (m *Manager) stopServices(projectID string, services map[string]int64, reason string) {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now().UnixMilli()
+	for _, name := range names {
+		// Newer than the agent's last report, whatever its clock says
+		updatedAt := now
+		if last := services[name]; last >= updatedAt {
+			updatedAt = last + 1
+		}
+		status := protocol.ServiceStatusPayload{Name: name, Status: protocol.ServiceStatusStopped, Error: reason, UpdatedAt: updatedAt}
+		msg, err := protocol.NewMessage(protocol.EventTypeServiceStatus, status)
+		if err != nil {
+			continue
+		}
+		m.BroadcastToClients(projectID, msg)
+		if m.OnAgentMessage != nil {
+			m.OnAgentMessage(projectID, msg, &status)
+		}
+	}
+}
+
+// previewAgent returns the agent preview requests are tunnelled to: one running
+// a service if there is one (its dev server), else the first agent
+func (m *Manager) previewAgent(projectID string) *agentConn {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	agents := m.agents[projectID]
+	for _, a := range agents {
+		if len(a.services) > 0 {
+			return a
+		}
+	}
+	if len(agents) > 0 {
+		return agents[0]
+	}
+	return nil
+}
+
+// AgentStatus returns the live state of an agent (by agents table ID), which
+// may be connected to another instance
+func (m *Manager) AgentStatus(agentID string) AgentStatus {
+	m.lock.RLock()
+	for _, agents := range m.agents {
+		for _, a := range agents {
+			if agentID != "" && a.agentID == agentID {
+				status := AgentStatus{Online: true, Labels: a.labels, ActiveJobs: len(a.jobs)}
+				m.lock.RUnlock()
+				return status
+			}
+		}
+	}
+	m.lock.RUnlock()
+
+	if m.Relay != nil && agentID != "" {
+		if status, ok := m.Relay.AgentStatus(agentID); ok {
+			return status
+		}
+	}
+	return AgentStatus{}
+}
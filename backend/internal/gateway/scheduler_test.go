@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+// testAgent is an agent without a socket, for the scheduling state only
+func testAgent(id string, labels []string, jobs int, services ...string) *agentConn {
+	a := &agentConn{
+		peerConn: &peerConn{out: make(chan outboundFrame, sendQueueSize), done: make(chan struct{})},
+		agentID:  id,
+		labels:   labels,
+		jobs:     make(map[string]*assignedJob),
+		services: make(map[string]int64),
+	}
+	for i := 0; i < jobs; i++ {
+		a.jobs[string(rune('a'+i))] = &assignedJob{}
+	}
+	for _, name := range services {
+		a.services[name] = 1
+	}
+	return a
+}
+
+func TestPickAgent(t *testing.T) {
+	base := time.Now()
+	idle := testAgent("idle", nil, 0)
+	idle.lastAssigned = base
+	idleLater := testAgent("idle-later", nil, 0)
+	idleLater.lastAssigned = base.Add(time.Second)
+	busy := testAgent("busy", []string{"gpu", "linux"}, 2, "web")
+	linux := testAgent("linux", []string{"linux"}, 1)
+
+	tests := []struct {
+		name   string
+		agents []*agentConn
+		cmd    protocol.CommandPayload
+		want   string // Agent ID, empty for none
+	}{
+		{"no agents", nil, protocol.CommandPayload{Type: "BUILD"}, ""},
+		{"least loaded", []*agentConn{busy, linux, idleLater}, protocol.CommandPayload{Type: "BUILD"}, "idle-later"},
+		{"least recently assigned among idle", []*agentConn{idleLater, idle}, protocol.CommandPayload{Type: "BUILD"}, "idle"},
+		{"labels filter", []*agentConn{idle, busy, linux}, protocol.CommandPayload{Type: "BUILD", Labels: []string{"linux"}}, "linux"},
+		{"all labels required", []*agentConn{idle, busy, linux}, protocol.CommandPayload{Type: "BUILD", Labels: []string{"linux", "gpu"}}, "busy"},
+		{"no agent has the labels", []*agentConn{idle, linux}, protocol.CommandPayload{Type: "BUILD", Labels: []string{"gpu"}}, ""},
+		{
+			"service stop goes to the agent running it",
+			[]*agentConn{idle, busy},
+			protocol.CommandPayload{Type: protocol.CommandTypeServiceStop, Params: map[string]string{"name": "web"}},
+			"busy",
+		},
+		{
+			"service status of an unknown service",
+			[]*agentConn{busy, idle},
+			protocol.CommandPayload{Type: protocol.CommandTypeServiceStatus, Params: map[string]string{"name": "api"}},
+			"idle",
+		},
+		{
+			"service start is load balanced",
+			[]*agentConn{busy, idle},
+			protocol.CommandPayload{Type: protocol.CommandTypeServiceStart, Params: map[string]string{"name": "web"}},
+			"idle",
+		},
+	}
+	for _, tt := range tests {
+		m := &Manager{agents: map[string][]*agentConn{"p": tt.agents}}
+		got := ""
+		if a := m.pickAgent("p", tt.cmd); a != nil {
+			got = a.agentID
+		}
+		if got != tt.want {
+			t.Errorf("%s: picked %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/rohaaaaaan/devair-protocol"
+)
+
+const (
+	tunnelResponseTimeout = 30 * time.Second
+	tunnelChunkSize       = 32 * 1024
+	// Frames buffered per stream before a slow browser aborts the stream
+	// (the agent read loop must never block on one request)
+	tunnelFrameBuffer = 256
+)
+
+// Headers that apply to a single connection and must not be forwarded (RFC 7230 6.1)
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// SessionCookie carries the login session of /preview requests. Like the
+// Authorization header it is never forwarded: the dev server runs whatever
+// code the project contains, and a session reaches every project of the user.
+const SessionCookie = "devair_session"
+
+// Headers the agent's WebSocket dialer sets itself
+var webSocketHandshakeHeaders = []string{
+	"Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Accept",
+}
+
+// tunnelStream is one proxied HTTP request or WebSocket connection
+type tunnelStream struct {
+	id        string
+	projectID string
+	agent     *agentConn // Every frame of a stream goes through the same agent
+	response  chan protocol.TunnelResponsePayload
+	frames    chan protocol.Payload // TUNNEL_DATA and TUNNEL_WS_MESSAGE from the agent
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func (s *tunnelStream) abort(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// tunnelRegistry routes tunnel frames from agents to the HTTP handlers waiting for them
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*tunnelStream
+}
+
+var tunnels = &tunnelRegistry{
+	streams: make(map[string]*tunnelStream),
+}
+
+// open starts a stream through the project's preview agent, or returns nil if
+// the project has no agent
+func (t *tunnelRegistry) open(projectID string) *tunnelStream {
+	agent := GlobalManager.previewAgent(projectID)
+	if agent == nil {
+		return nil
+	}
+
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+
+	stream := &tunnelStream{
+		id:        hex.EncodeToString(idBytes),
+		projectID: projectID,
+		agent:     agent,
+		response:  make(chan protocol.TunnelResponsePayload, 1),
+		frames:    make(chan protocol.Payload, tunnelFrameBuffer),
+		done:      make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	t.streams[stream.id] = stream
+	t.mu.Unlock()
+	return stream
+}
+
+func (t *tunnelRegistry) remove(stream *tunnelStream) {
+	t.mu.Lock()
+	delete(t.streams, stream.id)
+	t.mu.Unlock()
+	stream.abort(nil)
+}
+
+// closeAgent aborts every stream through an agent (it went away)
+func (t *tunnelRegistry) closeAgent(agent *agentConn, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, stream := range t.streams {
+		if stream.agent == agent {
+			stream.abort(errors.New(reason))
+		}
+	}
+}
+
+// dispatch hands a tunnel frame from an agent to its stream.
+// It returns false if payload is not a tunnel frame.
+func (t *tunnelRegistry) dispatch(agent *agentConn, payload protocol.Payload) bool {
+	var streamID string
+	switch p := payload.(type) {
+	case *protocol.TunnelResponsePayload:
+		streamID = p.StreamID
+	case *protocol.TunnelDataPayload:
+		streamID = p.StreamID
+	case *protocol.TunnelWSMessagePayload:
+		streamID = p.StreamID
+	case *protocol.TunnelClosePayload:
+		streamID = p.StreamID
+	default:
+		return false
+	}
+
+	t.mu.Lock()
+	stream, ok := t.streams[streamID]
+	t.mu.Unlock()
+	// Agents may only answer their own streams
+	if !ok || stream.agent != agent {
+		return true
+	}
+
+	switch p := payload.(type) {
+	case *protocol.TunnelClosePayload:
+		reason := p.Error
+		if reason == "" {
+			reason = "closed by agent"
+		}
+		stream.abort(errors.New(reason))
+		return true
+
+	case *protocol.TunnelResponsePayload:
+		select {
+		case stream.response <- *p:
+		default:
+		}
+		return true
+	}
+
+	select {
+	case stream.frames <- payload:
+	default:
+		stream.abort(errors.New("client too slow"))
+		stream.sendClose("client too slow")
+	}
+	return true
+}
+
+func (s *tunnelStream) send(t protocol.EventType, payload interface{}) bool {
+	return GlobalManager.sendToAgent(s.projectID, s.agent, t, payload)
+}
+
+func (s *tunnelStream) sendClose(reason string) {
+	s.send(protocol.EventTypeTunnelClose, protocol.TunnelClosePayload{StreamID: s.id, Error: reason})
+}
+
+// HandlePreview proxies /preview/:projectID/*path to the dev server on the
+// project's agent machine, over the agent's WebSocket.
+func HandlePreview(c *gin.Context) {
+	projectID := c.Param("projectID")
+	path := c.Param("path")
+	if path == "" {
+		path = "/"
+	}
+	if c.Request.URL.RawQuery != "" {
+		path += "?" + c.Request.URL.RawQuery
+	}
+
+	headers := forwardHeaders(c.Request, "/preview/"+projectID)
+
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		proxyWebSocket(c, projectID, path, headers)
+		return
+	}
+	proxyHTTP(c, projectID, path, headers)
+}
+
+func proxyHTTP(c *gin.Context, projectID string, path string, headers http.Header) {
+	stream := tunnels.open(projectID)
+	if stream == nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "No agent connected for this project"})
+		return
+	}
+	defer tunnels.remove(stream)
+
+	sent := stream.send(protocol.EventTypeTunnelRequest, protocol.TunnelRequestPayload{
+		StreamID: stream.id,
+		Method:   c.Request.Method,
+		Path:     path,
+		Headers:  headers,
+	})
+	if !sent {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Agent connection lost"})
+		return
+	}
+
+	go streamRequestBody(stream, c.Request.Body)
+
+	var resp protocol.TunnelResponsePayload
+	select {
+	case resp = <-stream.response:
+	case <-stream.done:
+		c.JSON(http.StatusBadGateway, gin.H{"error": streamError(stream)})
+		return
+	case <-c.Request.Context().Done():
+		stream.sendClose("client gone")
+		return
+	case <-time.After(tunnelResponseTimeout):
+		stream.sendClose("timeout")
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Dev server did not respond"})
+		return
+	}
+
+	for key, values := range resp.Headers {
+		if isHopByHop(key) {
+			continue
+		}
+		for _, v := range values {
+			c.Writer.Header().Add(key, v)
+		}
+	}
+	c.Writer.WriteHeader(resp.Status)
+	c.Writer.Flush()
+
+	for {
+		select {
+		case frame := <-stream.frames:
+			data, ok := frame.(*protocol.TunnelDataPayload)
+			if !ok {
+				continue
+			}
+			if len(data.Data) > 0 {
+				if _, err := c.Writer.Write(data.Data); err != nil {
+					stream.sendClose("client gone")
+					return
+				}
+				c.Writer.Flush()
+			}
+			if data.EOF {
+				return
+			}
+		case <-stream.done:
+			// Headers are already out, all we can do is cut the body short
+			return
+		case <-c.Request.Context().Done():
+			stream.sendClose("client gone")
+			return
+		}
+	}
+}
+
+// streamRequestBody forwards the request body to the agent in chunks
+func streamRequestBody(stream *tunnelStream, body io.Reader) {
+	buf := make([]byte, tunnelChunkSize)
+	for {
+		n, err := body.Read(buf)
+		select {
+		case <-stream.done:
+			return
+		default:
+		}
+
+		frame := protocol.TunnelDataPayload{StreamID: stream.id}
+		if n > 0 {
+			frame.Data = append([]byte(nil), buf[:n]...)
+		}
+		if err == io.EOF {
+			frame.EOF = true
+		} else if err != nil {
+			stream.sendClose("request body: " + err.Error())
+			return
+		}
+
+		if n > 0 || frame.EOF {
+			stream.send(protocol.EventTypeTunnelData, frame)
+		}
+		if frame.EOF {
+			return
+		}
+	}
+}
+
+// proxyWebSocket connects a browser WebSocket (e.g. Vite HMR) to the dev server through the agent
+func proxyWebSocket(c *gin.Context, projectID string, path string, headers http.Header) {
+	stream := tunnels.open(projectID)
+	if stream == nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "No agent connected for this project"})
+		return
+	}
+	defer tunnels.remove(stream)
+
+	sent := stream.send(protocol.EventTypeTunnelRequest, protocol.TunnelRequestPayload{
+		StreamID:  stream.id,
+		Method:    http.MethodGet,
+		Path:      path,
+		Headers:   headers,
+		WebSocket: true,
+	})
+	if !sent {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Agent connection lost"})
+		return
+	}
+
+	// Only accept the browser's upgrade once the agent reached the dev server
+	var resp protocol.TunnelResponsePayload
+	select {
+	case resp = <-stream.response:
+	case <-stream.done:
+		c.JSON(http.StatusBadGateway, gin.H{"error": streamError(stream)})
+		return
+	case <-time.After(tunnelResponseTimeout):
+		stream.sendClose("timeout")
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Dev server did not respond"})
+		return
+	}
+	if resp.Status != http.StatusSwitchingProtocols {
+		stream.sendClose("")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Dev server refused the WebSocket connection"})
+		return
+	}
+
+	responseHeader := http.Header{}
+	if protocol := http.Header(resp.Headers).Get("Sec-Websocket-Protocol"); protocol != "" {
+		responseHeader.Set("Sec-Websocket-Protocol", protocol)
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
+	if err != nil {
+		log.Printf("Failed to upgrade preview websocket: %v", err)
+		stream.sendClose("upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	// Browser -> agent
+	go func() {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				stream.abort(err)
+				stream.sendClose("")
+				return
+			}
+			stream.send(protocol.EventTypeTunnelWSMessage, protocol.TunnelWSMessagePayload{
+				StreamID:    stream.id,
+				MessageType: messageType,
+				Data:        data,
+			})
+		}
+	}()
+
+	// Agent -> browser (this goroutine is the only writer)
+	for {
+		select {
+		case frame := <-stream.frames:
+			msg, ok := frame.(*protocol.TunnelWSMessagePayload)
+			if !ok {
+				continue
+			}
+			if err := conn.WriteMessage(msg.MessageType, msg.Data); err != nil {
+				stream.sendClose("")
+				return
+			}
+		case <-stream.done:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
+		}
+	}
+}
+
+// forwardHeaders copies the end-to-end request headers, minus the backend's
+// credentials, and adds X-Forwarded-*
+func forwardHeaders(r *http.Request, prefix string) http.Header {
+	headers := http.Header{}
+	for key, values := range r.Header {
+		if isHopByHop(key) {
+			continue
+		}
+		headers[key] = append([]string(nil), values...)
+	}
+	for _, key := range webSocketHandshakeHeaders {
+		headers.Del(key)
+	}
+	headers.Del("Authorization")
+	headers.Del("Cookie")
+	if cookies := withoutCookie(r.Header.Values("Cookie"), SessionCookie); cookies != "" {
+		headers.Set("Cookie", cookies)
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	headers.Set("X-Forwarded-Host", r.Host)
+	headers.Set("X-Forwarded-Proto", proto)
+	headers.Set("X-Forwarded-Prefix", prefix)
+	if ip := clientIP(r); ip != "" {
+		headers.Set("X-Forwarded-For", ip)
+	}
+	return headers
+}
+
+// withoutCookie joins Cookie header values into one, leaving out the named cookie
+func withoutCookie(values []string, name string) string {
+	var kept []string
+	for _, value := range values {
+		for _, pair := range strings.Split(value, ";") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			if n, _, _ := strings.Cut(pair, "="); strings.TrimSpace(n) == name {
+				continue
+			}
+			kept = append(kept, pair)
+		}
+	}
+	return strings.Join(kept, "; ")
+}
+
+func isHopByHop(key string) bool {
+	for _, h := range hopByHopHeaders {
+		if strings.EqualFold(key, h) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIP(r *http.Request) string {
+	host := r.RemoteAddr
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	return strings.Trim(host, "[]")
+}
+
+func streamError(stream *tunnelStream) string {
+	if stream.err != nil {
+		return stream.err.Error()
+	}
+	return "Tunnel closed"
+}
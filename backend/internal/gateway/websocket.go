@@ -2,101 +2,346 @@ package gateway
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
-	"net/http"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"github.com/rohaaaaaan/devair-backend/internal/models"
+	"github.com/rohaaaaaan/devair-protocol"
 )
 
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for dev
-	},
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true, // permessage-deflate, if the peer offers it
+	CheckOrigin:       OriginAllowed,
 }
 
 // Manager tracks connections
 type Manager struct {
-	agents  map[string]*websocket.Conn
-	clients map[string][]*websocket.Conn // ProjectID -> List of Clients
+	agents  map[string][]*agentConn  // ProjectID -> Connected agents
+	clients map[string][]*clientConn // ProjectID -> List of Clients
 	lock    sync.RWMutex
+
+	// OnAgentMessage, if set, receives every valid message an agent sends (e.g. to persist results)
+	// together with its decoded payload
+	OnAgentMessage func(projectID string, msg protocol.WSMessage, payload protocol.Payload)
+
+	// OnJobUpdate, if set, applies a JOB_UPDATE before it is pushed to clients (e.g. to
+	// persist it). Updates it returns false for (illegal transitions) are dropped.
+	OnJobUpdate func(projectID string, update *protocol.JobUpdatePayload) bool
+
+	// OnLogChunk, if set, stores a LOG_CHUNK before it is pushed to clients and sets its Offset
+	OnLogChunk func(projectID string, chunk *protocol.LogChunkPayload)
+
+	// ReplayLogs, if set, answers LOG_SUBSCRIBE by calling send with the stored log of
+	// a job of the project from offset on
+	ReplayLogs func(projectID string, jobID string, offset int64, send func(protocol.LogChunkPayload) error) error
+
+	// OnClientCommand, if set, creates and dispatches the job of a client's COMMAND_REQUEST.
+	// It calls created with the job ID before the job is dispatched. Errors with a
+	// RetryAfter method are reported as RATE_LIMITED.
+	OnClientCommand func(projectID string, userID string, cmd protocol.CommandPayload, created func(jobID string)) error
+
+	// AuthorizeCommand, if set, checks that the user of a client may send COMMAND_REQUESTs
+	AuthorizeCommand func(projectID string, userID string) error
+
+	// OnAgentConnected, if set, is called once an agent is registered (e.g. to send it queued jobs)
+	OnAgentConnected func(projectID string)
+
+	// OnJobUnassigned, if set, receives the jobs a disconnected agent never received that no
+	// other agent can run, so they can wait for one. If nil, those jobs fail.
+	OnJobUnassigned func(projectID string, cmd protocol.CommandPayload)
+
+	// AuthenticateAgent checks the token an agent sent in IDENTIFY and returns its agent ID.
+	// If nil, agents are not authenticated (local development only).
+	AuthenticateAgent func(projectID string, token string) (string, error)
+
+	// AuthenticateClient checks the session token a browser sent in IDENTIFY and returns
+	// its user ID. If nil, clients are not authenticated (local development only).
+	AuthenticateClient func(projectID string, token string) (string, error)
+
+	// Relay, if set, reaches the sockets of other backend instances (see internal/cluster)
+	Relay Relay
+
+	events   map[string]*eventLog // ProjectID -> Recent events for Server-Sent Events
+	eventsMu sync.Mutex
 }
 
 var GlobalManager = &Manager{
-	agents:  make(map[string]*websocket.Conn),
-	clients: make(map[string][]*websocket.Conn),
+	agents:  make(map[string][]*agentConn),
+	clients: make(map[string][]*clientConn),
+	events:  make(map[string]*eventLog),
 }
 
-func (m *Manager) Register(projectID string, conn *websocket.Conn, role string) {
+func (m *Manager) RegisterClient(projectID string, client *clientConn) {
 	m.lock.Lock()
-	defer m.lock.Unlock()
+	m.clients[projectID] = append(m.clients[projectID], client)
+	m.lock.Unlock()
 
-	if role == models.RoleClient {
-		m.clients[projectID] = append(m.clients[projectID], conn)
-		log.Printf("Client connected to Project: %s", projectID)
-	} else {
-		m.agents[projectID] = conn
-		log.Printf("Agent registered for Project: %s", projectID)
+	log.Printf("Client connected to Project: %s", projectID)
+	m.presenceChanged()
+}
+
+// RegisterAgent adds an agent to its project. An older connection of the same
+// agent (e.g. one that hasn't timed out yet) is dropped, and the COMMANDs it
+// didn't acknowledge are sent to the new one.
+func (m *Manager) RegisterAgent(projectID string, agent *agentConn) {
+	m.lock.Lock()
+	var replaced *agentConn
+	if agent.agentID != "" {
+		for _, a := range m.agents[projectID] {
+			if a.agentID == agent.agentID {
+				replaced = a
+			}
+		}
+	}
+	var resend []*assignedJob
+	if replaced != nil {
+		m.removeAgent(projectID, replaced)
+		resend = takeUnacked(replaced, agent, time.Now())
 	}
+	m.agents[projectID] = append(m.agents[projectID], agent)
+	connected := len(m.agents[projectID])
+	m.lock.Unlock()
+
+	log.Printf("Agent registered for Project: %s (%d connected, labels %v)", projectID, connected, agent.labels)
+	if replaced != nil {
+		m.agentGone(projectID, replaced, "agent reconnected")
+	}
+	if len(resend) > 0 {
+		log.Printf("Resending %d unacknowledged COMMAND(s) to the reconnected agent of Project %s", len(resend), projectID)
+		m.sendCommands(projectID, agent, resend)
+	}
+	m.presenceChanged()
 }
 
 func (m *Manager) Unregister(projectID string, conn *websocket.Conn) {
 	m.lock.Lock()
-	defer m.lock.Unlock()
 
 	// Check Agents
-	if current, ok := m.agents[projectID]; ok && current == conn {
-		conn.Close()
-		delete(m.agents, projectID)
-		log.Printf("Agent disconnected from Project: %s", projectID)
-		return
+	for _, a := range m.agents[projectID] {
+		if a.conn == conn {
+			m.removeAgent(projectID, a)
+			m.lock.Unlock()
+			log.Printf("Agent disconnected from Project: %s", projectID)
+			m.agentGone(projectID, a, "agent disconnected")
+			m.presenceChanged()
+			return
+		}
 	}
 
 	// Check Clients
-	if clients, ok := m.clients[projectID]; ok {
-		for i, c := range clients {
-			if c == conn {
-				conn.Close()
-				// Remove from slice
-				m.clients[projectID] = append(clients[:i], clients[i+1:]...)
-				log.Printf("Client disconnected from Project: %s", projectID)
-				return
+	clients := m.clients[projectID]
+	for i, c := range clients {
+		if c.conn == conn {
+			c.close()
+			// Remove from slice (without touching the array broadcasts may be iterating)
+			m.clients[projectID] = append(clients[:i:i], clients[i+1:]...)
+			if len(m.clients[projectID]) == 0 {
+				delete(m.clients, projectID)
 			}
+			m.lock.Unlock()
+			log.Printf("Client disconnected from Project: %s", projectID)
+			m.presenceChanged()
+			return
+		}
+	}
+	m.lock.Unlock()
+}
+
+// removeAgent takes an agent out of its project. Called with lock held.
+func (m *Manager) removeAgent(projectID string, agent *agentConn) {
+	agents := m.agents[projectID]
+	for i, a := range agents {
+		if a == agent {
+			m.agents[projectID] = append(agents[:i:i], agents[i+1:]...)
+			break
 		}
 	}
+	if len(m.agents[projectID]) == 0 {
+		delete(m.agents, projectID)
+	}
+}
+
+// agentGone cleans up after a removed agent: its socket, preview streams, jobs and services
+func (m *Manager) agentGone(projectID string, agent *agentConn, reason string) {
+	agent.close()
+	tunnels.closeAgent(agent, reason)
+
+	m.lock.Lock()
+	jobs := agent.jobs
+	agent.jobs = make(map[string]*assignedJob)
+	services := agent.services
+	agent.services = make(map[string]int64)
+	m.lock.Unlock()
+	m.reassignJobs(projectID, jobs, reason)
+	m.stopServices(projectID, services, reason)
+}
+
+// DisconnectAgent closes the connection of an agent whose token is no longer
+// valid, on whichever instance holds it
+func (m *Manager) DisconnectAgent(agentID string, reason string) error {
+	if agentID == "" {
+		return nil
+	}
+	m.DisconnectLocalAgent(agentID, reason)
+	if m.Relay != nil {
+		return m.Relay.DisconnectAgent(agentID, reason)
+	}
+	return nil
 }
 
-func (m *Manager) SendToAgent(projectID string, msg models.WSMessage) bool {
+// DisconnectLocalAgent is DisconnectAgent for the agents connected to this instance
+func (m *Manager) DisconnectLocalAgent(agentID string, reason string) {
 	m.lock.RLock()
-	conn, ok := m.agents[projectID]
+	var agent *agentConn
+	for _, agents := range m.agents {
+		for _, a := range agents {
+			if a.agentID == agentID {
+				agent = a
+			}
+		}
+	}
 	m.lock.RUnlock()
-
-	if !ok {
-		return false
+	if agent == nil {
+		return
 	}
 
-	if err := conn.WriteJSON(msg); err != nil {
-		log.Printf("Error sending to agent: %v", err)
-		m.Unregister(projectID, conn)
+	log.Printf("Disconnecting agent %s: %s", agentID, reason)
+	agent.send(protocol.EventTypeError, protocol.ErrorPayload{Code: protocol.ErrorCodeUnauthorized, Message: reason})
+	// The read loop of the connection unregisters it
+	agent.closeWith(protocol.CloseUnauthorized, reason)
+}
+
+// sendToAgent sends to one agent and drops it if the socket is broken
+func (m *Manager) sendToAgent(projectID string, agent *agentConn, t protocol.EventType, payload interface{}) bool {
+	if err := agent.send(t, payload); err != nil {
+		logSendError("agent", err)
+		m.Unregister(projectID, agent.conn)
 		return false
 	}
 	return true
 }
 
-func (m *Manager) BroadcastToClients(projectID string, msg models.WSMessage) {
+func (m *Manager) BroadcastToClients(projectID string, msg protocol.WSMessage) {
+	m.broadcast(projectID, msg, "")
+}
+
+// broadcast encodes msg once and queues it for every client of the project,
+// here and on the other instances. logJobID is the job of a LOG_CHUNK, see
+// clientConn.replay.
+func (m *Manager) broadcast(projectID string, msg protocol.WSMessage, logJobID string) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding %s for clients: %v", msg.Type, err)
+		return
+	}
+	m.DeliverLocal(projectID, data, logJobID)
+	if m.Relay != nil {
+		m.Relay.Broadcast(projectID, data, logJobID)
+	}
+}
+
+// sendError reports a malformed message back to the connection that sent it
+func (m *Manager) sendError(projectID string, conn *websocket.Conn, payload protocol.ErrorPayload) {
 	m.lock.RLock()
-	clients := m.clients[projectID]
+	var agent *agentConn
+	for _, a := range m.agents[projectID] {
+		if a.conn == conn {
+			agent = a
+		}
+	}
+	var client *clientConn
+	for _, c := range m.clients[projectID] {
+		if c.conn == conn {
+			client = c
+		}
+	}
 	m.lock.RUnlock()
 
-	for _, conn := range clients {
-		if err := conn.WriteJSON(msg); err != nil {
-			log.Printf("Error sending to client: %v", err)
+	if agent != nil {
+		agent.send(protocol.EventTypeError, payload)
+	} else if client != nil {
+		client.send(protocol.EventTypeError, payload)
+	}
+}
+
+// replayLogs answers LOG_SUBSCRIBE
+func (m *Manager) replayLogs(projectID string, client *clientConn, sub *protocol.LogSubscribePayload) {
+	fail := func(message string) {
+		client.send(protocol.EventTypeError, protocol.ErrorPayload{
+			Code:    protocol.ErrorCodeLogUnavailable,
+			Message: message,
+			Type:    protocol.EventTypeLogSubscribe,
+		})
+	}
+	if m.ReplayLogs == nil {
+		fail("logs are not stored")
+		return
+	}
+	err := client.replay(sub.JobID, func(send func(protocol.LogChunkPayload) error) error {
+		return m.ReplayLogs(projectID, sub.JobID, sub.Offset, send)
+	})
+	if err != nil && !errors.Is(err, errConnClosed) {
+		log.Printf("Error replaying log of job %s to client of Project %s: %v", sub.JobID, projectID, err)
+		fail(err.Error())
+	}
+}
+
+// submitCommand answers COMMAND_REQUEST. The ACK is queued before the job is
+// dispatched, so it reaches the client ahead of the job's events.
+func (m *Manager) submitCommand(projectID string, client *clientConn, req *protocol.CommandRequestPayload) {
+	if m.OnClientCommand == nil {
+		nack(client, req.RequestID, protocol.ErrorCodeCommandFailed, "commands are not accepted over the socket")
+		return
+	}
+	// Checked on every request: a role may change while the socket is open
+	if m.AuthorizeCommand != nil {
+		if err := m.AuthorizeCommand(projectID, client.userID); err != nil {
+			nack(client, req.RequestID, protocol.ErrorCodeForbidden, err.Error())
+			return
 		}
 	}
+	acked := false
+	err := m.OnClientCommand(projectID, client.userID, req.CommandPayload(), func(jobID string) {
+		acked = true
+		client.send(protocol.EventTypeAck, protocol.AckPayload{RequestID: req.RequestID, JobID: jobID})
+	})
+	if err == nil || acked {
+		return
+	}
+	var limited interface{ RetryAfter() time.Duration }
+	if errors.As(err, &limited) {
+		client.send(protocol.EventTypeNack, protocol.NackPayload{
+			RequestID:  req.RequestID,
+			Code:       protocol.ErrorCodeRateLimited,
+			Message:    err.Error(),
+			RetryAfter: int(math.Ceil(limited.RetryAfter().Seconds())),
+		})
+		return
+	}
+	log.Printf("Command request %s of a client of Project %s failed: %v", req.RequestID, projectID, err)
+	nack(client, req.RequestID, protocol.ErrorCodeCommandFailed, err.Error())
+}
+
+// nackInvalid answers a COMMAND_REQUEST that failed to decode, if it has a request ID
+func nackInvalid(client *clientConn, msg protocol.WSMessage, err *protocol.DecodeError) bool {
+	var req struct {
+		RequestID string `json:"request_id"`
+	}
+	if json.Unmarshal(msg.Payload, &req) != nil || req.RequestID == "" {
+		return false
+	}
+	nack(client, req.RequestID, protocol.ErrorCodeInvalidPayload, err.Error())
+	return true
+}
+
+func nack(client *clientConn, requestID string, code string, message string) {
+	client.send(protocol.EventTypeNack, protocol.NackPayload{RequestID: requestID, Code: code, Message: message})
 }
 
 func HandleWebSocket(c *gin.Context) {
@@ -108,45 +353,189 @@ func HandleWebSocket(c *gin.Context) {
 	// Don't close immediately, let connection live
 
 	// Wait for IDENTIFY message
-	var msg models.WSMessage
-	if err := conn.ReadJSON(&msg); err != nil {
+	msg, err := readMessage(conn)
+	if err != nil {
 		log.Println("Failed to read initial message:", err)
+		if decodeErr, ok := err.(*protocol.DecodeError); ok {
+			reject(conn, protocol.CloseInvalidIdentify, protocol.ErrorCodeInvalidIdentify, decodeErr.Error())
+		} else {
+			conn.Close()
+		}
+		return
+	}
+
+	if msg.Type != protocol.EventTypeIdentify {
+		log.Println("First message must be IDENTIFY")
+		reject(conn, protocol.CloseInvalidIdentify, protocol.ErrorCodeInvalidIdentify, "First message must be IDENTIFY")
+		return
+	}
+
+	payload, err := msg.Decode()
+	if err != nil {
+		log.Printf("Invalid IDENTIFY payload: %v", err)
+		reject(conn, protocol.CloseInvalidIdentify, protocol.ErrorCodeInvalidIdentify, err.Error())
+		return
+	}
+	identify := payload.(*protocol.IdentifyPayload)
+
+	if err := protocol.CheckVersion(identify.ProtocolVersion); err != nil {
+		log.Printf("Rejecting %s for Project %s: %v", identify.Role, identify.ProjectID, err)
+		reject(conn, protocol.CloseIncompatibleVersion, protocol.ErrorCodeIncompatibleVersion, err.Error())
+		return
+	}
+
+	role := identify.Role
+	if role == "" {
+		role = protocol.RoleAgent // Default to Agent for backward compat
+	}
+
+	var agentID, userID string
+	authenticate := GlobalManager.AuthenticateClient
+	if role == protocol.RoleAgent {
+		authenticate = GlobalManager.AuthenticateAgent
+	}
+	if authenticate != nil {
+		id, err := authenticate(identify.ProjectID, identify.Secret)
+		if err != nil {
+			log.Printf("Rejecting %s for Project %s: %v", role, identify.ProjectID, err)
+			reject(conn, protocol.CloseUnauthorized, protocol.ErrorCodeUnauthorized, err.Error())
+			return
+		}
+		if role == protocol.RoleAgent {
+			agentID = id
+		} else {
+			userID = id
+		}
+	}
+
+	// Browsers only speak JSON; agents may ask for a binary encoding
+	encoding := protocol.EncodingJSON
+	if role == protocol.RoleAgent {
+		encoding = protocol.NegotiateEncoding(identify.Encoding)
+	}
+	welcome, _ := protocol.NewMessage(protocol.EventTypeWelcome, protocol.WelcomePayload{
+		ProtocolVersion: protocol.Version,
+		Encoding:        encoding,
+	})
+	if err := conn.WriteJSON(welcome); err != nil {
 		conn.Close()
 		return
 	}
 
-	if msg.Type == models.EventTypeIdentify {
-		// Parse payload to get Project ID
-		payloadBytes, _ := json.Marshal(msg.Payload)
-		var identify models.IdentifyPayload
-		if err := json.Unmarshal(payloadBytes, &identify); err == nil && identify.ProjectID != "" {
+	var agent *agentConn
+	var client *clientConn
+	if role == protocol.RoleAgent {
+		agent = newAgentConn(conn, agentID, identify.Labels, encoding, identify.ProtocolVersion >= protocol.CommandAckVersion)
+		GlobalManager.RegisterAgent(identify.ProjectID, agent)
+		if GlobalManager.OnAgentConnected != nil {
+			GlobalManager.OnAgentConnected(identify.ProjectID)
+		}
+	} else {
+		client = newClientConn(conn, userID)
+		GlobalManager.RegisterClient(identify.ProjectID, client)
+	}
 
-			role := identify.Role
-			if role == "" {
-				role = models.RoleAgent // Default to Agent for backward compat
+	// Listen loop to keep connection open (and handle updates)
+	for {
+		incomingMsg, err := readMessage(conn)
+		if err != nil {
+			if decodeErr, ok := err.(*protocol.DecodeError); ok {
+				log.Printf("Malformed message from %s of Project %s: %v", role, identify.ProjectID, err)
+				GlobalManager.sendError(identify.ProjectID, conn, decodeErr.ErrorPayload())
+				continue
 			}
+			GlobalManager.Unregister(identify.ProjectID, conn)
+			break
+		}
 
-			GlobalManager.Register(identify.ProjectID, conn, role)
+		incomingPayload, err := incomingMsg.Decode()
+		if err != nil {
+			log.Printf("Invalid message from %s of Project %s: %v", role, identify.ProjectID, err)
+			decodeErr := err.(*protocol.DecodeError)
+			if client != nil && incomingMsg.Type == protocol.EventTypeCommandRequest && nackInvalid(client, incomingMsg, decodeErr) {
+				continue
+			}
+			// Never answer an ERROR with an ERROR
+			if incomingMsg.Type != protocol.EventTypeError {
+				GlobalManager.sendError(identify.ProjectID, conn, decodeErr.ErrorPayload())
+			}
+			continue
+		}
 
-			// Listen loop to keep connection open (and handle updates)
-			for {
-				var incomingMsg models.WSMessage
-				if err := conn.ReadJSON(&incomingMsg); err != nil {
-					GlobalManager.Unregister(identify.ProjectID, conn)
-					break
-				}
+		if errPayload, ok := incomingPayload.(*protocol.ErrorPayload); ok {
+			log.Printf("%s of Project %s reported an error (%s): %s", role, identify.ProjectID, errPayload.Code, errPayload.Message)
+			continue
+		}
 
-				// Broadcast if it's an Agent Log or Job Update or AI Stage
-				if role == models.RoleAgent && (incomingMsg.Type == models.EventTypeLogChunk || incomingMsg.Type == models.EventTypeJobUpdate || incomingMsg.Type == models.EventTypeAIStageUpdate) {
-					GlobalManager.BroadcastToClients(identify.ProjectID, incomingMsg)
-				}
+		if role != protocol.RoleAgent {
+			switch p := incomingPayload.(type) {
+			case *protocol.LogSubscribePayload:
+				GlobalManager.replayLogs(identify.ProjectID, client, p)
+			case *protocol.CommandRequestPayload:
+				GlobalManager.submitCommand(identify.ProjectID, client, p)
 			}
-		} else {
-			log.Println("Invalid IDENTIFY payload")
-			conn.Close()
+			continue
 		}
-	} else {
-		log.Println("First message must be IDENTIFY")
-		conn.Close()
+
+		// Preview tunnel frames go to the waiting HTTP handler, not to clients
+		if tunnels.dispatch(agent, incomingPayload) {
+			continue
+		}
+
+		GlobalManager.trackAgentMessage(agent, incomingPayload)
+
+		if update, ok := incomingPayload.(*protocol.JobUpdatePayload); ok && GlobalManager.OnJobUpdate != nil {
+			if !GlobalManager.OnJobUpdate(identify.ProjectID, update) {
+				continue
+			}
+		}
+		if chunk, ok := incomingPayload.(*protocol.LogChunkPayload); ok && GlobalManager.OnLogChunk != nil {
+			GlobalManager.OnLogChunk(identify.ProjectID, chunk)
+			// Re-encode, the frame doesn't carry the offset
+			if out, err := protocol.NewMessage(incomingMsg.Type, chunk); err == nil {
+				incomingMsg = out
+			}
+		}
+
+		// Broadcast agent events (logs, job and step updates, AI stages, test results, resource samples, service status, agent-created jobs)
+		switch incomingMsg.Type {
+		case protocol.EventTypeLogChunk, protocol.EventTypeJobUpdate, protocol.EventTypeStepUpdate, protocol.EventTypeAIStageUpdate, protocol.EventTypeTestResults,
+			protocol.EventTypeResourceSample, protocol.EventTypeServiceStatus, protocol.EventTypeJobCreated:
+			logJobID := ""
+			if chunk, ok := incomingPayload.(*protocol.LogChunkPayload); ok {
+				logJobID = chunk.JobID
+			}
+			if out, err := incomingMsg.AsJSON(incomingPayload); err == nil {
+				GlobalManager.broadcast(identify.ProjectID, out, logJobID)
+			}
+		}
+
+		if GlobalManager.OnAgentMessage != nil {
+			GlobalManager.OnAgentMessage(identify.ProjectID, incomingMsg, incomingPayload)
+		}
+	}
+}
+
+// readMessage reads one frame and decodes its envelope. Undecodable frames
+// return a *protocol.DecodeError; other errors mean the connection is gone.
+func readMessage(conn *websocket.Conn) (protocol.WSMessage, error) {
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		return protocol.WSMessage{}, err
+	}
+	return protocol.ParseFrame(frameType, data)
+}
+
+// reject tells the peer why it is being disconnected (ERROR event, then a close frame) and closes the socket
+func reject(conn *websocket.Conn, closeCode int, errorCode string, message string) {
+	if msg, err := protocol.NewMessage(protocol.EventTypeError, protocol.ErrorPayload{Code: errorCode, Message: message}); err == nil {
+		conn.WriteJSON(msg)
+	}
+	// Close reasons are limited to 123 bytes
+	reason := message
+	if len(reason) > 123 {
+		reason = reason[:123]
 	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason), time.Now().Add(time.Second))
+	conn.Close()
 }
@@ -2,6 +2,8 @@ package models
 
 import (
 	"time"
+
+	"github.com/rohaaaaaan/devair-protocol"
 )
 
 type User struct {
@@ -10,6 +12,14 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Session is returned by login; the token is sent as "Authorization: Bearer <token>"
+// and as the secret of CLIENT IDENTIFY messages
+type Session struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      User      `json:"user"`
+}
+
 type Project struct {
 	ID            string    `json:"id"`
 	Name          string    `json:"name"`
@@ -17,20 +27,88 @@ type Project struct {
 	Status        string    `json:"status"` // "last run: 2 hours ago"
 	State         string    `json:"state"`  // "success", "error", "idle"
 	LastBuildID   string    `json:"last_build_id"`
+	Role          string    `json:"role,omitempty"` // Of the user who asked, see ProjectMember
 }
 
 type Job struct {
-	ID        string    `json:"id"`
-	ProjectID string    `json:"project_id"`
-	Type      string    `json:"type"`   // BUILD, TEST, DEPLOY
-	Status    string    `json:"status"` // CREATED, RUNNING, COMPLETED, FAILED
-	Result    string    `json:"result"`
+	ID            string    `json:"id"`
+	ProjectID     string    `json:"project_id"`
+	Type          string    `json:"type"`   // BUILD, TEST, DEPLOY
+	Status        string    `json:"status"` // CREATED, RUNNING, COMPLETED, FAILED
+	Result        string    `json:"result"`
+	TriggerSource string    `json:"trigger_source"` // manual, watch
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type TestResult struct {
+	ID         string    `json:"id"`
+	JobID      string    `json:"job_id"`
+	Suite      string    `json:"suite"`
+	Name       string    `json:"name"`
+	Status     string    `json:"status"` // PASS, FAIL, SKIP
+	DurationMs float64   `json:"duration_ms"`
+	Output     string    `json:"output"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// One step of a multi-step job
+type JobStep struct {
+	ID         string     `json:"id"`
+	JobID      string     `json:"job_id"`
+	Index      int        `json:"index"`
+	Name       string     `json:"name"`
+	Command    string     `json:"command"`
+	Status     string     `json:"status"` // PENDING, RUNNING, COMPLETED, FAILED, SKIPPED
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// A range of a job's log. Offsets are in bytes; NextOffset is where the next
+// range (or a LOG_SUBSCRIBE) continues.
+type JobLog struct {
+	JobID      string `json:"job_id"`
+	Offset     int64  `json:"offset"`
+	NextOffset int64  `json:"next_offset"`
+	Log        string `json:"log"`
+	Finished   bool   `json:"finished"` // The job is done, the log won't grow
+}
+
+// Resource usage summary of a job, see ResourceSummary
+type JobResourceUsage struct {
+	JobID     string `json:"job_id"`
+	ProjectID string `json:"project_id"`
+	JobType   string `json:"job_type"`
+	protocol.ResourceSummary
 	CreatedAt time.Time `json:"created_at"`
 }
 
 type Agent struct {
-	ID           string    `json:"id"`
-	ProjectID    string    `json:"project_id"`
-	Status       string    `json:"status"` // ONLINE, OFFLINE
-	LastSeenAt   time.Time `json:"last_seen_at"`
+	ID             string     `json:"id"`
+	ProjectID      string     `json:"project_id"`
+	Name           string     `json:"name"`
+	Status         string     `json:"status"` // ONLINE, OFFLINE
+	LastSeenAt     *time.Time `json:"last_seen_at,omitempty"`
+	TokenRotatedAt *time.Time `json:"token_rotated_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Labels         []string   `json:"labels,omitempty"` // Sent by the agent when it connects
+	ActiveJobs     int        `json:"active_jobs"`
+}
+
+// ProjectMember is a user's role in a project: viewer, operator or admin
+type ProjectMember struct {
+	ProjectID string    `json:"project_id"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AgentToken is returned when a token is created or rotated; the token is not stored
+// and can't be shown again
+type AgentToken struct {
+	Agent Agent  `json:"agent"`
+	Token string `json:"token"`
 }
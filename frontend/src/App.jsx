@@ -5,15 +5,21 @@ import Dashboard from './views/Dashboard';
 import ProjectControl from './views/ProjectControl';
 import BuildProgress from './views/BuildProgress';
 import Preview from './views/Preview';
+import { getToken, clearToken } from './auth';
 
 function App() {
-  const [currentView, setCurrentView] = useState('login');
+  const [currentView, setCurrentView] = useState(getToken() ? 'dashboard' : 'login');
   const [selectedProject, setSelectedProject] = useState(null);
 
   const handleLogin = () => {
     setCurrentView('dashboard');
   };
 
+  const handleSessionExpired = () => {
+    clearToken();
+    setCurrentView('login');
+  };
+
   const handleSelectProject = (project) => {
     setSelectedProject(project);
     setCurrentView('control');
@@ -38,7 +44,7 @@ function App() {
       {currentView === 'login' && <Login onLogin={handleLogin} />}
 
       {currentView === 'dashboard' && (
-        <Dashboard onSelectProject={handleSelectProject} />
+        <Dashboard onSelectProject={handleSelectProject} onSessionExpired={handleSessionExpired} />
       )}
 
       {currentView === 'control' && (
@@ -0,0 +1,24 @@
+// Session token returned by POST /api/auth/login
+const TOKEN_KEY = 'devair_token';
+
+export const getToken = () => localStorage.getItem(TOKEN_KEY);
+
+export const clearToken = () => localStorage.removeItem(TOKEN_KEY);
+
+// Headers for authenticated API calls
+export const authHeaders = (headers = {}) => ({
+    ...headers,
+    Authorization: `Bearer ${getToken()}`,
+});
+
+export const login = async (email, password) => {
+    const res = await fetch('http://localhost:8080/api/auth/login', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ email, password })
+    });
+    const data = await res.json();
+    if (!res.ok) throw new Error(data.error || 'Login failed');
+    localStorage.setItem(TOKEN_KEY, data.token);
+    return data.user;
+};
@@ -1,18 +1,32 @@
 import React, { useEffect, useState } from 'react';
 import { motion } from 'framer-motion';
-import { Check, Loader2 } from 'lucide-react';
+import { Check, Loader2, X, Circle, CircleMinus } from 'lucide-react';
 import Header from '../components/UI/Header';
 import Button from '../components/UI/Button';
 import Card from '../components/UI/Card';
+import { authHeaders, getToken } from '../auth';
+
+const stepIcons = {
+    PENDING: <Circle size={14} color="var(--text-secondary)" />,
+    RUNNING: <Loader2 className="spin" size={14} color="#a78bfa" />,
+    COMPLETED: <Check size={14} color="#4ade80" />,
+    FAILED: <X size={14} color="#f87171" />,
+    SKIPPED: <CircleMinus size={14} color="var(--text-secondary)" />,
+};
+
+const stripAnsi = (text) => text.replace(/[\u001b\u009b][[()#;?]*(?:[0-9]{1,4}(?:;[0-9]{0,4})*)?[0-9A-ORZcf-nqry=><]/g, '');
 
-const steps = [
-    { id: 1, text: '12 files changed', delay: 500 },
-    { id: 2, text: 'Tests passed', delay: 1500 },
-    { id: 3, text: 'Preview ready', delay: 2500 },
-];
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+const formatDuration = (step) => {
+    if (!step.started_at || !step.finished_at) return '';
+    return `${((step.finished_at - step.started_at) / 1000).toFixed(1)}s`;
+};
 
 const BuildProgress = ({ project, onBack, onApprove }) => {
     const [logs, setLogs] = useState([]);
+    const [steps, setSteps] = useState([]); // Steps of a multi-step job, by index
     const [status, setStatus] = useState('Connecting...');
     const [aiAnalysis, setAiAnalysis] = useState(null);
     const [analyzing, setAnalyzing] = useState(false);
@@ -23,7 +37,7 @@ const BuildProgress = ({ project, onBack, onApprove }) => {
         try {
             const res = await fetch('http://localhost:8080/api/ai/analyze', {
                 method: 'POST',
-                headers: { 'Content-Type': 'application/json' },
+                headers: authHeaders({ 'Content-Type': 'application/json' }),
                 body: JSON.stringify({ logs: logs.join('\n') })
             });
             const data = await res.json();
@@ -40,10 +54,14 @@ const BuildProgress = ({ project, onBack, onApprove }) => {
 
         // Reset logs when project changes or connection restarts
         setLogs(['>> Initializing connection...']);
+        setSteps([]);
         setStatus('Connecting...');
 
         const ws = new WebSocket('ws://localhost:8080/ws');
         let isMounted = true;
+        let jobId = null;
+        let logOffset = 0; // Bytes of the job's log shown so far
+        const requestId = crypto.randomUUID();
 
         ws.onopen = () => {
             if (isMounted) {
@@ -53,25 +71,17 @@ const BuildProgress = ({ project, onBack, onApprove }) => {
                     type: 'IDENTIFY',
                     payload: {
                         project_id: project.id,
+                        secret: getToken(),
                         role: 'CLIENT'
                     }
                 }));
 
-                // Trigger the actual build now that we are listening
-                fetch(`http://localhost:8080/api/projects/${project.id}/build`, { method: 'POST' })
-                    .then(res => res.json())
-                    .then(data => {
-                        if (isMounted) {
-                            setStatus('Build Started');
-                            setLogs(prev => [...prev, `>> Build Job Created: ${data.id}`]);
-                        }
-                    })
-                    .catch(err => {
-                        if (isMounted) {
-                            setStatus('Error');
-                            setLogs(prev => [...prev, `>> Failed to trigger build: ${err.message}`]);
-                        }
-                    });
+                // Trigger the build on the same socket; the ACK carries the job ID
+                // and arrives before any event of the job
+                ws.send(JSON.stringify({
+                    type: 'COMMAND_REQUEST',
+                    payload: { request_id: requestId, type: 'BUILD' }
+                }));
             }
         };
 
@@ -79,11 +89,33 @@ const BuildProgress = ({ project, onBack, onApprove }) => {
             if (!isMounted) return;
             try {
                 const msg = JSON.parse(event.data);
-                if (msg.type === 'LOG_CHUNK') {
-                    const rawText = msg.payload.chunk || '';
-                    // Robust ANSI strip regex
-                    const cleanText = rawText.replace(/[\u001b\u009b][[()#;?]*(?:[0-9]{1,4}(?:;[0-9]{0,4})*)?[0-9A-ORZcf-nqry=><]/g, '');
+                if (msg.type === 'ACK' && msg.payload.request_id === requestId) {
+                    jobId = msg.payload.job_id;
+                    setStatus('Build Started');
+                    setLogs(prev => [...prev, `>> Build Job Created: ${jobId}`]);
+                } else if (msg.type === 'NACK' && msg.payload.request_id === requestId) {
+                    setStatus('Error');
+                    setLogs(prev => [...prev, `>> Failed to trigger build: ${msg.payload.message}`]);
+                } else if (msg.type === 'LOG_CHUNK') {
+                    const chunk = msg.payload;
+                    if (chunk.job_id !== jobId) return;
+                    let bytes = encoder.encode(chunk.chunk || '');
+                    // Stored chunks carry their offset: skip what the replay already showed
+                    if (typeof chunk.offset === 'number') {
+                        const end = chunk.offset + bytes.length;
+                        if (end <= logOffset || chunk.offset > logOffset) return;
+                        bytes = bytes.subarray(logOffset - chunk.offset);
+                        logOffset = end;
+                    }
+                    const cleanText = stripAnsi(decoder.decode(bytes));
                     setLogs(prev => [...prev, cleanText]);
+                } else if (msg.type === 'STEP_UPDATE') {
+                    const step = msg.payload;
+                    setSteps(prev => {
+                        const next = [...prev];
+                        next[step.index] = { ...next[step.index], ...step };
+                        return next;
+                    });
                 } else if (msg.type === 'JOB_UPDATE') {
                     setStatus(msg.payload.status);
                     setLogs(prev => [...prev, `\n>> Job Status: ${msg.payload.status}`]);
@@ -117,6 +149,21 @@ const BuildProgress = ({ project, onBack, onApprove }) => {
                     <span style={{ fontSize: '0.9rem', color: 'var(--text-secondary)' }}>Status: {status}</span>
                 </div>
 
+                {steps.length > 0 && (
+                    <Card style={{ marginBottom: '16px', padding: '12px 16px' }}>
+                        {steps.filter(Boolean).map(step => (
+                            <div key={step.index} style={{ display: 'flex', alignItems: 'center', gap: '8px', padding: '4px 0', fontSize: '0.9rem' }}>
+                                {stepIcons[step.status] || stepIcons.PENDING}
+                                <span style={{ flex: 1 }}>{step.name}</span>
+                                <span style={{ color: 'var(--text-secondary)', fontSize: '0.8rem' }}>
+                                    {step.status === 'FAILED' && step.exit_code !== undefined ? `exit ${step.exit_code} · ` : ''}
+                                    {formatDuration(step)}
+                                </span>
+                            </div>
+                        ))}
+                    </Card>
+                )}
+
                 <Card style={{ flex: 1, marginBottom: '20px', overflow: 'hidden', display: 'flex', flexDirection: 'column', background: '#1e1e1e', padding: 0 }}>
                     <div style={{
                         padding: '16px',
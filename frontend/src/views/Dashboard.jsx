@@ -3,15 +3,20 @@ import { motion } from 'framer-motion';
 import { ChevronRight, Clock, AlertCircle } from 'lucide-react';
 import Header from '../components/UI/Header';
 import Card from '../components/UI/Card';
+import { authHeaders } from '../auth';
 
-const Dashboard = ({ onSelectProject }) => {
+const Dashboard = ({ onSelectProject, onSessionExpired }) => {
     const [projects, setProjects] = React.useState([]);
     const [loading, setLoading] = React.useState(true);
     const [error, setError] = React.useState(null);
 
     React.useEffect(() => {
-        fetch('http://localhost:8080/api/projects')
+        fetch('http://localhost:8080/api/projects', { headers: authHeaders() })
             .then(res => {
+                if (res.status === 401) {
+                    onSessionExpired();
+                    throw new Error('Session expired');
+                }
                 if (!res.ok) throw new Error('Failed to fetch projects');
                 return res.json();
             })
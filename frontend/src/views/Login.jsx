@@ -1,10 +1,30 @@
-import React from 'react';
+import React, { useState } from 'react';
 import { motion } from 'framer-motion';
-import { CheckCircle2 } from 'lucide-react';
+import { AlertCircle } from 'lucide-react';
 import Button from '../components/UI/Button';
 import Card from '../components/UI/Card';
+import { login } from '../auth';
 
 const Login = ({ onLogin }) => {
+    const [email, setEmail] = useState('');
+    const [password, setPassword] = useState('');
+    const [error, setError] = useState(null);
+    const [submitting, setSubmitting] = useState(false);
+
+    const handleSubmit = async (e) => {
+        e?.preventDefault();
+        setSubmitting(true);
+        setError(null);
+        try {
+            const user = await login(email, password);
+            onLogin(user);
+        } catch (err) {
+            setError(err.message);
+        } finally {
+            setSubmitting(false);
+        }
+    };
+
     return (
         <div style={{
             padding: '0 24px',
@@ -57,46 +77,54 @@ const Login = ({ onLogin }) => {
                         opacity: 0.5
                     }} />
                     <Card className="login-card" style={{ width: '100%' }}>
-                        <div style={{ display: 'flex', flexDirection: 'column', gap: '16px', alignItems: 'center' }}>
-                            <div
+                        <form
+                            id="login-form"
+                            onSubmit={handleSubmit}
+                            style={{ display: 'flex', flexDirection: 'column', gap: '12px' }}
+                        >
+                            <input
+                                type="email"
+                                placeholder="Email"
+                                autoComplete="email"
+                                value={email}
+                                onChange={e => setEmail(e.target.value)}
+                                style={{
+                                    background: 'var(--bg-tertiary)',
+                                    color: 'var(--text-primary)',
+                                    border: '1px solid var(--text-muted)',
+                                    padding: '8px',
+                                    borderRadius: '4px'
+                                }}
+                            />
+                            <input
+                                type="password"
+                                placeholder="Password"
+                                autoComplete="current-password"
+                                value={password}
+                                onChange={e => setPassword(e.target.value)}
                                 style={{
-                                    width: '64px',
-                                    height: '64px',
-                                    borderRadius: '50%',
-                                    overflow: 'hidden',
-                                    border: '2px solid rgba(255,255,255,0.1)'
+                                    background: 'var(--bg-tertiary)',
+                                    color: 'var(--text-primary)',
+                                    border: '1px solid var(--text-muted)',
+                                    padding: '8px',
+                                    borderRadius: '4px'
                                 }}
-                            >
-                                <img
-                                    src="https://api.dicebear.com/7.x/avataaars/svg?seed=rohan&backgroundColor=262626"
-                                    alt="User Avatar"
-                                    style={{ width: '100%', height: '100%' }}
-                                />
-                            </div>
-                            <div style={{ textAlign: 'center' }}>
-                                <p style={{ fontSize: '0.875rem', color: 'var(--text-secondary)' }}>Logged in as</p>
-                                <p style={{ fontWeight: 600 }}>rohan@example.com</p>
-                            </div>
-                            <div style={{
-                                display: 'flex',
-                                alignItems: 'center',
-                                gap: '8px',
-                                background: 'rgba(34, 197, 94, 0.1)',
-                                padding: '8px 16px',
-                                borderRadius: '20px',
-                                color: 'var(--status-success)'
-                            }}>
+                            />
+                            {error && (
                                 <div style={{
-                                    width: '8px',
-                                    height: '8px',
-                                    background: 'var(--status-success)',
-                                    borderRadius: '50%',
-                                    boxShadow: '0 0 10px var(--status-success)'
-                                }} />
-                                <span style={{ fontSize: '0.875rem', fontWeight: 600 }}>Agent Online</span>
-                                <CheckCircle2 size={16} />
-                            </div>
-                        </div>
+                                    display: 'flex',
+                                    alignItems: 'center',
+                                    gap: '8px',
+                                    color: 'var(--status-error)',
+                                    fontSize: '0.875rem'
+                                }}>
+                                    <AlertCircle size={16} />
+                                    <span>{error}</span>
+                                </div>
+                            )}
+                            {/* Submits on Enter */}
+                            <button type="submit" style={{ display: 'none' }} />
+                        </form>
                     </Card>
                 </div>
             </motion.div>
@@ -106,8 +134,8 @@ const Login = ({ onLogin }) => {
                 animate={{ y: 0, opacity: 1 }}
                 transition={{ delay: 0.3 }}
             >
-                <Button fullWidth onClick={onLogin} variant="primary">
-                    Continue to Dashboard
+                <Button fullWidth onClick={handleSubmit} disabled={submitting} variant="primary">
+                    {submitting ? 'Signing in...' : 'Sign In'}
                 </Button>
             </motion.div>
         </div>
@@ -4,6 +4,7 @@ import { Play, Pause, AlertCircle, X, Lightbulb } from 'lucide-react';
 import Header from '../components/UI/Header';
 import Button from '../components/UI/Button';
 import Card from '../components/UI/Card';
+import { authHeaders } from '../auth';
 
 const ProjectControl = ({ project, onBack, onStartBuild }) => {
     const [showInstructions, setShowInstructions] = useState(true);
@@ -84,7 +85,7 @@ const ProjectControl = ({ project, onBack, onStartBuild }) => {
 
                             fetch(`http://127.0.0.1:8080/api/projects/${project.id}/ai-command`, {
                                 method: 'POST',
-                                headers: { 'Content-Type': 'application/json' },
+                                headers: authHeaders({ 'Content-Type': 'application/json' }),
                                 body: JSON.stringify({
                                     type: 'UI_ACTION',
                                     action,
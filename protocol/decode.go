@@ -0,0 +1,259 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Payload is implemented by every message payload. Validate reports missing
+// required fields; it does not check values against server state.
+type Payload interface {
+	Validate() error
+}
+
+// payloadTypes maps each event type to a constructor for its payload
+var payloadTypes = map[EventType]func() Payload{
+	EventTypeIdentify:        func() Payload { return &IdentifyPayload{} },
+	EventTypeWelcome:         func() Payload { return &WelcomePayload{} },
+	EventTypeError:           func() Payload { return &ErrorPayload{} },
+	EventTypeCommand:         func() Payload { return &CommandPayload{} },
+	EventTypeCommandAck:      func() Payload { return &CommandAckPayload{} },
+	EventTypeLogChunk:        func() Payload { return &LogChunkPayload{} },
+	EventTypeJobUpdate:       func() Payload { return &JobUpdatePayload{} },
+	EventTypeAIStageUpdate:   func() Payload { return &AIStagePayload{} },
+	EventTypeTestResults:     func() Payload { return &TestResultsPayload{} },
+	EventTypeResourceSample:  func() Payload { return &ResourceSample{} },
+	EventTypeServiceStatus:   func() Payload { return &ServiceStatusPayload{} },
+	EventTypeJobCreated:      func() Payload { return &JobCreatedPayload{} },
+	EventTypeStepUpdate:      func() Payload { return &StepUpdatePayload{} },
+	EventTypeLogSubscribe:    func() Payload { return &LogSubscribePayload{} },
+	EventTypeCommandRequest:  func() Payload { return &CommandRequestPayload{} },
+	EventTypeAck:             func() Payload { return &AckPayload{} },
+	EventTypeNack:            func() Payload { return &NackPayload{} },
+	EventTypeTunnelRequest:   func() Payload { return &TunnelRequestPayload{} },
+	EventTypeTunnelResponse:  func() Payload { return &TunnelResponsePayload{} },
+	EventTypeTunnelData:      func() Payload { return &TunnelDataPayload{} },
+	EventTypeTunnelWSMessage: func() Payload { return &TunnelWSMessagePayload{} },
+	EventTypeTunnelClose:     func() Payload { return &TunnelClosePayload{} },
+}
+
+// DecodeError is returned by ParseMessage and Decode. Its ErrorPayload is
+// what the receiver sends back to the peer.
+type DecodeError struct {
+	Code string
+	Type EventType
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Type == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Type, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// ErrorPayload builds the ERROR event payload describing e
+func (e *DecodeError) ErrorPayload() ErrorPayload {
+	return ErrorPayload{Code: e.Code, Message: e.Error(), Type: e.Type}
+}
+
+// ParseMessage decodes the envelope of a frame; the payload stays raw
+func ParseMessage(data []byte) (WSMessage, error) {
+	var msg WSMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return WSMessage{}, &DecodeError{Code: ErrorCodeMalformedMessage, Err: fmt.Errorf("invalid message: %w", err)}
+	}
+	if msg.Type == "" {
+		return WSMessage{}, &DecodeError{Code: ErrorCodeMalformedMessage, Err: fmt.Errorf("message has no type")}
+	}
+	return msg, nil
+}
+
+// Decode parses the payload into the type registered for m.Type (always a
+// pointer, e.g. *CommandPayload) and validates it
+func (m WSMessage) Decode() (Payload, error) {
+	newPayload, ok := payloadTypes[m.Type]
+	if !ok {
+		return nil, &DecodeError{Code: ErrorCodeUnknownType, Type: m.Type, Err: fmt.Errorf("unknown message type")}
+	}
+	payload := newPayload()
+	if len(m.Payload) == 0 || (m.Encoding == "" && string(m.Payload) == "null") {
+		return nil, &DecodeError{Code: ErrorCodeInvalidPayload, Type: m.Type, Err: fmt.Errorf("missing payload")}
+	}
+	if err := unmarshalPayload(m.Encoding, m.Payload, payload); err != nil {
+		return nil, &DecodeError{Code: ErrorCodeInvalidPayload, Type: m.Type, Err: err}
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, &DecodeError{Code: ErrorCodeInvalidPayload, Type: m.Type, Err: err}
+	}
+	return payload, nil
+}
+
+func required(fields ...string) error {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] == "" {
+			return fmt.Errorf("missing %s", fields[i])
+		}
+	}
+	return nil
+}
+
+func (p *IdentifyPayload) Validate() error {
+	if err := required("project_id", p.ProjectID); err != nil {
+		return err
+	}
+	switch p.Role {
+	case "", RoleAgent, RoleClient:
+	default:
+		return fmt.Errorf("unknown role %q", p.Role)
+	}
+	// Unknown encodings are not an error: the server falls back to JSON
+	return nil
+}
+
+func (p *WelcomePayload) Validate() error { return nil }
+
+func (p *ErrorPayload) Validate() error { return required("code", p.Code) }
+
+func (p *CommandPayload) Validate() error {
+	if err := required("job_id", p.JobID, "type", p.Type); err != nil {
+		return err
+	}
+	if err := ValidateSteps(p.Steps); err != nil {
+		return err
+	}
+	return p.Cache.Validate()
+}
+
+func (p *CommandAckPayload) Validate() error { return required("job_id", p.JobID) }
+
+// Validate checks a cache spec; a nil spec is valid (no caching)
+func (c *CacheSpec) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Inputs) == 0 || len(c.Outputs) == 0 {
+		return fmt.Errorf("cache needs inputs and outputs")
+	}
+	for _, p := range append(append([]string{}, c.Inputs...), c.Outputs...) {
+		// FromSlash: on Windows agents `..\` leaves the working directory too
+		if !filepath.IsLocal(filepath.FromSlash(p)) {
+			return fmt.Errorf("cache path %q must be relative to the working directory", p)
+		}
+	}
+	for _, out := range c.Outputs {
+		// Outputs are deleted and replaced on a cache hit
+		if path.Clean(out) == "." {
+			return fmt.Errorf("cache output %q is the whole working directory", out)
+		}
+		for _, in := range c.Inputs {
+			if cacheOverlaps(out, in) {
+				return fmt.Errorf("cache output %q overlaps input %q", out, in)
+			}
+		}
+	}
+	return nil
+}
+
+// cacheOverlaps reports whether an output directory or file can hold files
+// matched by an input glob (a glob also matches everything below what it matches)
+func cacheOverlaps(output string, input string) bool {
+	segments := strings.Split(path.Clean(input), "/")
+	for i, name := range strings.Split(path.Clean(output), "/") {
+		if i >= len(segments) || segments[i] == "**" {
+			// The output is below a match of the input
+			return true
+		}
+		if ok, _ := path.Match(segments[i], name); !ok {
+			return false
+		}
+	}
+	// The output contains what the rest of the input matches
+	return true
+}
+
+// ValidateSteps checks the steps of a multi-step job
+func ValidateSteps(steps []JobStep) error {
+	for i, step := range steps {
+		if step.Command == "" {
+			return fmt.Errorf("step %d has no command", i)
+		}
+		if step.TimeoutSeconds < 0 {
+			return fmt.Errorf("step %d has a negative timeout", i)
+		}
+	}
+	return nil
+}
+
+func (p *JobCreatedPayload) Validate() error { return required("job_id", p.JobID, "type", p.Type) }
+
+func (p *JobUpdatePayload) Validate() error { return required("job_id", p.JobID, "status", p.Status) }
+
+func (p *StepUpdatePayload) Validate() error {
+	if err := required("job_id", p.JobID, "name", p.Name, "status", p.Status); err != nil {
+		return err
+	}
+	if p.Index < 0 {
+		return fmt.Errorf("invalid index %d", p.Index)
+	}
+	return nil
+}
+
+func (p *LogChunkPayload) Validate() error { return required("job_id", p.JobID) }
+
+func (p *LogSubscribePayload) Validate() error {
+	if err := required("job_id", p.JobID); err != nil {
+		return err
+	}
+	if p.Offset < 0 {
+		return fmt.Errorf("invalid offset %d", p.Offset)
+	}
+	return nil
+}
+
+func (p *CommandRequestPayload) Validate() error {
+	if err := required("request_id", p.RequestID, "type", p.Type); err != nil {
+		return err
+	}
+	if err := ValidateSteps(p.Steps); err != nil {
+		return err
+	}
+	return p.Cache.Validate()
+}
+
+func (p *AckPayload) Validate() error { return required("request_id", p.RequestID, "job_id", p.JobID) }
+
+func (p *NackPayload) Validate() error { return required("request_id", p.RequestID, "code", p.Code) }
+
+func (p *AIStagePayload) Validate() error { return required("job_id", p.JobID, "stage", p.Stage) }
+
+func (p *TestResultsPayload) Validate() error { return required("job_id", p.JobID) }
+
+func (p *ResourceSample) Validate() error { return required("job_id", p.JobID) }
+
+func (p *ServiceStatusPayload) Validate() error { return required("name", p.Name, "status", p.Status) }
+
+func (p *TunnelRequestPayload) Validate() error {
+	return required("stream_id", p.StreamID, "method", p.Method, "path", p.Path)
+}
+
+func (p *TunnelResponsePayload) Validate() error {
+	if err := required("stream_id", p.StreamID); err != nil {
+		return err
+	}
+	if p.Status < 100 || p.Status > 999 {
+		return fmt.Errorf("invalid status %d", p.Status)
+	}
+	return nil
+}
+
+func (p *TunnelDataPayload) Validate() error { return required("stream_id", p.StreamID) }
+
+func (p *TunnelWSMessagePayload) Validate() error { return required("stream_id", p.StreamID) }
+
+func (p *TunnelClosePayload) Validate() error { return required("stream_id", p.StreamID) }
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Frame encodings, negotiated at IDENTIFY
+const (
+	EncodingJSON    = "json"    // Text frames, the default
+	EncodingMsgpack = "msgpack" // Binary frames: MessagePack, []byte fields stay raw instead of base64
+)
+
+// WebSocket frame opcodes (RFC 6455), the values of websocket.TextMessage and BinaryMessage
+const (
+	TextFrame   = 1
+	BinaryFrame = 2
+)
+
+// msgpackHandle honours the json struct tags, so payload types need no extra tags
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.WriteExt = true // Encode []byte as bin, not str
+	return h
+}()
+
+// binaryEnvelope is the MessagePack counterpart of WSMessage. The payload is
+// encoded separately so it can be decoded once its type is known.
+type binaryEnvelope struct {
+	Type    EventType `codec:"type"`
+	Payload []byte    `codec:"payload"`
+}
+
+// NegotiateEncoding returns the encoding granted for a requested one
+func NegotiateEncoding(requested string) string {
+	if requested == EncodingMsgpack {
+		return EncodingMsgpack
+	}
+	return EncodingJSON
+}
+
+// EncodeFrame encodes a message of type t and returns it with the frame type to send it as
+func EncodeFrame(encoding string, t EventType, payload interface{}) (int, []byte, error) {
+	if encoding != EncodingMsgpack {
+		msg, err := NewMessage(t, payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		data, err := json.Marshal(msg)
+		return TextFrame, data, err
+	}
+
+	var payloadBytes []byte
+	if err := codec.NewEncoderBytes(&payloadBytes, msgpackHandle).Encode(payload); err != nil {
+		return 0, nil, fmt.Errorf("encoding %s payload: %w", t, err)
+	}
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(binaryEnvelope{Type: t, Payload: payloadBytes}); err != nil {
+		return 0, nil, fmt.Errorf("encoding %s message: %w", t, err)
+	}
+	return BinaryFrame, data, nil
+}
+
+// ParseFrame decodes the envelope of a received frame: text frames are JSON,
+// binary frames MessagePack. The payload stays raw until Decode.
+func ParseFrame(frameType int, data []byte) (WSMessage, error) {
+	if frameType != BinaryFrame {
+		return ParseMessage(data)
+	}
+
+	var env binaryEnvelope
+	if err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&env); err != nil {
+		return WSMessage{}, &DecodeError{Code: ErrorCodeMalformedMessage, Err: fmt.Errorf("invalid binary message: %w", err)}
+	}
+	if env.Type == "" {
+		return WSMessage{}, &DecodeError{Code: ErrorCodeMalformedMessage, Err: fmt.Errorf("message has no type")}
+	}
+	return WSMessage{Type: env.Type, Payload: env.Payload, Encoding: EncodingMsgpack}, nil
+}
+
+// AsJSON returns m with a JSON payload (payload is m's decoded payload), e.g.
+// to forward a MessagePack message to a browser
+func (m WSMessage) AsJSON(payload Payload) (WSMessage, error) {
+	if m.Encoding == "" || m.Encoding == EncodingJSON {
+		return m, nil
+	}
+	return NewMessage(m.Type, payload)
+}
+
+func unmarshalPayload(encoding string, data []byte, v interface{}) error {
+	if encoding == EncodingMsgpack {
+		return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+	}
+	return json.Unmarshal(data, v)
+}
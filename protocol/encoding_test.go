@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// A build log line as the agent streams it: one LOG_CHUNK per write
+var benchLogChunk = LogChunkPayload{
+	JobID: "0b7c3f52-6a1e-4d2b-9c43-1f0e8d9a7b21",
+	Chunk: strings.Repeat("vite v5.4.2 building for production... transforming (412) src/components/Button.tsx\n", 4),
+}
+
+// countingConn counts the bytes written to the socket, i.e. after compression
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// BenchmarkLogStream measures end-to-end throughput of the log-streaming path
+// (encode, WebSocket write, read, decode) for each encoding, with and without
+// permessage-deflate. wire-B/op is what actually goes over the network.
+// Run with: go test -bench LogStream -benchmem
+func BenchmarkLogStream(b *testing.B) {
+	for _, encoding := range []string{EncodingJSON, EncodingMsgpack} {
+		for _, compress := range []bool{false, true} {
+			name := fmt.Sprintf("%s/deflate=%v", encoding, compress)
+			b.Run(name, func(b *testing.B) {
+				benchmarkLogStream(b, encoding, compress)
+			})
+		}
+	}
+}
+
+func benchmarkLogStream(b *testing.B, encoding string, compress bool) {
+	received := make(chan error, 1)
+	upgrader := websocket.Upgrader{EnableCompression: compress}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			received <- err
+			return
+		}
+		defer conn.Close()
+		for i := 0; i < b.N; i++ {
+			frameType, data, err := conn.ReadMessage()
+			if err != nil {
+				received <- err
+				return
+			}
+			msg, err := ParseFrame(frameType, data)
+			if err == nil {
+				_, err = msg.Decode()
+			}
+			if err != nil {
+				received <- err
+				return
+			}
+		}
+		received <- nil
+	}))
+	defer server.Close()
+
+	var written atomic.Int64
+	dialer := websocket.Dialer{
+		EnableCompression: compress,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, written: &written}, nil
+		},
+	}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	b.SetBytes(int64(len(benchLogChunk.Chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	written.Store(0)
+
+	for i := 0; i < b.N; i++ {
+		frameType, data, err := EncodeFrame(encoding, EventTypeLogChunk, benchLogChunk)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := conn.WriteMessage(frameType, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-received; err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(written.Load())/float64(b.N), "wire-B/op")
+}
+
+// BenchmarkEncodeLogChunk isolates the encoding cost of a LOG_CHUNK frame
+func BenchmarkEncodeLogChunk(b *testing.B) {
+	for _, encoding := range []string{EncodingJSON, EncodingMsgpack} {
+		b.Run(encoding, func(b *testing.B) {
+			b.SetBytes(int64(len(benchLogChunk.Chunk)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := EncodeFrame(encoding, EventTypeLogChunk, benchLogChunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Tunnel frames carry raw bytes; both encodings must round-trip them
+func TestEncodeFrameRoundTrip(t *testing.T) {
+	in := TunnelDataPayload{StreamID: "s1", Data: []byte{0, 1, 2, 0xff}, EOF: true}
+	for _, encoding := range []string{EncodingJSON, EncodingMsgpack} {
+		frameType, data, err := EncodeFrame(encoding, EventTypeTunnelData, in)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", encoding, err)
+		}
+		msg, err := ParseFrame(frameType, data)
+		if err != nil {
+			t.Fatalf("%s: parse: %v", encoding, err)
+		}
+		payload, err := msg.Decode()
+		if err != nil {
+			t.Fatalf("%s: decode: %v", encoding, err)
+		}
+		out := payload.(*TunnelDataPayload)
+		if out.StreamID != in.StreamID || string(out.Data) != string(in.Data) || out.EOF != in.EOF {
+			t.Errorf("%s: got %+v, want %+v", encoding, *out, in)
+		}
+	}
+}
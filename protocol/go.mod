@@ -0,0 +1,8 @@
+module github.com/rohaaaaaan/devair-protocol
+
+go 1.25.6
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/ugorji/go/codec v1.3.0
+)
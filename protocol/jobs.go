@@ -0,0 +1,171 @@
+package protocol
+
+// Command Types for Job Dispatching
+const (
+	CommandTypeBuild         = "BUILD"
+	CommandTypeTest          = "TEST"
+	CommandTypeOpenIDE       = "OPEN_IDE"
+	CommandTypeOpenApp       = "OPEN_APP"       // Open arbitrary apps
+	CommandTypeAIInstruction = "AI_INSTRUCTION" // Natural language instruction
+	CommandTypeUIAction      = "UI_ACTION"      // Low-level UI control
+	CommandTypeServiceStart  = "SERVICE_START"  // Start a supervised long-running process (dev server)
+	CommandTypeServiceStop   = "SERVICE_STOP"
+	CommandTypeServiceStatus = "SERVICE_STATUS"
+)
+
+// Job statuses reported in JobUpdatePayload.Status
+const (
+	JobStatusQueued    = "QUEUED"
+	JobStatusRunning   = "RUNNING"
+	JobStatusCompleted = "COMPLETED"
+	JobStatusFailed    = "FAILED"
+	JobStatusCancelled = "CANCELLED"
+)
+
+// Where a job came from (jobs.trigger_source)
+const (
+	TriggerSourceManual = "manual" // REST / client request
+	TriggerSourceWatch  = "watch"  // Agent file watcher
+)
+
+// Payload for "COMMAND" (Server -> Agent)
+type CommandPayload struct {
+	JobID   string            `json:"job_id"`
+	Type    string            `json:"type"`              // BUILD, TEST, OPEN_APP, AI_INSTRUCTION, UI_ACTION, SERVICE_*
+	Command string            `json:"command,omitempty"` // e.g., "npm run build"
+	App     string            `json:"app,omitempty"`     // For OPEN_APP
+	Prompt  string            `json:"prompt,omitempty"`  // For AI_INSTRUCTION
+	Action  string            `json:"action,omitempty"`  // For UI_ACTION (find, click, type)
+	Target  string            `json:"target,omitempty"`  // For UI_ACTION (window name, element name)
+	Value   string            `json:"value,omitempty"`   // For UI_ACTION (text to type)
+	Params  map[string]string `json:"params"`
+	Secrets map[string]string `json:"secrets,omitempty"` // Env vars for the command, redacted from its output
+	Steps   []JobStep         `json:"steps,omitempty"`   // Run in order instead of Command
+	Cache   *CacheSpec        `json:"cache,omitempty"`   // Opt-in build cache
+	Labels  []string          `json:"labels,omitempty"`  // Only agents with all of these labels may run the job
+}
+
+// Payload for "COMMAND_ACK" (Agent -> Server), sent as soon as a COMMAND arrives.
+// The server resends a COMMAND until it is acknowledged, so an agent may get
+// the same job more than once; it acknowledges each copy and runs the first.
+type CommandAckPayload struct {
+	JobID string `json:"job_id"`
+}
+
+// CacheSpec makes a job cacheable: if the files matching Inputs hash to the key of an
+// earlier successful run, the agent restores that run's Outputs instead of running the job.
+type CacheSpec struct {
+	Inputs  []string `json:"inputs"`  // Globs relative to the working directory ("src/**", "package-lock.json")
+	Outputs []string `json:"outputs"` // Files or directories the job produces ("dist")
+}
+
+// JobStep is one command of a multi-step job (install -> lint -> test -> build)
+type JobStep struct {
+	Name            string            `json:"name"`
+	Command         string            `json:"command"`
+	WorkDir         string            `json:"work_dir,omitempty"` // Relative to the agent's working directory
+	Env             map[string]string `json:"env,omitempty"`
+	ContinueOnError bool              `json:"continue_on_error,omitempty"`
+	TimeoutSeconds  int               `json:"timeout_seconds,omitempty"` // 0 = no timeout
+}
+
+// Step statuses, in addition to RUNNING, COMPLETED and FAILED
+const (
+	StepStatusPending = "PENDING" // Not started yet
+	StepStatusSkipped = "SKIPPED" // An earlier step failed
+)
+
+// Payload for "STEP_UPDATE" (Agent -> Server -> Client), sent when a step starts and when it ends
+type StepUpdatePayload struct {
+	JobID      string `json:"job_id"`
+	Index      int    `json:"index"` // Position in CommandPayload.Steps
+	Name       string `json:"name"`
+	Status     string `json:"status"` // RUNNING, COMPLETED, FAILED, SKIPPED
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  int64  `json:"started_at,omitempty"`  // Unix millis
+	FinishedAt int64  `json:"finished_at,omitempty"` // Unix millis
+}
+
+// Payload for "JOB_CREATED" (Agent -> Server -> Clients)
+// The agent generates JobID (a UUID) and starts running the job right away.
+type JobCreatedPayload struct {
+	JobID         string            `json:"job_id"`
+	Type          string            `json:"type"`
+	Command       string            `json:"command"`
+	Params        map[string]string `json:"params,omitempty"`
+	TriggerSource string            `json:"trigger_source"`
+}
+
+// Payload for "JOB_UPDATE" (Agent -> Server -> Clients)
+type JobUpdatePayload struct {
+	JobID     string           `json:"job_id"`
+	Status    string           `json:"status"`
+	Result    string           `json:"result,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	Resources *ResourceSummary `json:"resources,omitempty"` // Set on the final update
+	Cached    bool             `json:"cached,omitempty"`    // Outputs restored from the build cache, nothing ran
+}
+
+// Payload for "LOG_CHUNK" (Agent -> Server -> Clients)
+type LogChunkPayload struct {
+	JobID  string `json:"job_id"`
+	Chunk  string `json:"chunk"`
+	Offset *int64 `json:"offset,omitempty"` // Byte offset of Chunk in the job's log, set by the server once stored
+}
+
+// Payload for "LOG_SUBSCRIBE" (Client -> Server). The server answers with the
+// stored log of the job from Offset on, as LOG_CHUNKs, before any live chunk
+// of the job. Clients drop live chunks they already got through the replay.
+type LogSubscribePayload struct {
+	JobID  string `json:"job_id"`
+	Offset int64  `json:"offset,omitempty"`
+}
+
+// Payload for "COMMAND_REQUEST" (Client -> Server), the socket counterpart of
+// POST /projects/:id/command. The server answers with an ACK carrying the job ID,
+// sent before any event of the job, or a NACK.
+type CommandRequestPayload struct {
+	RequestID string            `json:"request_id"` // Chosen by the client, echoed in the ACK/NACK
+	Type      string            `json:"type"`
+	Command   string            `json:"command,omitempty"` // Ignored for BUILD and TEST (use Steps), else defaults to the command of the type
+	Params    map[string]string `json:"params,omitempty"`
+	Secrets   map[string]string `json:"secrets,omitempty"`
+	Steps     []JobStep         `json:"steps,omitempty"`
+	Cache     *CacheSpec        `json:"cache,omitempty"`
+	Labels    []string          `json:"labels,omitempty"`
+}
+
+// CommandPayload returns the command to run; the server assigns JobID
+func (p *CommandRequestPayload) CommandPayload() CommandPayload {
+	return CommandPayload{
+		Type:    p.Type,
+		Command: p.Command,
+		Params:  p.Params,
+		Secrets: p.Secrets,
+		Steps:   p.Steps,
+		Cache:   p.Cache,
+		Labels:  p.Labels,
+	}
+}
+
+// Payload for "ACK" (Server -> Client)
+type AckPayload struct {
+	RequestID string `json:"request_id"`
+	JobID     string `json:"job_id"`
+}
+
+// Payload for "NACK" (Server -> Client)
+type NackPayload struct {
+	RequestID  string `json:"request_id"`
+	Code       string `json:"code"` // INVALID_PAYLOAD, FORBIDDEN, RATE_LIMITED, COMMAND_FAILED
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"` // Seconds to wait before retrying, with RATE_LIMITED
+}
+
+// Payload for "AI_STAGE_UPDATE" (Agent -> Server -> Clients)
+type AIStagePayload struct {
+	JobID   string `json:"job_id"`
+	Stage   string `json:"stage"`   // e.g., "Analyzing", "Creating files", "Done"
+	Message string `json:"message"` // Optional details
+}
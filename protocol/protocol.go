@@ -0,0 +1,128 @@
+// Package protocol defines the WebSocket messages exchanged between the
+// DevAir backend, its agents and its clients. Both binaries import it, so a
+// message type only ever has one definition.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Version of the wire protocol. Bump it on incompatible changes and raise
+// MinSupportedVersion once older peers can no longer be served.
+const (
+	Version             = 2
+	MinSupportedVersion = 1
+
+	// First version whose agents acknowledge each COMMAND with a COMMAND_ACK
+	CommandAckVersion = 2
+)
+
+// CheckVersion returns an error if a peer speaking version v can't talk to us.
+// Peers that predate versioning send no version (0) and speak version 1.
+func CheckVersion(v int) error {
+	if v == 0 {
+		v = 1
+	}
+	if v < MinSupportedVersion || v > Version {
+		return fmt.Errorf("incompatible protocol version %d (supported: %d to %d)", v, MinSupportedVersion, Version)
+	}
+	return nil
+}
+
+type EventType string
+
+const (
+	EventTypeIdentify       EventType = "IDENTIFY"
+	EventTypeWelcome        EventType = "WELCOME" // Server's answer to IDENTIFY, see WelcomePayload
+	EventTypeError          EventType = "ERROR"
+	EventTypeCommand        EventType = "COMMAND"
+	EventTypeCommandAck     EventType = "COMMAND_ACK" // Agent received a COMMAND, see CommandAckPayload
+	EventTypeLogChunk       EventType = "LOG_CHUNK"
+	EventTypeJobUpdate      EventType = "JOB_UPDATE"
+	EventTypeAIStageUpdate  EventType = "AI_STAGE_UPDATE" // For streaming AI progress
+	EventTypeTestResults    EventType = "TEST_RESULTS"    // Parsed per-test results of a TEST job
+	EventTypeResourceSample EventType = "RESOURCE_SAMPLE" // CPU/memory/IO of a running job
+	EventTypeServiceStatus  EventType = "SERVICE_STATUS"  // State change of a supervised dev server
+	EventTypeJobCreated     EventType = "JOB_CREATED"     // Job started by the agent itself (e.g. watch mode)
+	EventTypeStepUpdate     EventType = "STEP_UPDATE"     // Start/end of a step of a multi-step job
+	EventTypeLogSubscribe   EventType = "LOG_SUBSCRIBE"   // Client asks for the stored log of a job, see LogSubscribePayload
+	EventTypeCommandRequest EventType = "COMMAND_REQUEST" // Client starts a job over its socket, see CommandRequestPayload
+	EventTypeAck            EventType = "ACK"             // COMMAND_REQUEST accepted, see AckPayload
+	EventTypeNack           EventType = "NACK"            // COMMAND_REQUEST rejected, see NackPayload
+
+	// Preview tunnel frames (Server <-> Agent), see TunnelRequestPayload
+	EventTypeTunnelRequest   EventType = "TUNNEL_REQUEST"
+	EventTypeTunnelResponse  EventType = "TUNNEL_RESPONSE"
+	EventTypeTunnelData      EventType = "TUNNEL_DATA"
+	EventTypeTunnelWSMessage EventType = "TUNNEL_WS_MESSAGE"
+	EventTypeTunnelClose     EventType = "TUNNEL_CLOSE"
+)
+
+const (
+	RoleAgent  = "AGENT"
+	RoleClient = "CLIENT"
+)
+
+// Base WebSocket Message. The payload stays raw until Decode picks its type.
+type WSMessage struct {
+	Type    EventType       `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+
+	// Encoding of Payload; empty for JSON. Set by ParseFrame.
+	Encoding string `json:"-"`
+}
+
+// NewMessage encodes payload into a JSON message of type t
+func NewMessage(t EventType, payload interface{}) (WSMessage, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return WSMessage{}, fmt.Errorf("encoding %s payload: %w", t, err)
+	}
+	return WSMessage{Type: t, Payload: data}, nil
+}
+
+// Payload for "IDENTIFY" (Agent/Client -> Server), always the first message
+type IdentifyPayload struct {
+	ProjectID       string   `json:"project_id"`
+	Secret          string   `json:"secret"` // Agent token, or the session token of a client
+	Role            string   `json:"role"`   // "AGENT" or "CLIENT"
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	Encoding        string   `json:"encoding,omitempty"` // Requested frame encoding, JSON if empty
+	Labels          []string `json:"labels,omitempty"`   // Agent capabilities jobs can require, e.g. "os:linux", "gpu"
+}
+
+// Payload for "WELCOME" (Server -> Agent/Client), sent as a JSON text frame once IDENTIFY is
+// accepted. Until it arrives the peer sends JSON; afterwards it may use Encoding.
+type WelcomePayload struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	Encoding        string `json:"encoding"` // Granted frame encoding
+}
+
+// Error codes sent in ErrorPayload.Code
+const (
+	ErrorCodeIncompatibleVersion = "INCOMPATIBLE_PROTOCOL_VERSION"
+	ErrorCodeInvalidIdentify     = "INVALID_IDENTIFY"
+	ErrorCodeUnauthorized        = "UNAUTHORIZED"         // Missing, unknown or revoked token
+	ErrorCodeMalformedMessage    = "MALFORMED_MESSAGE"    // Not a JSON envelope
+	ErrorCodeUnknownType         = "UNKNOWN_MESSAGE_TYPE" // No payload registered for the type
+	ErrorCodeInvalidPayload      = "INVALID_PAYLOAD"      // Undecodable or missing required fields
+	ErrorCodeLogUnavailable      = "LOG_UNAVAILABLE"      // LOG_SUBSCRIBE to an unknown job, or logs are not stored
+	ErrorCodeCommandFailed       = "COMMAND_FAILED"       // The job of a COMMAND_REQUEST could not be created
+	ErrorCodeForbidden           = "FORBIDDEN"            // The user's project role doesn't allow the request
+	ErrorCodeRateLimited         = "RATE_LIMITED"         // Over a rate limit or quota, see NackPayload.RetryAfter
+)
+
+// WebSocket close codes (4000-4999 are reserved for applications)
+const (
+	CloseIncompatibleVersion = 4001
+	CloseInvalidIdentify     = 4002
+	CloseUnauthorized        = 4003 // Also sent when the token of a connected agent is revoked or rotated
+)
+
+// Payload for "ERROR" (Server -> Agent/Client)
+type ErrorPayload struct {
+	Code    string    `json:"code"`
+	Message string    `json:"message"`
+	Type    EventType `json:"type,omitempty"` // Type of the offending message, if known
+}
@@ -0,0 +1,25 @@
+package protocol
+
+// Payload for "RESOURCE_SAMPLE" (Agent -> Server -> Clients)
+// Covers the job's whole process tree.
+type ResourceSample struct {
+	JobID      string  `json:"job_id"`
+	Timestamp  int64   `json:"timestamp"` // Unix millis
+	CPUPercent float64 `json:"cpu_percent"`
+	RSSBytes   uint64  `json:"rss_bytes"`
+	ReadBytes  uint64  `json:"read_bytes"`  // Cumulative for the job
+	WriteBytes uint64  `json:"write_bytes"` // Cumulative for the job
+	Processes  int     `json:"processes"`
+}
+
+// Peak/average resource usage of a finished job
+type ResourceSummary struct {
+	Samples        int     `json:"samples"`
+	DurationMs     int64   `json:"duration_ms"`
+	PeakCPUPercent float64 `json:"peak_cpu_percent"`
+	AvgCPUPercent  float64 `json:"avg_cpu_percent"`
+	PeakRSSBytes   uint64  `json:"peak_rss_bytes"`
+	AvgRSSBytes    uint64  `json:"avg_rss_bytes"`
+	ReadBytes      uint64  `json:"read_bytes"`
+	WriteBytes     uint64  `json:"write_bytes"`
+}
@@ -0,0 +1,26 @@
+package protocol
+
+// Service states reported in ServiceStatusPayload.Status
+const (
+	ServiceStatusStarting  = "STARTING"  // Process launched, port not known yet
+	ServiceStatusRunning   = "RUNNING"   // Port detected
+	ServiceStatusHealthy   = "HEALTHY"   // HTTP health check succeeded
+	ServiceStatusUnhealthy = "UNHEALTHY" // HTTP health check failed
+	ServiceStatusCrashed   = "CRASHED"   // Exited unexpectedly, restarting
+	ServiceStatusFailed    = "FAILED"    // Restart limit reached
+	ServiceStatusStopped   = "STOPPED"
+)
+
+// Payload for "SERVICE_STATUS" (Agent -> Server -> Clients)
+// Service params in CommandPayload.Params: name, port, health_path, max_restarts
+type ServiceStatusPayload struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Command   string `json:"command"`
+	PID       int    `json:"pid,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	URL       string `json:"url,omitempty"` // On the agent machine
+	Restarts  int    `json:"restarts"`
+	Error     string `json:"error,omitempty"`
+	UpdatedAt int64  `json:"updated_at"` // Unix millis
+}
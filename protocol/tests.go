@@ -0,0 +1,31 @@
+package protocol
+
+// Test report formats (TestResultsPayload.Format, CommandPayload.Params["format"])
+const (
+	TestFormatGoJSON = "gotest-json"
+	TestFormatJUnit  = "junit"
+	TestFormatTAP    = "tap"
+)
+
+// Test outcome values used in TestCaseResult.Status
+const (
+	TestStatusPass = "PASS"
+	TestStatusFail = "FAIL"
+	TestStatusSkip = "SKIP"
+)
+
+// Payload for "TEST_RESULTS" (Agent -> Server -> Clients)
+type TestResultsPayload struct {
+	JobID   string           `json:"job_id"`
+	Format  string           `json:"format"` // gotest-json, junit, tap
+	Results []TestCaseResult `json:"results"`
+}
+
+// A single parsed test case
+type TestCaseResult struct {
+	Suite      string  `json:"suite,omitempty"` // Go package, JUnit classname, ...
+	Name       string  `json:"name"`
+	Status     string  `json:"status"` // PASS, FAIL, SKIP
+	DurationMs float64 `json:"duration_ms"`
+	Output     string  `json:"output,omitempty"` // Failure message / captured output
+}
@@ -0,0 +1,40 @@
+package protocol
+
+// Payload for "TUNNEL_REQUEST" (Server -> Agent)
+// Opens a stream: an HTTP request (body follows as TUNNEL_DATA frames) or,
+// if WebSocket is set, a WebSocket connection (messages follow as TUNNEL_WS_MESSAGE).
+type TunnelRequestPayload struct {
+	StreamID  string              `json:"stream_id"`
+	Method    string              `json:"method"`
+	Path      string              `json:"path"` // Path and query, relative to the dev server root
+	Headers   map[string][]string `json:"headers"`
+	WebSocket bool                `json:"websocket,omitempty"`
+}
+
+// Payload for "TUNNEL_RESPONSE" (Agent -> Server)
+// For WebSocket streams, status 101 means the agent connected to the dev server.
+type TunnelResponsePayload struct {
+	StreamID string              `json:"stream_id"`
+	Status   int                 `json:"status"`
+	Headers  map[string][]string `json:"headers"`
+}
+
+// Payload for "TUNNEL_DATA" (both directions): a chunk of request or response body
+type TunnelDataPayload struct {
+	StreamID string `json:"stream_id"`
+	Data     []byte `json:"data,omitempty"`
+	EOF      bool   `json:"eof,omitempty"`
+}
+
+// Payload for "TUNNEL_WS_MESSAGE" (both directions)
+type TunnelWSMessagePayload struct {
+	StreamID    string `json:"stream_id"`
+	MessageType int    `json:"message_type"` // websocket.TextMessage or websocket.BinaryMessage
+	Data        []byte `json:"data"`
+}
+
+// Payload for "TUNNEL_CLOSE" (both directions): aborts or ends a stream
+type TunnelClosePayload struct {
+	StreamID string `json:"stream_id"`
+	Error    string `json:"error,omitempty"`
+}